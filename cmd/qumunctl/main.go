@@ -0,0 +1,458 @@
+// Command qumunctl talks to the control socket of a running qumun scheduler
+// (see the control package). It is pure Go and can be built without cgo.
+//
+//	qumunctl [-socket path] [-o table|json] <command> [args]
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/Gthulhu/qumun/control"
+)
+
+const usage = `usage: qumunctl [-socket path] [-o table|json] <command> [args]
+
+commands:
+  stats                       BPF counters, pool occupancy, preemptions and events
+  top [-n N]                  tasks waiting in the user-space pool, longest wait first
+  prio ls                     priority tasks
+  prio add PID...             dispatch PIDs as priority tasks
+  prio rm PID...              stop dispatching PIDs as priority tasks
+  config get [KEY]            running configuration, or one key (e.g. scheduler.policy)
+  config set KEY=VALUE...     update tunables: slice_default, slice_min, policy,
+                              capacity_aware, preempt_interval
+  topology                    CPU topology seen by the scheduler
+  exit-info                   exit state of the BPF scheduler
+  detach                      detach the scheduler and make it exit
+`
+
+var jsonOutput bool
+
+func main() {
+	fs := flag.NewFlagSet("qumunctl", flag.ContinueOnError)
+	fs.Usage = func() { fmt.Fprint(os.Stderr, usage) }
+	socket := fs.String("socket", control.DefaultSocketPath, "control socket of the scheduler")
+	output := fs.String("o", "table", "output format (table, json)")
+	if err := fs.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		os.Exit(2)
+	}
+	switch *output {
+	case "table":
+	case "json":
+		jsonOutput = true
+	default:
+		fmt.Fprintf(os.Stderr, "unknown output format %q\n", *output)
+		os.Exit(2)
+	}
+	if fs.NArg() == 0 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	c, err := control.Dial(*socket)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "qumunctl: %v (is the scheduler running with -control-socket %s?)\n", err, *socket)
+		os.Exit(1)
+	}
+	defer c.Close()
+
+	if err := run(c, fs.Arg(0), fs.Args()[1:]); err != nil {
+		fmt.Fprintf(os.Stderr, "qumunctl: %v\n", err)
+		c.Close()
+		os.Exit(1)
+	}
+}
+
+func run(c *control.Client, cmd string, args []string) error {
+	switch cmd {
+	case "stats":
+		return stats(c)
+	case "top":
+		return top(c, args)
+	case "prio":
+		return prio(c, args)
+	case "config":
+		return configCmd(c, args)
+	case "topology":
+		return topology(c)
+	case "exit-info":
+		return exitInfo(c)
+	case "detach":
+		return c.Call(control.MethodDetach, nil, nil)
+	}
+	return fmt.Errorf("unknown command %q", cmd)
+}
+
+// printJSON prints raw indented. It returns true when the json output was
+// requested, in which case the table must not be printed.
+func printJSON(raw json.RawMessage) bool {
+	if !jsonOutput {
+		return false
+	}
+	var b bytes.Buffer
+	if err := json.Indent(&b, raw, "", "  "); err != nil {
+		os.Stdout.Write(raw)
+	} else {
+		b.WriteTo(os.Stdout)
+	}
+	fmt.Println()
+	return true
+}
+
+func newTable() *tabwriter.Writer {
+	return tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+}
+
+// printCounters prints the numeric fields of a JSON object, sorted by name.
+func printCounters(title string, m map[string]json.Number) {
+	if len(m) == 0 {
+		return
+	}
+	names := make([]string, 0, len(m))
+	for k := range m {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	fmt.Println(title)
+	w := newTable()
+	for _, k := range names {
+		fmt.Fprintf(w, "  %s\t%s\n", k, m[k])
+	}
+	w.Flush()
+}
+
+func stats(c *control.Client) error {
+	raw, err := c.CallRaw(control.MethodStats, nil)
+	if err != nil || printJSON(raw) {
+		return err
+	}
+	var st struct {
+		Bss       map[string]json.Number `json:"bss"`
+		PoolCount int                    `json:"pool_count"`
+		Preempt   map[string]json.Number `json:"preempt"`
+		Events    map[string]json.Number `json:"events"`
+		Running   []struct {
+			Cpu      int32 `json:"cpu"`
+			Pid      int32 `json:"pid"`
+			Tgid     int32 `json:"tgid"`
+			Priority bool  `json:"priority"`
+		} `json:"running"`
+	}
+	if err := decodeNumbers(raw, &st); err != nil {
+		return err
+	}
+	fmt.Printf("pool_count: %d\n", st.PoolCount)
+	printCounters("bss:", st.Bss)
+	printCounters("preempt:", st.Preempt)
+	printCounters("events:", st.Events)
+	if len(st.Running) > 0 {
+		fmt.Println("running:")
+		w := newTable()
+		fmt.Fprintln(w, "  CPU\tPID\tTGID\tPRIO")
+		for _, r := range st.Running {
+			fmt.Fprintf(w, "  %d\t%d\t%d\t%v\n", r.Cpu, r.Pid, r.Tgid, r.Priority)
+		}
+		w.Flush()
+	}
+	return nil
+}
+
+func decodeNumbers(raw json.RawMessage, v any) error {
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func top(c *control.Client, args []string) error {
+	fs := flag.NewFlagSet("top", flag.ContinueOnError)
+	n := fs.Int("n", 20, "number of tasks to show (0 for all)")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	var tasks []control.QueuedTask
+	if err := c.Call(control.MethodQueuedList, nil, &tasks); err != nil {
+		return err
+	}
+	now := uint64(time.Now().UnixNano())
+	wait := func(t control.QueuedTask) time.Duration {
+		if t.Timestamp > now {
+			return 0
+		}
+		return time.Duration(now - t.Timestamp)
+	}
+	sort.SliceStable(tasks, func(i, j int) bool { return wait(tasks[i]) > wait(tasks[j]) })
+	if *n > 0 && len(tasks) > *n {
+		tasks = tasks[:*n]
+	}
+	if jsonOutput {
+		type waiting struct {
+			control.QueuedTask
+			Wait time.Duration `json:"wait"`
+		}
+		out := make([]waiting, len(tasks))
+		for i, t := range tasks {
+			out[i] = waiting{t, wait(t)}
+		}
+		raw, err := json.Marshal(out)
+		if err != nil {
+			return err
+		}
+		printJSON(raw)
+		return nil
+	}
+	w := newTable()
+	fmt.Fprintln(w, "PID\tTGID\tCPU\tWEIGHT\tWAIT\tVTIME\tDEADLINE")
+	for _, t := range tasks {
+		fmt.Fprintf(w, "%d\t%d\t%d\t%d\t%v\t%d\t%d\n", t.Pid, t.Tgid, t.Cpu, t.Weight, wait(t).Round(time.Microsecond), t.Vtime, t.Deadline)
+	}
+	return w.Flush()
+}
+
+func prio(c *control.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: prio ls|add|rm [PID...]")
+	}
+	var pids []int32
+	switch args[0] {
+	case "ls":
+		raw, err := c.CallRaw(control.MethodPriorityList, nil)
+		if err != nil || printJSON(raw) {
+			return err
+		}
+		if err := json.Unmarshal(raw, &pids); err != nil {
+			return err
+		}
+	case "add", "rm":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: prio %s PID...", args[0])
+		}
+		for _, a := range args[1:] {
+			pid, err := strconv.ParseInt(a, 10, 32)
+			if err != nil {
+				return fmt.Errorf("invalid pid %q", a)
+			}
+			p := control.PriorityParams{Pid: int32(pid), Priority: args[0] == "add"}
+			if err := c.Call(control.MethodPrioritySet, p, &pids); err != nil {
+				return fmt.Errorf("pid %d: %w", pid, err)
+			}
+		}
+		if jsonOutput {
+			raw, _ := json.Marshal(pids)
+			printJSON(raw)
+			return nil
+		}
+	default:
+		return fmt.Errorf("unknown prio command %q", args[0])
+	}
+	for _, pid := range pids {
+		fmt.Println(pid)
+	}
+	return nil
+}
+
+func configCmd(c *control.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: config get [KEY] | config set KEY=VALUE...")
+	}
+	switch args[0] {
+	case "get":
+		return configGet(c, args[1:])
+	case "set":
+		return configSet(c, args[1:])
+	}
+	return fmt.Errorf("unknown config command %q", args[0])
+}
+
+func configGet(c *control.Client, args []string) error {
+	var doc any
+	if err := c.Call(control.MethodConfig, nil, &doc); err != nil {
+		return err
+	}
+	if len(args) > 0 {
+		for _, k := range strings.Split(args[0], ".") {
+			m, ok := doc.(map[string]any)
+			if !ok {
+				return fmt.Errorf("no key %q", args[0])
+			}
+			if doc, ok = m[k]; !ok {
+				return fmt.Errorf("no key %q", args[0])
+			}
+		}
+	}
+	if !jsonOutput {
+		switch v := doc.(type) {
+		case map[string]any:
+			w := newTable()
+			printConfig(w, "", v)
+			return w.Flush()
+		case string:
+			fmt.Println(v)
+			return nil
+		}
+	}
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	if !printJSON(raw) {
+		fmt.Println(string(raw))
+	}
+	return nil
+}
+
+func printConfig(w *tabwriter.Writer, prefix string, m map[string]any) {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if sub, ok := m[k].(map[string]any); ok {
+			printConfig(w, prefix+k+".", sub)
+			continue
+		}
+		fmt.Fprintf(w, "%s%s\t%v\n", prefix, k, m[k])
+	}
+}
+
+func configSet(c *control.Client, args []string) error {
+	if len(args) == 0 {
+		return errors.New("usage: config set KEY=VALUE...")
+	}
+	var u control.TunablesUpdate
+	for _, a := range args {
+		k, v, ok := strings.Cut(a, "=")
+		if !ok {
+			return fmt.Errorf("expected KEY=VALUE, got %q", a)
+		}
+		if err := setTunable(&u, strings.TrimPrefix(k, "scheduler."), v); err != nil {
+			return err
+		}
+	}
+	var t control.Tunables
+	if err := c.Call(control.MethodTunablesSet, u, &t); err != nil {
+		return err
+	}
+	raw, err := json.Marshal(t)
+	if err != nil || printJSON(raw) {
+		return err
+	}
+	w := newTable()
+	fmt.Fprintf(w, "slice_default\t%v\n", t.SliceDefault)
+	fmt.Fprintf(w, "slice_min\t%v\n", t.SliceMin)
+	fmt.Fprintf(w, "policy\t%s\n", t.Policy)
+	fmt.Fprintf(w, "capacity_aware\t%v\n", t.CapacityAware)
+	fmt.Fprintf(w, "preempt_interval\t%v\n", t.PreemptInterval)
+	return w.Flush()
+}
+
+func setTunable(u *control.TunablesUpdate, key, value string) error {
+	duration := func() (*time.Duration, error) {
+		d, err := time.ParseDuration(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		return &d, nil
+	}
+	var err error
+	switch key {
+	case "slice_default":
+		u.SliceDefault, err = duration()
+	case "slice_min":
+		u.SliceMin, err = duration()
+	case "preempt_interval":
+		u.PreemptInterval, err = duration()
+	case "policy":
+		u.Policy = &value
+	case "capacity_aware":
+		var b bool
+		b, err = strconv.ParseBool(value)
+		u.CapacityAware = &b
+	default:
+		return fmt.Errorf("%s cannot be changed at runtime", key)
+	}
+	return err
+}
+
+func topology(c *control.Client) error {
+	raw, err := c.CallRaw(control.MethodTopology, nil)
+	if err != nil || printJSON(raw) {
+		return err
+	}
+	type domain struct {
+		ID int `json:"id"`
+	}
+	var topo struct {
+		CPUs []struct {
+			ID      int  `json:"id"`
+			Online  bool `json:"online"`
+			Package int  `json:"package"`
+			Node    int  `json:"node"`
+			LLC     int  `json:"llc"`
+			L2      int  `json:"l2"`
+			Core    int  `json:"core"`
+		} `json:"cpus"`
+		Packages []domain `json:"packages"`
+		Nodes    []domain `json:"nodes"`
+		LLCs     []domain `json:"llcs"`
+		L2s      []domain `json:"l2s"`
+		Cores    []domain `json:"cores"`
+	}
+	if err := json.Unmarshal(raw, &topo); err != nil {
+		return err
+	}
+	id := func(ds []domain, i int) string {
+		if i < 0 || i >= len(ds) {
+			return "-"
+		}
+		return strconv.Itoa(ds[i].ID)
+	}
+	w := newTable()
+	fmt.Fprintln(w, "CPU\tONLINE\tPACKAGE\tNODE\tLLC\tL2\tCORE")
+	for _, cpu := range topo.CPUs {
+		fmt.Fprintf(w, "%d\t%v\t%s\t%s\t%s\t%s\t%s\n", cpu.ID, cpu.Online,
+			id(topo.Packages, cpu.Package), id(topo.Nodes, cpu.Node), id(topo.LLCs, cpu.LLC),
+			id(topo.L2s, cpu.L2), id(topo.Cores, cpu.Core))
+	}
+	return w.Flush()
+}
+
+func exitInfo(c *control.Client) error {
+	raw, err := c.CallRaw(control.MethodExitInfo, nil)
+	if err != nil || printJSON(raw) {
+		return err
+	}
+	var info struct {
+		control.ExitInfo
+		Events map[string]json.Number `json:"events"`
+	}
+	if err := decodeNumbers(raw, &info); err != nil {
+		return err
+	}
+	w := newTable()
+	fmt.Fprintf(w, "running\t%v\n", info.Running)
+	fmt.Fprintf(w, "kind\t%d\n", info.Kind)
+	fmt.Fprintf(w, "exit_code\t%d\n", info.ExitCode)
+	if info.Reason != "" {
+		fmt.Fprintf(w, "reason\t%s\n", info.Reason)
+	}
+	if info.Message != "" {
+		fmt.Fprintf(w, "message\t%s\n", info.Message)
+	}
+	w.Flush()
+	printCounters("events:", info.Events)
+	return nil
+}
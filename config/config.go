@@ -0,0 +1,414 @@
+package config
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Gthulhu/qumun/control"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	PolicyVtime = "vtime" // order tasks by deadline (vruntime + exec runtime)
+	PolicyFifo  = "fifo"  // order tasks by arrival in the user-space pool
+)
+
+// Config holds every knob of the scheduler binary. It can be loaded from a
+// YAML file and overridden from the command line.
+type Config struct {
+	BPFObject string          `yaml:"bpf_object"`
+	LogLevel  string          `yaml:"log_level"`
+	Record    string          `yaml:"record"` // trace file of the queued/dispatched tasks, empty to disable
+	Replay    string          `yaml:"-"`      // replay a trace offline instead of attaching the scheduler
+	Scheduler SchedulerConfig `yaml:"scheduler"`
+	Partial   PartialConfig   `yaml:"partial"`
+	Stats     StatsConfig     `yaml:"stats"`
+	Control   ControlConfig   `yaml:"control"`
+	Trace     TraceConfig     `yaml:"trace"`
+}
+
+// SchedulerConfig contains the BPF rodata knobs and the user-space policy
+// parameters.
+type SchedulerConfig struct {
+	Debug           bool          `yaml:"debug"`
+	BuiltinIdle     bool          `yaml:"builtin_idle"`
+	EarlyProcessing bool          `yaml:"early_processing"`
+	DefaultSlice    time.Duration `yaml:"default_slice"`    // slice used by the BPF side for kthreads and the scheduler itself
+	SliceNsDefault  time.Duration `yaml:"slice_default"`    // upper bound of the slice assigned by the policy
+	SliceNsMin      time.Duration `yaml:"slice_min"`        // lower bound of the slice assigned by the policy
+	TaskPoolSize    int           `yaml:"task_pool_size"`   // slots of the user-space task pool
+	PoolBatch       int           `yaml:"pool_batch"`       // tasks pooled before dispatching again once the pool is empty
+	PollInterval    time.Duration `yaml:"poll_interval"`    // how often the exit state of the BPF side is checked
+	HeartbeatPeriod time.Duration `yaml:"heartbeat_period"` // the BPF side wakes up the scheduler after this much inactivity
+	WatchdogTimeout time.Duration `yaml:"watchdog_timeout"` // the kernel ejects the scheduler when a task waits this long
+	Policy          string        `yaml:"policy"`
+	PreemptInterval time.Duration `yaml:"preempt_interval"` // minimum interval between two preemptions of the same CPU
+	CapacityAware   bool          `yaml:"capacity_aware"`   // steer interactive tasks to high-capacity CPUs
+	UserschedCpus   string        `yaml:"usersched_cpus"`   // CPU list dedicated to the user-space scheduler, e.g. "0-1"
+	ReservedCpus    string        `yaml:"reserved_cpus"`    // CPU list reserved to priority tasks
+
+	StarvationThreshold time.Duration `yaml:"starvation_threshold"` // wait after which a task is reported as starving, 0 to disable (see defaultStarvationThreshold)
+	StarvationDispatch  bool          `yaml:"starvation_dispatch"`  // dispatch starving tasks of the pool to the shared DSQ
+
+	QueuedRingSize      int `yaml:"queued_ring_size"`     // tasks the queue from the BPF side holds
+	CongestionWatermark int `yaml:"congestion_watermark"` // queue fill (%) above which non-interactive tasks bypass user space, 0 to disable
+
+	QueuedShards     string `yaml:"queued_shards"`     // split the queue from the BPF side: none, cpu or llc
+	ParallelDispatch bool   `yaml:"parallel_dispatch"` // one scheduling loop per shard of the queue, pinned to its CPUs unless UserschedCpus is set
+}
+
+// PartialConfig enables the partial switch mode, where only the listed
+// processes (and their descendants) and cgroups are scheduled by qumun.
+type PartialConfig struct {
+	Enabled bool     `yaml:"enabled"`
+	Pids    []int    `yaml:"pids"`    // process trees moved to SCHED_EXT
+	Cgroups []string `yaml:"cgroups"` // cgroup v2 directories moved to SCHED_EXT
+}
+
+// StatsConfig controls how scheduler statistics are exposed.
+type StatsConfig struct {
+	Address  string        `yaml:"address"`  // HTTP listen address serving /stats, empty to disable
+	Interval time.Duration `yaml:"interval"` // period of the stats log line, 0 to disable
+}
+
+// ControlConfig controls the local control API (see the control package).
+type ControlConfig struct {
+	Socket string `yaml:"socket"` // Unix socket path, empty to disable
+}
+
+// TraceConfig controls the structured task events of the BPF side.
+type TraceConfig struct {
+	Output     string   `yaml:"output"`      // file receiving the events, empty to disable
+	Format     string   `yaml:"format"`      // jsonl or chrome
+	SampleRate uint32   `yaml:"sample_rate"` // keep one event out of sample_rate
+	Pids       []int    `yaml:"pids"`        // only trace these pids or tgids
+	Comms      []string `yaml:"comms"`       // only trace these commands
+}
+
+// Default returns the configuration used when neither a config file nor
+// flags are given.
+func Default() Config {
+	return Config{
+		BPFObject: "main.bpf.o",
+		LogLevel:  "info",
+		Scheduler: SchedulerConfig{
+			Debug:           false,
+			BuiltinIdle:     true,
+			EarlyProcessing: false,
+			DefaultSlice:    20 * time.Millisecond,
+			SliceNsDefault:  5 * time.Millisecond,
+			SliceNsMin:      500 * time.Microsecond,
+			TaskPoolSize:    4096,
+			PoolBatch:       10,
+			PollInterval:    1 * time.Second,
+			HeartbeatPeriod: 100 * time.Millisecond,
+			WatchdogTimeout: 5 * time.Second,
+			Policy:          PolicyVtime,
+			PreemptInterval: 1 * time.Millisecond,
+
+			StarvationThreshold: defaultStarvationThreshold(5 * time.Second),
+			QueuedRingSize:      4096,
+			CongestionWatermark: 0,
+			QueuedShards:        "none",
+		},
+		Control: ControlConfig{
+			Socket: control.DefaultSocketPath,
+		},
+		Trace: TraceConfig{
+			Format:     "jsonl",
+			SampleRate: 1,
+		},
+	}
+}
+
+// defaultStarvationThreshold is the starvation threshold used with the
+// given watchdog timeout when none is configured: 1s, or half the timeout
+// if that is less, so that starving tasks are found before the kernel
+// ejects the scheduler.
+func defaultStarvationThreshold(watchdog time.Duration) time.Duration {
+	return min(time.Second, watchdog/2)
+}
+
+// Load reads a YAML config file on top of the default configuration.
+func Load(path string) (Config, error) {
+	cfg, explicit, err := load(path)
+	if err == nil && !explicit {
+		cfg.Scheduler.StarvationThreshold = defaultStarvationThreshold(cfg.Scheduler.WatchdogTimeout)
+	}
+	return cfg, err
+}
+
+// load is Load, also reporting whether the file sets the starvation
+// threshold.
+func load(path string) (Config, bool, error) {
+	cfg := Default()
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		return cfg, false, err
+	}
+	dec := yaml.NewDecoder(bytes.NewReader(raw))
+	dec.KnownFields(true)
+	if err := dec.Decode(&cfg); err != nil && err != io.EOF {
+		return cfg, false, fmt.Errorf("parse %s: %w", path, err)
+	}
+	var set struct {
+		Scheduler struct {
+			StarvationThreshold *time.Duration `yaml:"starvation_threshold"`
+		} `yaml:"scheduler"`
+	}
+	yaml.Unmarshal(raw, &set)
+	return cfg, set.Scheduler.StarvationThreshold != nil, nil
+}
+
+// Parse builds the configuration from the command line: the file given by
+// -config (if any) is loaded first and explicitly set flags override it.
+func Parse(name string, args []string) (Config, error) {
+	probe := Default()
+	fs := newFlagSet(name, &probe)
+	if err := fs.Parse(args); err != nil {
+		return probe, err
+	}
+
+	cfg := Default()
+	var explicit bool
+	if path := fs.Lookup("config").Value.String(); path != "" {
+		var err error
+		cfg, explicit, err = load(path)
+		if err != nil {
+			return cfg, err
+		}
+	}
+
+	// Re-parse with the loaded values as defaults, so that only the flags
+	// present on the command line replace what the file says.
+	fs = newFlagSet(name, &cfg)
+	if err := fs.Parse(args); err != nil {
+		return cfg, err
+	}
+	fs.Visit(func(f *flag.Flag) {
+		explicit = explicit || f.Name == "starvation-threshold"
+	})
+	if !explicit {
+		cfg.Scheduler.StarvationThreshold = defaultStarvationThreshold(cfg.Scheduler.WatchdogTimeout)
+	}
+	return cfg, cfg.Validate()
+}
+
+func newFlagSet(name string, cfg *Config) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.String("config", "", "path of a YAML config file")
+	fs.StringVar(&cfg.BPFObject, "bpf-obj", cfg.BPFObject, "path of the BPF object")
+	fs.StringVar(&cfg.LogLevel, "log-level", cfg.LogLevel, "log level (debug, info, warn, error)")
+	fs.StringVar(&cfg.Record, "record", cfg.Record, "record queued and dispatched tasks to this trace file")
+	fs.StringVar(&cfg.Replay, "replay", cfg.Replay, "replay a recorded trace into the policy and print the differences")
+
+	s := &cfg.Scheduler
+	fs.BoolVar(&s.Debug, "debug", s.Debug, "print BPF debug messages to trace_pipe")
+	fs.BoolVar(&s.BuiltinIdle, "builtin-idle", s.BuiltinIdle, "let the BPF side pick idle CPUs and dispatch directly")
+	fs.BoolVar(&s.EarlyProcessing, "early-processing", s.EarlyProcessing, "dispatch per-CPU kthreads directly from BPF")
+	fs.DurationVar(&s.DefaultSlice, "default-slice", s.DefaultSlice, "slice of tasks dispatched by the BPF side")
+	fs.DurationVar(&s.SliceNsDefault, "slice-default", s.SliceNsDefault, "maximum slice assigned by the policy")
+	fs.DurationVar(&s.SliceNsMin, "slice-min", s.SliceNsMin, "minimum slice assigned by the policy")
+	fs.IntVar(&s.TaskPoolSize, "pool-size", s.TaskPoolSize, "slots of the user-space task pool")
+	fs.IntVar(&s.PoolBatch, "pool-batch", s.PoolBatch, "tasks pooled before dispatching again once the pool is empty (1 to dispatch each task at once)")
+	fs.DurationVar(&s.PollInterval, "poll-interval", s.PollInterval, "interval to check whether the BPF scheduler exited")
+	fs.DurationVar(&s.HeartbeatPeriod, "heartbeat-period", s.HeartbeatPeriod, "wake up the user-space scheduler after this much inactivity")
+	fs.DurationVar(&s.WatchdogTimeout, "watchdog-timeout", s.WatchdogTimeout, "sched_ext watchdog timeout: the scheduler is ejected when a task waits this long")
+	fs.StringVar(&s.Policy, "policy", s.Policy, "scheduling policy (vtime, fifo)")
+	fs.BoolVar(&s.CapacityAware, "capacity-aware", s.CapacityAware, "prefer high-capacity CPUs for interactive tasks and efficient CPUs for CPU-bound ones")
+	fs.StringVar(&s.UserschedCpus, "usersched-cpus", s.UserschedCpus, "CPU list dedicated to the user-space scheduler (e.g. 0-1)")
+	fs.StringVar(&s.ReservedCpus, "reserved-cpus", s.ReservedCpus, "CPU list reserved to priority tasks")
+	fs.DurationVar(&s.PreemptInterval, "preempt-interval", s.PreemptInterval, "minimum interval between two preemptions of the same CPU (0 to disable)")
+	fs.DurationVar(&s.StarvationThreshold, "starvation-threshold", s.StarvationThreshold, "report tasks waiting longer than this for a CPU (0 to disable)")
+	fs.BoolVar(&s.StarvationDispatch, "starvation-dispatch", s.StarvationDispatch, "dispatch the starving tasks of the pool to the shared DSQ")
+	fs.IntVar(&s.QueuedRingSize, "queued-ring-size", s.QueuedRingSize, "tasks the queue from the BPF side holds")
+	fs.IntVar(&s.CongestionWatermark, "congestion-watermark", s.CongestionWatermark, "queue fill (%) above which non-interactive tasks bypass user space (0 to disable)")
+	fs.StringVar(&s.QueuedShards, "queued-shards", s.QueuedShards, "split the queue from the BPF side per CPU or per LLC (none, cpu, llc)")
+	fs.BoolVar(&s.ParallelDispatch, "parallel-dispatch", s.ParallelDispatch, "run one scheduling loop per shard of the queue, on the CPUs of the shard (or on the usersched CPUs if set)")
+
+	fs.BoolVar(&cfg.Partial.Enabled, "partial", cfg.Partial.Enabled, "only schedule the tasks moved to SCHED_EXT (SCX_OPS_SWITCH_PARTIAL)")
+	fs.Var((*intList)(&cfg.Partial.Pids), "partial-pids", "comma-separated pids whose process trees are moved to SCHED_EXT")
+	fs.Var((*stringList)(&cfg.Partial.Cgroups), "partial-cgroups", "comma-separated cgroup v2 directories moved to SCHED_EXT")
+
+	fs.StringVar(&cfg.Stats.Address, "stats-addr", cfg.Stats.Address, "HTTP address serving /stats (empty to disable)")
+	fs.DurationVar(&cfg.Stats.Interval, "stats-interval", cfg.Stats.Interval, "interval of the stats log line (0 to disable)")
+	fs.StringVar(&cfg.Trace.Output, "trace", cfg.Trace.Output, "write structured task events to this file")
+	fs.StringVar(&cfg.Trace.Format, "trace-format", cfg.Trace.Format, "format of the task events (jsonl, chrome)")
+	fs.Func("trace-sample", "keep one task event out of N", func(v string) error {
+		n, err := strconv.ParseUint(v, 10, 32)
+		cfg.Trace.SampleRate = uint32(n)
+		return err
+	})
+	fs.Var((*intList)(&cfg.Trace.Pids), "trace-pids", "comma-separated pids or tgids to trace")
+	fs.Var((*stringList)(&cfg.Trace.Comms), "trace-comms", "comma-separated commands to trace")
+	fs.StringVar(&cfg.Control.Socket, "control-socket", cfg.Control.Socket, "Unix socket of the control API (empty to disable)")
+	return fs
+}
+
+// Document returns c keyed like the YAML file, with durations as strings,
+// so that it can be encoded in other formats (e.g. JSON) the same way.
+func (c Config) Document() (map[string]any, error) {
+	b, err := yaml.Marshal(c)
+	if err != nil {
+		return nil, err
+	}
+	var doc map[string]any
+	if err := yaml.Unmarshal(b, &doc); err != nil {
+		return nil, err
+	}
+	return doc, nil
+}
+
+// Validate reports the first inconsistent setting.
+func (c Config) Validate() error {
+	s := c.Scheduler
+	if c.BPFObject == "" {
+		return fmt.Errorf("bpf_object must not be empty")
+	}
+	if _, err := c.SlogLevel(); err != nil {
+		return err
+	}
+	if s.DefaultSlice <= 0 {
+		return fmt.Errorf("default_slice must be positive, got %v", s.DefaultSlice)
+	}
+	if s.SliceNsMin <= 0 {
+		return fmt.Errorf("slice_min must be positive, got %v", s.SliceNsMin)
+	}
+	if s.SliceNsDefault < s.SliceNsMin {
+		return fmt.Errorf("slice_default (%v) is less than slice_min (%v)", s.SliceNsDefault, s.SliceNsMin)
+	}
+	if s.TaskPoolSize < 2 {
+		return fmt.Errorf("task_pool_size must be at least 2, got %d", s.TaskPoolSize)
+	}
+	if s.PoolBatch < 1 {
+		return fmt.Errorf("pool_batch must be at least 1, got %d", s.PoolBatch)
+	}
+	if s.PollInterval <= 0 {
+		return fmt.Errorf("poll_interval must be positive, got %v", s.PollInterval)
+	}
+	if s.HeartbeatPeriod <= 0 {
+		return fmt.Errorf("heartbeat_period must be positive, got %v", s.HeartbeatPeriod)
+	}
+	if s.WatchdogTimeout < time.Millisecond || s.WatchdogTimeout > dataplane.MaxWatchdogTimeout {
+		return fmt.Errorf("watchdog_timeout must be between 1ms and %v, got %v", dataplane.MaxWatchdogTimeout, s.WatchdogTimeout)
+	}
+	if s.HeartbeatPeriod >= s.WatchdogTimeout {
+		return fmt.Errorf("heartbeat_period (%v) must be less than watchdog_timeout (%v)", s.HeartbeatPeriod, s.WatchdogTimeout)
+	}
+	if s.PreemptInterval < 0 {
+		return fmt.Errorf("preempt_interval must not be negative, got %v", s.PreemptInterval)
+	}
+	if s.StarvationThreshold < 0 {
+		return fmt.Errorf("starvation_threshold must not be negative, got %v", s.StarvationThreshold)
+	}
+	if s.StarvationDispatch && s.StarvationThreshold == 0 {
+		return fmt.Errorf("starvation_dispatch requires a starvation_threshold")
+	}
+	if s.QueuedRingSize < 1 || s.QueuedRingSize > 1<<20 {
+		return fmt.Errorf("queued_ring_size must be between 1 and %d, got %d", 1<<20, s.QueuedRingSize)
+	}
+	if s.CongestionWatermark < 0 || s.CongestionWatermark > 100 {
+		return fmt.Errorf("congestion_watermark must be a percentage, got %d", s.CongestionWatermark)
+	}
+	if s.StarvationThreshold >= s.WatchdogTimeout {
+		return fmt.Errorf("starvation_threshold (%v) must be less than watchdog_timeout (%v)", s.StarvationThreshold, s.WatchdogTimeout)
+	}
+	switch s.Policy {
+	case PolicyVtime, PolicyFifo:
+	default:
+		return fmt.Errorf("unknown policy %q", s.Policy)
+	}
+	switch s.QueuedShards {
+	case "none", "cpu", "llc":
+	default:
+		return fmt.Errorf("unknown queued_shards mode %q", s.QueuedShards)
+	}
+	if s.ParallelDispatch && s.QueuedShards == "none" {
+		return fmt.Errorf("parallel_dispatch requires queued_shards (cpu or llc)")
+	}
+	if !c.Partial.Enabled && (len(c.Partial.Pids) > 0 || len(c.Partial.Cgroups) > 0) {
+		return fmt.Errorf("partial pids and cgroups require partial mode to be enabled")
+	}
+	if c.Trace.Output != "" {
+		switch c.Trace.Format {
+		case "jsonl", "chrome":
+		default:
+			return fmt.Errorf("unknown trace format %q", c.Trace.Format)
+		}
+		if c.Trace.SampleRate == 0 {
+			return fmt.Errorf("trace sample_rate must be at least 1")
+		}
+	}
+	if c.Stats.Interval < 0 {
+		return fmt.Errorf("stats interval must not be negative, got %v", c.Stats.Interval)
+	}
+	return nil
+}
+
+// SlogLevel converts LogLevel into a slog.Level.
+func (c Config) SlogLevel() (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(c.LogLevel)); err != nil {
+		return l, fmt.Errorf("invalid log_level %q", c.LogLevel)
+	}
+	return l, nil
+}
+
+// intList is a flag.Value for a comma-separated list of integers; setting it
+// replaces the current list.
+type intList []int
+
+func (l *intList) String() string {
+	if l == nil {
+		return ""
+	}
+	s := make([]string, len(*l))
+	for i, v := range *l {
+		s[i] = strconv.Itoa(v)
+	}
+	return strings.Join(s, ",")
+}
+
+func (l *intList) Set(v string) error {
+	*l = nil
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f == "" {
+			continue
+		}
+		n, err := strconv.Atoi(f)
+		if err != nil {
+			return err
+		}
+		*l = append(*l, n)
+	}
+	return nil
+}
+
+// stringList is a flag.Value for a comma-separated list of strings; setting
+// it replaces the current list.
+type stringList []string
+
+func (l *stringList) String() string {
+	if l == nil {
+		return ""
+	}
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(v string) error {
+	*l = nil
+	for _, f := range strings.Split(v, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			*l = append(*l, f)
+		}
+	}
+	return nil
+}
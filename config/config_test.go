@@ -0,0 +1,159 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// writeConfig writes a YAML config file and returns its path.
+func writeConfig(t *testing.T, yaml string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "qumun.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+const testFile = `
+log_level: debug
+scheduler:
+  policy: fifo
+  slice_default: 4ms
+  watchdog_timeout: 10s
+partial:
+  enabled: true
+  pids: [1, 2]
+trace:
+  comms: [a, b]
+`
+
+func TestParse(t *testing.T) {
+	path := writeConfig(t, testFile)
+	tests := []struct {
+		name  string
+		args  []string
+		check func(c Config) bool
+	}{
+		{"defaults", nil, func(c Config) bool {
+			return reflect.DeepEqual(c, Default())
+		}},
+		{"file only", []string{"-config", path}, func(c Config) bool {
+			s := c.Scheduler
+			return c.LogLevel == "debug" && s.Policy == PolicyFifo && s.SliceNsDefault == 4*time.Millisecond &&
+				s.SliceNsMin == Default().Scheduler.SliceNsMin && s.WatchdogTimeout == 10*time.Second &&
+				reflect.DeepEqual(c.Partial.Pids, []int{1, 2}) && reflect.DeepEqual(c.Trace.Comms, []string{"a", "b"})
+		}},
+		{"flag over file", []string{"-policy", "vtime", "-config", path, "-partial-pids", "3", "-trace-comms", " c ,"}, func(c Config) bool {
+			return c.Scheduler.Policy == PolicyVtime && c.Scheduler.SliceNsDefault == 4*time.Millisecond &&
+				reflect.DeepEqual(c.Partial.Pids, []int{3}) && reflect.DeepEqual(c.Trace.Comms, []string{"c"})
+		}},
+		{"derived starvation threshold", []string{"-watchdog-timeout", "500ms"}, func(c Config) bool {
+			return c.Scheduler.StarvationThreshold == 250*time.Millisecond
+		}},
+		{"explicit starvation threshold", []string{"-watchdog-timeout", "500ms", "-starvation-threshold", "100ms"}, func(c Config) bool {
+			return c.Scheduler.StarvationThreshold == 100*time.Millisecond
+		}},
+	}
+	for _, tt := range tests {
+		c, err := Parse("qumun", tt.args)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if !tt.check(c) {
+			t.Errorf("%s: unexpected config %+v", tt.name, c)
+		}
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		yaml string
+		err  string
+	}{
+		{name: "bad duration flag", args: []string{"-slice-min", "1"}, err: "invalid value"},
+		{name: "bad int list", args: []string{"-partial", "-partial-pids", "1,x"}, err: "invalid value"},
+		{name: "bad trace sample", args: []string{"-trace-sample", "-1"}, err: "invalid value"},
+		{name: "unknown flag", args: []string{"-nope"}, err: "not defined"},
+		{name: "missing file", args: []string{"-config", "/nonexistent/qumun.yaml"}, err: "no such file"},
+		{name: "bad duration in file", yaml: "scheduler:\n  slice_min: fast\n", err: "parse"},
+		{name: "unknown key in file", yaml: "scheduler:\n  nope: 1\n", err: "field nope not found"},
+		{name: "invalid value in file", yaml: "scheduler:\n  policy: rr\n", err: `unknown policy "rr"`},
+		{name: "explicit starvation threshold in file", yaml: "scheduler:\n  watchdog_timeout: 500ms\n  starvation_threshold: 1s\n", err: "starvation_threshold (1s) must be less than watchdog_timeout (500ms)"},
+	}
+	for _, tt := range tests {
+		args := tt.args
+		if tt.yaml != "" {
+			args = append([]string{"-config", writeConfig(t, tt.yaml)}, args...)
+		}
+		_, err := Parse("qumun", args)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	c, err := Load(writeConfig(t, "scheduler:\n  watchdog_timeout: 600ms\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Scheduler.StarvationThreshold != 300*time.Millisecond {
+		t.Errorf("starvation threshold %v", c.Scheduler.StarvationThreshold)
+	}
+	c, err = Load(writeConfig(t, ""))
+	if err != nil || !reflect.DeepEqual(c, Default()) {
+		t.Errorf("empty file: %+v, %v", c, err)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	tests := []struct {
+		set func(c *Config)
+		err string
+	}{
+		{func(c *Config) { c.BPFObject = "" }, "bpf_object must not be empty"},
+		{func(c *Config) { c.LogLevel = "loud" }, `invalid log_level "loud"`},
+		{func(c *Config) { c.Scheduler.DefaultSlice = 0 }, "default_slice must be positive"},
+		{func(c *Config) { c.Scheduler.SliceNsMin = -1 }, "slice_min must be positive"},
+		{func(c *Config) { c.Scheduler.SliceNsDefault = time.Microsecond }, "slice_default (1µs) is less than slice_min"},
+		{func(c *Config) { c.Scheduler.TaskPoolSize = 1 }, "task_pool_size must be at least 2"},
+		{func(c *Config) { c.Scheduler.PoolBatch = 0 }, "pool_batch must be at least 1"},
+		{func(c *Config) { c.Scheduler.PollInterval = 0 }, "poll_interval must be positive"},
+		{func(c *Config) { c.Scheduler.HeartbeatPeriod = 0 }, "heartbeat_period must be positive"},
+		{func(c *Config) { c.Scheduler.WatchdogTimeout = time.Microsecond }, "watchdog_timeout must be between 1ms and 30s"},
+		{func(c *Config) { c.Scheduler.WatchdogTimeout = time.Minute }, "watchdog_timeout must be between 1ms and 30s"},
+		{func(c *Config) { c.Scheduler.HeartbeatPeriod = 5 * time.Second }, "heartbeat_period (5s) must be less than watchdog_timeout"},
+		{func(c *Config) { c.Scheduler.PreemptInterval = -1 }, "preempt_interval must not be negative"},
+		{func(c *Config) { c.Scheduler.StarvationThreshold = -1 }, "starvation_threshold must not be negative"},
+		{func(c *Config) { c.Scheduler.StarvationThreshold = 0; c.Scheduler.StarvationDispatch = true }, "starvation_dispatch requires a starvation_threshold"},
+		{func(c *Config) { c.Scheduler.QueuedRingSize = 0 }, "queued_ring_size must be between 1 and"},
+		{func(c *Config) { c.Scheduler.CongestionWatermark = 101 }, "congestion_watermark must be a percentage"},
+		{func(c *Config) { c.Scheduler.StarvationThreshold = 5 * time.Second }, "starvation_threshold (5s) must be less than watchdog_timeout (5s)"},
+		{func(c *Config) { c.Scheduler.Policy = "rr" }, `unknown policy "rr"`},
+		{func(c *Config) { c.Scheduler.QueuedShards = "numa" }, `unknown queued_shards mode "numa"`},
+		{func(c *Config) { c.Scheduler.ParallelDispatch = true }, "parallel_dispatch requires queued_shards"},
+		{func(c *Config) { c.Partial.Pids = []int{1} }, "partial pids and cgroups require partial mode"},
+		{func(c *Config) { c.Trace.Output = "t.json"; c.Trace.Format = "xml" }, `unknown trace format "xml"`},
+		{func(c *Config) { c.Trace.Output = "t.json"; c.Trace.SampleRate = 0 }, "trace sample_rate must be at least 1"},
+		{func(c *Config) { c.Stats.Interval = -1 }, "stats interval must not be negative"},
+	}
+	if err := Default().Validate(); err != nil {
+		t.Fatalf("default config: %v", err)
+	}
+	for _, tt := range tests {
+		c := Default()
+		tt.set(&c)
+		err := c.Validate()
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("error %v, want %q", err, tt.err)
+		}
+	}
+}
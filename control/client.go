@@ -0,0 +1,78 @@
+package control
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"time"
+)
+
+// Client calls the control API of a running scheduler.
+type Client struct {
+	conn    net.Conn
+	sc      *bufio.Scanner
+	Timeout time.Duration // deadline of each call, 0 for none
+}
+
+// Dial connects to the control socket at path.
+func Dial(path string) (*Client, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), 64*maxRequestSize)
+	return &Client{conn: conn, sc: sc, Timeout: 5 * time.Second}, nil
+}
+
+// Close closes the connection.
+func (c *Client) Close() error {
+	return c.conn.Close()
+}
+
+// Call runs method with params (nil for none) and decodes its result into
+// result (nil to discard it).
+func (c *Client) Call(method string, params, result any) error {
+	raw, err := c.CallRaw(method, params)
+	if err != nil {
+		return err
+	}
+	if result == nil || len(raw) == 0 {
+		return nil
+	}
+	return json.Unmarshal(raw, result)
+}
+
+// CallRaw is like Call but returns the result undecoded.
+func (c *Client) CallRaw(method string, params any) (json.RawMessage, error) {
+	req := Request{Method: method}
+	if params != nil {
+		b, err := json.Marshal(params)
+		if err != nil {
+			return nil, err
+		}
+		req.Params = b
+	}
+	if c.Timeout > 0 {
+		c.conn.SetDeadline(time.Now().Add(c.Timeout))
+	}
+	if err := json.NewEncoder(c.conn).Encode(req); err != nil {
+		return nil, err
+	}
+	if !c.sc.Scan() {
+		if err := c.sc.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("control: connection closed")
+	}
+	var resp Response
+	if err := json.Unmarshal(c.sc.Bytes(), &resp); err != nil {
+		return nil, fmt.Errorf("control: bad response: %w", err)
+	}
+	if resp.Error != "" {
+		return nil, errors.New(resp.Error)
+	}
+	return resp.Result, nil
+}
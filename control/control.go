@@ -0,0 +1,137 @@
+// Package control implements the local control API of a running scheduler:
+// newline-delimited JSON requests and responses over a Unix domain socket.
+//
+// A request names a method and carries its parameters:
+//
+//	{"method":"priority.set","params":{"pid":1234,"priority":true}}
+//
+// and is answered with either a result or an error:
+//
+//	{"result":[1234]}
+//	{"error":"unknown method \"foo\""}
+//
+// The package does not depend on goland_core, so that clients can be built
+// without cgo or libbpf.
+package control
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Methods of the control API.
+const (
+	MethodStats        = "stats"         // result: the same document as the /stats endpoint
+	MethodConfig       = "config"        // result: the running configuration
+	MethodTunablesGet  = "tunables.get"  // result: Tunables
+	MethodTunablesSet  = "tunables.set"  // params: TunablesUpdate, result: Tunables
+	MethodPriorityList = "priority.list" // result: []int32
+	MethodPrioritySet  = "priority.set"  // params: PriorityParams, result: []int32
+	MethodQueuedList   = "queued.list"   // result: []QueuedTask
+	MethodTopology     = "topology"      // result: the CPU topology
+	MethodExitInfo     = "exit_info"     // result: ExitInfo
+	MethodDetach       = "detach"        // detach the scheduler and exit, as on SIGTERM
+)
+
+// DefaultSocketPath is the socket path used by the documentation and, by
+// default, by clients.
+const DefaultSocketPath = "/run/qumun/qumun.sock"
+
+const maxRequestSize = 1 << 20
+
+// Request is a call of method with its JSON encoded params.
+type Request struct {
+	Method string          `json:"method"`
+	Params json.RawMessage `json:"params,omitempty"`
+}
+
+// Response carries the JSON encoded result of a request, or its error.
+type Response struct {
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  string          `json:"error,omitempty"`
+}
+
+// Tunables are the policy parameters that can be changed at runtime.
+type Tunables struct {
+	SliceDefault    time.Duration `json:"slice_default"`    // upper bound of the slice assigned by the policy (ns)
+	SliceMin        time.Duration `json:"slice_min"`        // lower bound of the slice assigned by the policy (ns)
+	Policy          string        `json:"policy"`           // vtime or fifo
+	CapacityAware   bool          `json:"capacity_aware"`   // steer interactive tasks to high-capacity CPUs
+	PreemptInterval time.Duration `json:"preempt_interval"` // minimum interval between two preemptions of a CPU (ns)
+}
+
+// TunablesUpdate changes the non-nil fields of Tunables.
+type TunablesUpdate struct {
+	SliceDefault    *time.Duration `json:"slice_default,omitempty"`
+	SliceMin        *time.Duration `json:"slice_min,omitempty"`
+	Policy          *string        `json:"policy,omitempty"`
+	CapacityAware   *bool          `json:"capacity_aware,omitempty"`
+	PreemptInterval *time.Duration `json:"preempt_interval,omitempty"`
+}
+
+// Apply returns t with the fields set in u replaced.
+func (u TunablesUpdate) Apply(t Tunables) Tunables {
+	if u.SliceDefault != nil {
+		t.SliceDefault = *u.SliceDefault
+	}
+	if u.SliceMin != nil {
+		t.SliceMin = *u.SliceMin
+	}
+	if u.Policy != nil {
+		t.Policy = *u.Policy
+	}
+	if u.CapacityAware != nil {
+		t.CapacityAware = *u.CapacityAware
+	}
+	if u.PreemptInterval != nil {
+		t.PreemptInterval = *u.PreemptInterval
+	}
+	return t
+}
+
+// PriorityParams adds (Priority true) or removes a task from the priority
+// tasks, which are dispatched with a zero vtime.
+type PriorityParams struct {
+	Pid      int32 `json:"pid"`
+	Priority bool  `json:"priority"`
+}
+
+// QueuedTask is a task held in the user-space pool, waiting to be
+// dispatched.
+type QueuedTask struct {
+	Pid            int32  `json:"pid"`
+	Tgid           int32  `json:"tgid"`
+	Cpu            int32  `json:"cpu"` // CPU the task last ran on
+	Weight         uint64 `json:"weight"`
+	Vtime          uint64 `json:"vtime"`
+	SumExecRuntime uint64 `json:"sum_exec_runtime"`
+	Deadline       uint64 `json:"deadline"`
+	Timestamp      uint64 `json:"timestamp"` // when the task entered the pool (ns)
+}
+
+// ExitInfo is the exit state of the BPF scheduler (struct user_exit_info)
+// along with the sched_ext event counters, when the kernel has them.
+type ExitInfo struct {
+	Running  bool   `json:"running"` // the BPF scheduler has not exited
+	Kind     int32  `json:"kind"`
+	ExitCode int64  `json:"exit_code"`
+	Reason   string `json:"reason,omitempty"`
+	Message  string `json:"message,omitempty"`
+	Events   any    `json:"events,omitempty"`
+}
+
+// Backend is the running scheduler, as seen by the control server. Its
+// methods are called from the server goroutines and must be safe for
+// concurrent use. Results typed as any are encoded as JSON.
+type Backend interface {
+	Stats() (any, error)
+	Config() (any, error)
+	Tunables() Tunables
+	SetTunables(u TunablesUpdate) (Tunables, error)
+	PriorityTasks() []int32
+	SetPriorityTask(pid int32, priority bool) error
+	QueuedTasks() []QueuedTask
+	Topology() (any, error)
+	ExitInfo() (ExitInfo, error)
+	Detach() error
+}
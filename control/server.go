@@ -0,0 +1,158 @@
+package control
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// Server answers control requests on a Unix socket.
+type Server struct {
+	b Backend
+}
+
+// NewServer returns a server for backend b.
+func NewServer(b Backend) *Server {
+	return &Server{b: b}
+}
+
+// ListenAndServe listens on the Unix socket path, replacing a stale socket
+// left by a previous run, and serves connections until ctx is done. The
+// socket is only accessible to the owner (root).
+func (s *Server) ListenAndServe(ctx context.Context, path string) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(path)
+	if err := os.Chmod(path, 0o600); err != nil {
+		l.Close()
+		return err
+	}
+	return s.Serve(ctx, l)
+}
+
+// Serve accepts connections on l until ctx is done, then closes l and waits
+// for the open connections to finish.
+func (s *Server) Serve(ctx context.Context, l net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.serveConn(ctx, conn)
+		}()
+	}
+}
+
+func (s *Server) serveConn(ctx context.Context, conn net.Conn) {
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	sc := bufio.NewScanner(conn)
+	sc.Buffer(make([]byte, 4096), maxRequestSize)
+	enc := json.NewEncoder(conn)
+	for sc.Scan() {
+		var req Request
+		var resp Response
+		if err := json.Unmarshal(sc.Bytes(), &req); err != nil {
+			resp.Error = fmt.Sprintf("bad request: %v", err)
+		} else {
+			resp = s.Handle(req)
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+	if err := sc.Err(); err != nil && ctx.Err() == nil {
+		slog.Debug("control connection closed", "err", err)
+	}
+}
+
+// Handle runs one request against the backend.
+func (s *Server) Handle(req Request) Response {
+	result, err := s.call(req)
+	if err != nil {
+		return Response{Error: err.Error()}
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		return Response{Error: fmt.Sprintf("encode result: %v", err)}
+	}
+	return Response{Result: b}
+}
+
+func (s *Server) call(req Request) (any, error) {
+	switch req.Method {
+	case MethodStats:
+		return s.b.Stats()
+	case MethodConfig:
+		return s.b.Config()
+	case MethodTunablesGet:
+		return s.b.Tunables(), nil
+	case MethodTunablesSet:
+		var u TunablesUpdate
+		if err := decodeParams(req, &u); err != nil {
+			return nil, err
+		}
+		return s.b.SetTunables(u)
+	case MethodPriorityList:
+		return s.b.PriorityTasks(), nil
+	case MethodPrioritySet:
+		var p PriorityParams
+		if err := decodeParams(req, &p); err != nil {
+			return nil, err
+		}
+		if p.Pid <= 0 {
+			return nil, fmt.Errorf("invalid pid %d", p.Pid)
+		}
+		if err := s.b.SetPriorityTask(p.Pid, p.Priority); err != nil {
+			return nil, err
+		}
+		return s.b.PriorityTasks(), nil
+	case MethodQueuedList:
+		return s.b.QueuedTasks(), nil
+	case MethodTopology:
+		return s.b.Topology()
+	case MethodExitInfo:
+		return s.b.ExitInfo()
+	case MethodDetach:
+		return nil, s.b.Detach()
+	}
+	return nil, fmt.Errorf("unknown method %q", req.Method)
+}
+
+func decodeParams(req Request, v any) error {
+	if len(req.Params) == 0 {
+		return fmt.Errorf("%s: missing params", req.Method)
+	}
+	if err := json.Unmarshal(req.Params, v); err != nil {
+		return fmt.Errorf("%s: bad params: %w", req.Method, err)
+	}
+	return nil
+}
@@ -0,0 +1,172 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeBackend is a Backend keeping its state in memory.
+type fakeBackend struct {
+	mu       sync.Mutex
+	tunables Tunables
+	priority []int32
+	detached bool
+}
+
+func (b *fakeBackend) Stats() (any, error)  { return map[string]uint64{"nr_queued": 3}, nil }
+func (b *fakeBackend) Config() (any, error) { return map[string]string{"policy": "vtime"}, nil }
+
+func (b *fakeBackend) Tunables() Tunables {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.tunables
+}
+
+func (b *fakeBackend) SetTunables(u TunablesUpdate) (Tunables, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	t := u.Apply(b.tunables)
+	if t.Policy != "vtime" && t.Policy != "fifo" {
+		return b.tunables, errors.New("unknown policy")
+	}
+	b.tunables = t
+	return t, nil
+}
+
+func (b *fakeBackend) PriorityTasks() []int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return slices.Clone(b.priority)
+}
+
+func (b *fakeBackend) SetPriorityTask(pid int32, priority bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.priority = slices.DeleteFunc(b.priority, func(p int32) bool { return p == pid })
+	if priority {
+		b.priority = append(b.priority, pid)
+	}
+	return nil
+}
+
+func (b *fakeBackend) QueuedTasks() []QueuedTask {
+	return []QueuedTask{{Pid: 1, Tgid: 1, Weight: 100}}
+}
+
+func (b *fakeBackend) Topology() (any, error) { return nil, errors.New("no topology") }
+
+func (b *fakeBackend) ExitInfo() (ExitInfo, error) { return ExitInfo{Running: true}, nil }
+
+func (b *fakeBackend) Detach() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.detached = true
+	return nil
+}
+
+func newBackend() *fakeBackend {
+	return &fakeBackend{tunables: Tunables{SliceDefault: 5 * time.Millisecond, Policy: "vtime"}}
+}
+
+func TestHandle(t *testing.T) {
+	tests := []struct {
+		name   string
+		req    Request
+		result string
+		err    string
+	}{
+		{name: "stats", req: Request{Method: MethodStats}, result: `{"nr_queued":3}`},
+		{name: "queued", req: Request{Method: MethodQueuedList}, result: `[{"pid":1,"tgid":1,"cpu":0,"weight":100,"vtime":0,"sum_exec_runtime":0,"deadline":0,"timestamp":0}]`},
+		{name: "exit info", req: Request{Method: MethodExitInfo}, result: `{"running":true,"kind":0,"exit_code":0}`},
+		{name: "backend error", req: Request{Method: MethodTopology}, err: "no topology"},
+		{name: "unknown method", req: Request{Method: "foo"}, err: `unknown method "foo"`},
+		{name: "missing params", req: Request{Method: MethodPrioritySet}, err: "priority.set: missing params"},
+		{name: "bad params", req: Request{Method: MethodPrioritySet, Params: json.RawMessage(`{"pid":"x"}`)}, err: "priority.set: bad params"},
+		{name: "zero pid", req: Request{Method: MethodPrioritySet, Params: json.RawMessage(`{"pid":0,"priority":true}`)}, err: "invalid pid 0"},
+		{name: "negative pid", req: Request{Method: MethodPrioritySet, Params: json.RawMessage(`{"pid":-4,"priority":true}`)}, err: "invalid pid -4"},
+		{name: "priority", req: Request{Method: MethodPrioritySet, Params: json.RawMessage(`{"pid":42,"priority":true}`)}, result: `[42]`},
+		{name: "tunables missing params", req: Request{Method: MethodTunablesSet}, err: "tunables.set: missing params"},
+		{name: "tunables rejected", req: Request{Method: MethodTunablesSet, Params: json.RawMessage(`{"policy":"rr"}`)}, err: "unknown policy"},
+	}
+	s := NewServer(newBackend())
+	for _, tt := range tests {
+		resp := s.Handle(tt.req)
+		if tt.err != "" {
+			if !strings.Contains(resp.Error, tt.err) || resp.Result != nil {
+				t.Errorf("%s: %+v, want error %q", tt.name, resp, tt.err)
+			}
+			continue
+		}
+		if resp.Error != "" || string(resp.Result) != tt.result {
+			t.Errorf("%s: result %s error %q, want %s", tt.name, resp.Result, resp.Error, tt.result)
+		}
+	}
+}
+
+func TestClientServer(t *testing.T) {
+	dir, err := os.MkdirTemp("", "qumun")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "run", "qumun.sock")
+
+	b := newBackend()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- NewServer(b).ListenAndServe(ctx, path) }()
+
+	var c *Client
+	for i := 0; ; i++ {
+		if c, err = Dial(path); err == nil {
+			break
+		}
+		if i == 100 {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	defer c.Close()
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0o600 {
+		t.Errorf("socket mode %v, %v", fi.Mode(), err)
+	}
+
+	var pids []int32
+	if err := c.Call(MethodPrioritySet, PriorityParams{Pid: 7, Priority: true}, &pids); err != nil || !slices.Equal(pids, []int32{7}) {
+		t.Errorf("priority.set: %v %v", pids, err)
+	}
+	slice := time.Millisecond
+	var tun Tunables
+	if err := c.Call(MethodTunablesSet, TunablesUpdate{SliceMin: &slice}, &tun); err != nil || tun.SliceMin != slice || tun.SliceDefault != 5*time.Millisecond {
+		t.Errorf("tunables.set: %+v %v", tun, err)
+	}
+	if err := c.Call("foo", nil, nil); err == nil || err.Error() != `unknown method "foo"` {
+		t.Errorf("unknown method: %v", err)
+	}
+	// A malformed line is answered without closing the connection.
+	if _, err := c.conn.Write([]byte("{\n")); err != nil {
+		t.Fatal(err)
+	}
+	if !c.sc.Scan() || !strings.Contains(c.sc.Text(), "bad request") {
+		t.Errorf("malformed request answered %q", c.sc.Text())
+	}
+	if err := c.Call(MethodDetach, nil, nil); err != nil || !b.detached {
+		t.Errorf("detach: %v (detached %v)", err, b.detached)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("ListenAndServe: %v", err)
+	}
+	if _, err := os.Stat(path); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("socket left behind: %v", err)
+	}
+}
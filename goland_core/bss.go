@@ -1,11 +1,11 @@
 package core
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
+	"time"
 	"unsafe"
 
+	"github.com/Gthulhu/qumun/goland_core/btf"
 	bpf "github.com/aquasecurity/libbpfgo"
 )
 
@@ -14,18 +14,27 @@ import (
 */
 import "C"
 
+// BssData holds the counters of the .bss section of main.bpf.c, decoded by
+// the name in their btf tag.
 type BssData struct {
-	Usersched_last_run_at uint64 `json:"usersched_last_run_at"` // The PID of the userspace scheduler
-	Nr_queued             uint64 `json:"nr_queued"`             // Number of tasks queued in the userspace scheduler
-	Nr_scheduled          uint64 `json:"nr_scheduled"`          // Number of tasks scheduled by the userspace scheduler
-	Nr_running            uint64 `json:"nr_running"`            // Number of tasks currently running in the userspace scheduler
-	Nr_online_cpus        uint64 `json:"nr_online_cpus"`        // Number of online CPUs in the system
-	Nr_user_dispatches    uint64 `json:"nr_user_dispatches"`    // Number of user-space dispatches
-	Nr_kernel_dispatches  uint64 `json:"nr_kernel_dispatches"`  // Number of kernel-space dispatches
-	Nr_cancel_dispatches  uint64 `json:"nr_cancel_dispatches"`  // Number of cancelled dispatches
-	Nr_bounce_dispatches  uint64 `json:"nr_bounce_dispatches"`  // Number of bounce dispatches
-	Nr_failed_dispatches  uint64 `json:"nr_failed_dispatches"`  // Number of failed dispatches
-	Nr_sched_congested    uint64 `json:"nr_sched_congested"`    // Number of times the scheduler was congested
+	Usersched_last_run_at   uint64 `json:"usersched_last_run_at" btf:"usersched_last_run_at"`     // The PID of the userspace scheduler
+	Nr_queued               uint64 `json:"nr_queued" btf:"nr_queued"`                             // Number of tasks queued in the userspace scheduler
+	Nr_scheduled            uint64 `json:"nr_scheduled" btf:"nr_scheduled"`                       // Number of tasks scheduled by the userspace scheduler
+	Nr_running              uint64 `json:"nr_running" btf:"nr_running"`                           // Number of tasks currently running in the userspace scheduler
+	Nr_online_cpus          uint64 `json:"nr_online_cpus" btf:"nr_online_cpus"`                   // Number of online CPUs in the system
+	Nr_user_dispatches      uint64 `json:"nr_user_dispatches" btf:"nr_user_dispatches"`           // Number of user-space dispatches
+	Nr_kernel_dispatches    uint64 `json:"nr_kernel_dispatches" btf:"nr_kernel_dispatches"`       // Number of kernel-space dispatches
+	Nr_cancel_dispatches    uint64 `json:"nr_cancel_dispatches" btf:"nr_cancel_dispatches"`       // Number of cancelled dispatches
+	Nr_bounce_dispatches    uint64 `json:"nr_bounce_dispatches" btf:"nr_bounce_dispatches"`       // Number of bounce dispatches
+	Nr_failed_dispatches    uint64 `json:"nr_failed_dispatches" btf:"nr_failed_dispatches"`       // Number of failed dispatches
+	Nr_sched_congested      uint64 `json:"nr_sched_congested" btf:"nr_sched_congested"`           // Number of times the scheduler was congested
+	Nr_watermark_dispatches uint64 `json:"nr_watermark_dispatches" btf:"nr_watermark_dispatches"` // Number of kernel dispatches above the congestion watermark
+	Nr_cpu_online_events    uint64 `json:"nr_cpu_online_events" btf:"nr_cpu_online_events"`       // Number of CPUs that went online
+	Nr_cpu_offline_events   uint64 `json:"nr_cpu_offline_events" btf:"nr_cpu_offline_events"`     // Number of CPUs that went offline
+	Nr_heartbeat_kicks      uint64 `json:"nr_heartbeat_kicks" btf:"nr_heartbeat_kicks"`           // Number of times the heartbeat woke up the userspace scheduler
+	Nr_trace_events         uint64 `json:"nr_trace_events" btf:"nr_trace_events"`                 // Number of task events sent to user space
+	Nr_trace_drops          uint64 `json:"nr_trace_drops" btf:"nr_trace_drops"`                   // Number of task events lost (ring buffer full)
+	Nr_starved_runs         uint64 `json:"nr_starved_runs" btf:"nr_starved_runs"`                 // Number of runs after a wait above the starvation threshold
 }
 
 func (data BssData) String() string {
@@ -34,7 +43,11 @@ func (data BssData) String() string {
 		fmt.Sprintf("Nr_online_cpus: %v, Nr_user_dispatches: %v ", data.Nr_online_cpus, data.Nr_user_dispatches) +
 		fmt.Sprintf("Nr_kernel_dispatches: %v, Nr_cancel_dispatches: %v ", data.Nr_kernel_dispatches, data.Nr_cancel_dispatches) +
 		fmt.Sprintf("Nr_bounce_dispatches: %v, Nr_failed_dispatches: %v", data.Nr_bounce_dispatches, data.Nr_failed_dispatches) +
-		fmt.Sprintf("Nr_sched_congested: %v", data.Nr_sched_congested)
+		fmt.Sprintf("Nr_sched_congested: %v, Nr_watermark_dispatches: %v ", data.Nr_sched_congested, data.Nr_watermark_dispatches) +
+		fmt.Sprintf("Nr_cpu_online_events: %v, Nr_cpu_offline_events: %v ", data.Nr_cpu_online_events, data.Nr_cpu_offline_events) +
+		fmt.Sprintf("Nr_heartbeat_kicks: %v ", data.Nr_heartbeat_kicks) +
+		fmt.Sprintf("Nr_trace_events: %v, Nr_trace_drops: %v ", data.Nr_trace_events, data.Nr_trace_drops) +
+		fmt.Sprintf("Nr_starved_runs: %v", data.Nr_starved_runs)
 }
 
 func LoadSkel() unsafe.Pointer {
@@ -57,11 +70,34 @@ func NotifyComplete(nr_pending uint64) error {
 	return nil
 }
 
+// GetNrQueued is the method form of GetNrQueued, so that Sched can be used
+// interchangeably with other backends (e.g. a replay or a simulation).
+func (s *Sched) GetNrQueued() uint64 {
+	return GetNrQueued()
+}
+
+// GetNrScheduled is the method form of GetNrScheduled.
+func (s *Sched) GetNrScheduled() uint64 {
+	return GetNrScheduled()
+}
+
+// NotifyComplete is the method form of NotifyComplete.
+func (s *Sched) NotifyComplete(nr_pending uint64) error {
+	return NotifyComplete(nr_pending)
+}
+
 func (s *Sched) SubNrQueued() error {
 	C.sub_nr_queued()
 	return nil
 }
 
+// SetStarvationThreshold makes the BPF side count in Nr_starved_runs the
+// tasks that waited at least d for a CPU, 0 turns the accounting off. It can
+// be changed while the scheduler runs.
+func (s *Sched) SetStarvationThreshold(d time.Duration) {
+	C.set_starvation_ns(C.u64(max(d, 0)))
+}
+
 type BssMap struct {
 	*bpf.BPFMap
 }
@@ -76,9 +112,7 @@ func (s *Sched) GetBssData() (BssData, error) {
 		return BssData{}, err
 	}
 	var bss BssData
-	buff := bytes.NewBuffer(b)
-	err = binary.Read(buff, binary.LittleEndian, &bss)
-	if err != nil {
+	if err := btf.Decode(s.bssLayout, b, &bss); err != nil {
 		return BssData{}, err
 	}
 	return bss, nil
@@ -0,0 +1,255 @@
+// Package btf reads the data section layouts (.bss, .rodata, ...) of a BPF
+// object from its BTF, so that Go can decode the global variables of
+// main.bpf.c by name instead of mirroring their C layout by hand.
+//
+// Only the subset of BTF needed for that is parsed: the type section is
+// walked to find DATASEC and VAR types, everything else is skipped.
+package btf
+
+import (
+	"bytes"
+	"debug/elf"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+)
+
+const btfMagic = 0xeb9f
+
+// BTF kinds, see include/uapi/linux/btf.h.
+const (
+	kindInt       = 1
+	kindPtr       = 2
+	kindArray     = 3
+	kindStruct    = 4
+	kindUnion     = 5
+	kindEnum      = 6
+	kindFwd       = 7
+	kindTypedef   = 8
+	kindVolatile  = 9
+	kindConst     = 10
+	kindRestrict  = 11
+	kindFunc      = 12
+	kindFuncProto = 13
+	kindVar       = 14
+	kindDatasec   = 15
+	kindFloat     = 16
+	kindDeclTag   = 17
+	kindTypeTag   = 18
+	kindEnum64    = 19
+)
+
+type header struct {
+	Magic   uint16
+	Version uint8
+	Flags   uint8
+	HdrLen  uint32
+	TypeOff uint32
+	TypeLen uint32
+	StrOff  uint32
+	StrLen  uint32
+}
+
+type rawType struct {
+	NameOff uint32
+	Info    uint32
+	Size    uint32 // size or type, depending on the kind
+}
+
+func (t rawType) kind() uint32 { return (t.Info >> 24) & 0x1f }
+func (t rawType) vlen() int    { return int(t.Info & 0xffff) }
+
+type secInfo struct {
+	Type   uint32
+	Offset uint32
+	Size   uint32
+}
+
+// Var is a global variable of a data section.
+type Var struct {
+	Name   string
+	Offset uint32
+	Size   uint32
+}
+
+// Datasec is the layout of a data section, with its variables sorted by
+// offset.
+type Datasec struct {
+	Name string
+	Size uint32
+	Vars []Var
+}
+
+// Var returns the variable called name, if the section has one.
+func (d *Datasec) Var(name string) (Var, bool) {
+	for _, v := range d.Vars {
+		if v.Name == name {
+			return v, true
+		}
+	}
+	return Var{}, false
+}
+
+// Spec holds the data sections found in a BTF blob.
+type Spec struct {
+	secs map[string]*Datasec
+}
+
+// Datasec returns the layout of the section called name (e.g. ".bss").
+func (s *Spec) Datasec(name string) (*Datasec, error) {
+	d, ok := s.secs[name]
+	if !ok {
+		return nil, fmt.Errorf("btf: no datasec %q", name)
+	}
+	return d, nil
+}
+
+// Parse reads the data sections of a raw (little endian) BTF blob.
+//
+// Offsets are taken as they are in the blob: this is right for BTF loaded
+// in the kernel, but not for the .BTF section of an object file, where
+// clang leaves them to be fixed up from the symbol table. Use LoadELF for
+// object files.
+func Parse(raw []byte) (*Spec, error) {
+	var hdr header
+	if err := binary.Read(bytes.NewReader(raw), binary.LittleEndian, &hdr); err != nil {
+		return nil, fmt.Errorf("btf: read header: %w", err)
+	}
+	if hdr.Magic != btfMagic {
+		return nil, fmt.Errorf("btf: bad magic %#x", hdr.Magic)
+	}
+	typesEnd := uint64(hdr.HdrLen) + uint64(hdr.TypeOff) + uint64(hdr.TypeLen)
+	strsEnd := uint64(hdr.HdrLen) + uint64(hdr.StrOff) + uint64(hdr.StrLen)
+	if typesEnd > uint64(len(raw)) || strsEnd > uint64(len(raw)) {
+		return nil, errors.New("btf: truncated")
+	}
+	types := raw[hdr.HdrLen+hdr.TypeOff : typesEnd]
+	strs := raw[hdr.HdrLen+hdr.StrOff : strsEnd]
+
+	name := func(off uint32) string {
+		if int(off) >= len(strs) {
+			return ""
+		}
+		end := bytes.IndexByte(strs[off:], 0)
+		if end < 0 {
+			return string(strs[off:])
+		}
+		return string(strs[off : int(off)+end])
+	}
+
+	// Type IDs start at 1; id 0 is void.
+	vars := map[uint32]string{}
+	type rawSec struct {
+		name string
+		size uint32
+		vars []secInfo
+	}
+	var secs []rawSec
+	r := bytes.NewReader(types)
+	for id := uint32(1); r.Len() > 0; id++ {
+		var t rawType
+		if err := binary.Read(r, binary.LittleEndian, &t); err != nil {
+			return nil, fmt.Errorf("btf: type %d: %w", id, err)
+		}
+		var skip int
+		switch t.kind() {
+		case kindPtr, kindFwd, kindTypedef, kindVolatile, kindConst,
+			kindRestrict, kindFunc, kindFloat, kindTypeTag:
+		case kindInt, kindDeclTag:
+			skip = 4
+		case kindVar:
+			vars[id] = name(t.NameOff)
+			skip = 4
+		case kindArray:
+			skip = 12
+		case kindStruct, kindUnion, kindEnum64:
+			skip = 12 * t.vlen()
+		case kindEnum, kindFuncProto:
+			skip = 8 * t.vlen()
+		case kindDatasec:
+			sec := rawSec{name: name(t.NameOff), size: t.Size, vars: make([]secInfo, t.vlen())}
+			if err := binary.Read(r, binary.LittleEndian, sec.vars); err != nil {
+				return nil, fmt.Errorf("btf: datasec %s: %w", sec.name, err)
+			}
+			secs = append(secs, sec)
+		default:
+			return nil, fmt.Errorf("btf: type %d: unknown kind %d", id, t.kind())
+		}
+		if _, err := r.Seek(int64(skip), 1); err != nil {
+			return nil, err
+		}
+	}
+
+	spec := &Spec{secs: map[string]*Datasec{}}
+	for _, sec := range secs {
+		d := &Datasec{Name: sec.name, Size: sec.size}
+		for _, si := range sec.vars {
+			// Entries may also be functions (.ksyms); only keep variables.
+			n, ok := vars[si.Type]
+			if !ok {
+				continue
+			}
+			d.Vars = append(d.Vars, Var{Name: n, Offset: si.Offset, Size: si.Size})
+		}
+		sortVars(d.Vars)
+		spec.secs[d.Name] = d
+	}
+	return spec, nil
+}
+
+// LoadELF reads the data sections of a BPF object file, fixing up section
+// sizes and variable offsets from the ELF headers and symbol table the same
+// way libbpf does when it loads the object.
+func LoadELF(obj []byte) (*Spec, error) {
+	f, err := elf.NewFile(bytes.NewReader(obj))
+	if err != nil {
+		return nil, fmt.Errorf("btf: %w", err)
+	}
+	defer f.Close()
+	if f.ByteOrder != binary.LittleEndian {
+		return nil, errors.New("btf: only little endian objects are supported")
+	}
+	sec := f.Section(".BTF")
+	if sec == nil {
+		return nil, errors.New("btf: object has no .BTF section")
+	}
+	raw, err := sec.Data()
+	if err != nil {
+		return nil, fmt.Errorf("btf: read .BTF: %w", err)
+	}
+	spec, err := Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	syms, err := f.Symbols()
+	if err != nil {
+		return nil, fmt.Errorf("btf: read symbols: %w", err)
+	}
+	for _, d := range spec.secs {
+		es := f.Section(d.Name)
+		if es == nil {
+			continue
+		}
+		d.Size = uint32(es.Size)
+		offs := map[string]uint64{}
+		for _, sym := range syms {
+			if int(sym.Section) < len(f.Sections) && f.Sections[sym.Section] == es {
+				offs[sym.Name] = sym.Value
+			}
+		}
+		for i := range d.Vars {
+			off, ok := offs[d.Vars[i].Name]
+			if !ok {
+				return nil, fmt.Errorf("btf: %s: no symbol for %s", d.Name, d.Vars[i].Name)
+			}
+			d.Vars[i].Offset = uint32(off)
+		}
+		sortVars(d.Vars)
+	}
+	return spec, nil
+}
+
+func sortVars(vars []Var) {
+	sort.Slice(vars, func(i, j int) bool { return vars[i].Offset < vars[j].Offset })
+}
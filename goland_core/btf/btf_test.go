@@ -0,0 +1,191 @@
+package btf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// blob builds a raw BTF blob.
+type blob struct {
+	types, strs bytes.Buffer
+}
+
+func newBlob() *blob {
+	b := &blob{}
+	b.strs.WriteByte(0) // offset 0 is the empty name
+	return b
+}
+
+func (b *blob) str(s string) uint32 {
+	if s == "" {
+		return 0
+	}
+	off := b.strs.Len()
+	b.strs.WriteString(s)
+	b.strs.WriteByte(0)
+	return uint32(off)
+}
+
+// typ appends a type of kind with vlen members and the kind specific data
+// that follows it.
+func (b *blob) typ(name string, kind, vlen int, size uint32, extra ...uint32) {
+	t := rawType{NameOff: b.str(name), Info: uint32(kind)<<24 | uint32(vlen), Size: size}
+	binary.Write(&b.types, binary.LittleEndian, t)
+	binary.Write(&b.types, binary.LittleEndian, extra)
+}
+
+func (b *blob) bytes() []byte {
+	hdr := header{
+		Magic:   btfMagic,
+		Version: 1,
+		HdrLen:  uint32(binary.Size(header{})),
+		TypeLen: uint32(b.types.Len()),
+		StrOff:  uint32(b.types.Len()),
+		StrLen:  uint32(b.strs.Len()),
+	}
+	var raw bytes.Buffer
+	binary.Write(&raw, binary.LittleEndian, hdr)
+	raw.Write(b.types.Bytes())
+	raw.Write(b.strs.Bytes())
+	return raw.Bytes()
+}
+
+// testBlob has a .bss holding nr_a (u32), nr_b (u64) and arr (u32[4]), in
+// reverse order and mixed with a function, plus types that are skipped.
+func testBlob() []byte {
+	b := newBlob()
+	b.typ("u32", kindInt, 0, 4, 32)                          // 1
+	b.typ("u64", kindInt, 0, 8, 64)                          // 2
+	b.typ("s", kindStruct, 1, 8, b.str("x"), 2, 0)           // 3
+	b.typ("", kindFuncProto, 1, 0, 0, 1)                     // 4
+	b.typ("f", kindFunc, 0, 4)                               // 5
+	b.typ("nr_a", kindVar, 0, 1, 1)                          // 6
+	b.typ("nr_b", kindVar, 0, 2, 1)                          // 7
+	b.typ("", kindArray, 0, 0, 1, 1, 4)                      // 8
+	b.typ("arr", kindVar, 0, 8, 1)                           // 9
+	b.typ("e", kindEnum, 2, 4, b.str("A"), 0, b.str("B"), 1) // 10
+	b.typ(".bss", kindDatasec, 4, 32,
+		9, 16, 16,
+		7, 8, 8,
+		5, 0, 0,
+		6, 0, 4,
+	)
+	return b.bytes()
+}
+
+func testData() []byte {
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, struct {
+		A   uint32
+		_   uint32
+		B   uint64
+		Arr [4]uint32
+	}{A: 1, B: 2, Arr: [4]uint32{3, 4, 5, 6}})
+	return data.Bytes()
+}
+
+func TestParse(t *testing.T) {
+	spec, err := Parse(testBlob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bss, err := spec.Datasec(".bss")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := &Datasec{Name: ".bss", Size: 32, Vars: []Var{
+		{Name: "nr_a", Offset: 0, Size: 4},
+		{Name: "nr_b", Offset: 8, Size: 8},
+		{Name: "arr", Offset: 16, Size: 16},
+	}}
+	if !reflect.DeepEqual(bss, want) {
+		t.Errorf("datasec %+v, want %+v", bss, want)
+	}
+	if _, ok := bss.Var("f"); ok {
+		t.Error("function kept as a variable")
+	}
+	if _, err := spec.Datasec(".data"); err == nil {
+		t.Error("missing datasec found")
+	}
+}
+
+func TestParseErrors(t *testing.T) {
+	valid := testBlob()
+	unknown := newBlob()
+	unknown.typ("x", 31, 0, 0)
+	tests := []struct {
+		name string
+		raw  []byte
+		err  string
+	}{
+		{"empty", nil, "read header"},
+		{"magic", append([]byte{0xeb, 0x9f}, valid[2:]...), "bad magic"},
+		{"truncated", valid[:len(valid)-1], "truncated"},
+		{"kind", unknown.bytes(), "unknown kind 31"},
+	}
+	for _, tt := range tests {
+		_, err := Parse(tt.raw)
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+}
+
+type vars struct {
+	A       uint32    `btf:"nr_a"`
+	B       uint64    `btf:"nr_b"`
+	Arr     [4]uint32 `btf:"arr"`
+	Opt     uint32    `btf:"nr_opt,optional"`
+	Ignored int
+}
+
+func TestCheck(t *testing.T) {
+	spec, err := Parse(testBlob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bss, _ := spec.Datasec(".bss")
+	if err := Check(bss, vars{}); err != nil {
+		t.Errorf("Check: %v", err)
+	}
+	if err := Check(bss, &vars{}); err != nil {
+		t.Errorf("Check pointer: %v", err)
+	}
+	var drift struct {
+		B    uint32 `btf:"nr_b"`
+		Gone uint32 `btf:"nr_gone"`
+	}
+	err = Check(bss, drift)
+	if err == nil || !strings.Contains(err.Error(), ".bss.nr_b is 8 bytes, Go field is 4") ||
+		!strings.Contains(err.Error(), "has no variable nr_gone") {
+		t.Errorf("Check drift: %v", err)
+	}
+	if err := Check(bss, 1); err == nil {
+		t.Error("Check on an int succeeded")
+	}
+}
+
+func TestDecode(t *testing.T) {
+	spec, err := Parse(testBlob())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bss, _ := spec.Datasec(".bss")
+	got := vars{Opt: 7}
+	if err := Decode(bss, testData(), &got); err != nil {
+		t.Fatal(err)
+	}
+	want := vars{A: 1, B: 2, Arr: [4]uint32{3, 4, 5, 6}, Opt: 7}
+	if got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+	if err := Decode(bss, testData()[:24], &got); err == nil || !strings.Contains(err.Error(), "past the end") {
+		t.Errorf("Decode short data: %v", err)
+	}
+	if err := Decode(bss, testData(), got); err == nil {
+		t.Error("Decode into a value succeeded")
+	}
+}
@@ -0,0 +1,106 @@
+package btf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// Fields of the structs passed to Check and Decode are bound to section
+// variables with a `btf:"name"` tag. Fields without the tag are ignored.
+// `btf:"name,optional"` fields are left untouched when the variable is not
+// in the section (e.g. SCX enum values the object does not reference).
+const tagName = "btf"
+
+type field struct {
+	name     string
+	optional bool
+	value    reflect.Value
+}
+
+func fields(v reflect.Value) ([]field, error) {
+	if v.Kind() != reflect.Struct {
+		return nil, fmt.Errorf("btf: %s is not a struct", v.Type())
+	}
+	var fs []field
+	for i := 0; i < v.NumField(); i++ {
+		tag, ok := v.Type().Field(i).Tag.Lookup(tagName)
+		if !ok || tag == "-" {
+			continue
+		}
+		name, opt, _ := strings.Cut(tag, ",")
+		fs = append(fs, field{name: name, optional: opt == "optional", value: v.Field(i)})
+	}
+	return fs, nil
+}
+
+// Check reports every tagged field of v (a struct or a pointer to one)
+// that has no variable in sec, or whose size differs from the variable's.
+// A nil error means Decode can fill v from the section.
+func Check(sec *Datasec, v any) error {
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	fs, err := fields(rv)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, f := range fs {
+		if err := checkField(sec, rv.Type(), f); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func checkField(sec *Datasec, t reflect.Type, f field) error {
+	bv, ok := sec.Var(f.name)
+	if !ok {
+		if f.optional {
+			return nil
+		}
+		return fmt.Errorf("%s: %s has no variable %s", t, sec.Name, f.name)
+	}
+	size := binary.Size(f.value.Interface())
+	if size < 0 {
+		return fmt.Errorf("%s: field for %s has no fixed size", t, f.name)
+	}
+	if uint32(size) != bv.Size {
+		return fmt.Errorf("%s: %s.%s is %d bytes, Go field is %d", t, sec.Name, f.name, bv.Size, size)
+	}
+	return nil
+}
+
+// Decode fills the tagged fields of v, a pointer to a struct, from b, the
+// content of section sec (e.g. the value of the main_bpf.bss map).
+func Decode(sec *Datasec, b []byte, v any) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Pointer || rv.IsNil() {
+		return fmt.Errorf("btf: Decode needs a non-nil pointer, got %T", v)
+	}
+	rv = rv.Elem()
+	fs, err := fields(rv)
+	if err != nil {
+		return err
+	}
+	for _, f := range fs {
+		if err := checkField(sec, rv.Type(), f); err != nil {
+			return err
+		}
+		bv, ok := sec.Var(f.name)
+		if !ok {
+			continue
+		}
+		end := uint64(bv.Offset) + uint64(bv.Size)
+		if end > uint64(len(b)) {
+			return fmt.Errorf("btf: %s.%s is past the end of the data (%d > %d)", sec.Name, f.name, end, len(b))
+		}
+		err := binary.Read(bytes.NewReader(b[bv.Offset:end]), binary.LittleEndian, f.value.Addr().Interface())
+		if err != nil {
+			return fmt.Errorf("btf: decode %s.%s: %w", sec.Name, f.name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"slices"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// MaxCpuCapacity is the capacity of the fastest CPU of the system.
+const MaxCpuCapacity = 1024
+
+// CapacityPref tells SelectCPUByCapacity which class of CPUs to prefer.
+type CapacityPref = dataplane.CapacityPref
+
+const (
+	CapacityAny         = dataplane.CapacityAny
+	CapacityPerformance = dataplane.CapacityPerformance // highest-capacity CPUs (P-cores, big cores)
+	CapacityEfficiency  = dataplane.CapacityEfficiency  // lower-capacity CPUs (E-cores, LITTLE cores)
+)
+
+// CapacityScheduler is implemented by schedulers that know the capacity of
+// each CPU. Policies may type-assert a Scheduler to it.
+type CapacityScheduler = dataplane.CapacityScheduler
+
+var _ CapacityScheduler = (*Sched)(nil)
+
+type cpu_capacity_arg struct {
+	cpuId    int32
+	capacity uint32
+}
+
+type task_cpu_cap_arg struct {
+	pid    int32
+	cpu    int32
+	flags  uint64
+	minCap uint32
+	maxCap uint32
+}
+
+// SetCpuCapacity publishes the capacity of cpuId (0 - MaxCpuCapacity) to the
+// BPF side. It is called by util.InitCpuCapacity and must not be called once
+// the scheduling loop has started.
+func (s *Sched) SetCpuCapacity(cpuId int32, capacity uint32) error {
+	if s.setCapacity == nil {
+		return fmt.Errorf("prog (setCapacity) not found")
+	}
+	arg := &cpu_capacity_arg{
+		cpuId:    cpuId,
+		capacity: capacity,
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, arg)
+	opt := bpf.RunOpts{
+		CtxIn:     data.Bytes(),
+		CtxSizeIn: uint32(data.Len()),
+	}
+	err := s.setCapacity.Run(&opt)
+	if err != nil {
+		return err
+	}
+	if opt.RetVal != 0 {
+		return fmt.Errorf("retVal: %v", int32(opt.RetVal))
+	}
+	s.topoMu.Lock()
+	defer s.topoMu.Unlock()
+	if s.cpuCap == nil {
+		s.cpuCap = make(map[int32]uint32)
+	}
+	s.cpuCap[cpuId] = capacity
+	return nil
+}
+
+// CpuCapacity returns the capacity of cpuId, MaxCpuCapacity if it is unknown.
+func (s *Sched) CpuCapacity(cpuId int32) uint32 {
+	s.topoMu.RLock()
+	defer s.topoMu.RUnlock()
+	return s.cpuCapacity(cpuId)
+}
+
+func (s *Sched) cpuCapacity(cpuId int32) uint32 {
+	if c, ok := s.cpuCap[cpuId]; ok && c != 0 {
+		return c
+	}
+	return MaxCpuCapacity
+}
+
+// PerformanceCapacity returns the lowest capacity of the performance CPUs
+// among caps: the capacity right above the widest gap between two distinct
+// capacities, so that favored cores (slightly faster than the other
+// performance cores, e.g. with Intel Turbo Boost Max 3.0) are not a class
+// of their own. It returns 0 when all the capacities are equal.
+func PerformanceCapacity(caps []uint32) uint32 {
+	distinct := slices.Clone(caps)
+	slices.Sort(distinct)
+	distinct = slices.Compact(distinct)
+	var perf, gap uint32
+	for i := 1; i < len(distinct); i++ {
+		if d := distinct[i] - distinct[i-1]; d >= gap {
+			perf, gap = distinct[i], d
+		}
+	}
+	return perf
+}
+
+// capacityRange returns the capacity bounds matching pref.
+func (s *Sched) capacityRange(pref CapacityPref) (uint32, uint32, bool) {
+	s.topoMu.RLock()
+	caps := make([]uint32, 0, len(s.cpuCap))
+	for cpu := range s.cpuCap {
+		caps = append(caps, s.cpuCapacity(cpu))
+	}
+	s.topoMu.RUnlock()
+	perf := PerformanceCapacity(caps)
+	if perf == 0 {
+		return 0, 0, false
+	}
+	switch pref {
+	case CapacityPerformance:
+		return perf, MaxCpuCapacity, true
+	case CapacityEfficiency:
+		return 0, perf - 1, true
+	}
+	return 0, 0, false
+}
+
+// SelectCPUByCapacity picks an idle CPU for t, trying first the CPUs of the
+// requested class. It behaves like SelectCPU on symmetric systems or when
+// pref is CapacityAny.
+func (s *Sched) SelectCPUByCapacity(t *models.QueuedTask, pref CapacityPref) (error, int32) {
+	minCap, maxCap, ok := s.capacityRange(pref)
+	if !ok || !s.IsAsymmetric() || s.selectCpuCap == nil {
+		return s.SelectCPU(t)
+	}
+	arg := &task_cpu_cap_arg{
+		pid:    t.Pid,
+		cpu:    t.Cpu,
+		flags:  t.Flags,
+		minCap: minCap,
+		maxCap: maxCap,
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, arg)
+	opt := bpf.RunOpts{
+		CtxIn:     data.Bytes(),
+		CtxSizeIn: uint32(data.Len()),
+	}
+	err := s.selectCpuCap.Run(&opt)
+	if err != nil {
+		return err, 0
+	}
+	if opt.RetVal > 2147483647 {
+		return nil, RL_CPU_ANY
+	}
+	return nil, int32(opt.RetVal)
+}
+
+// IsAsymmetric reports whether the CPUs published with SetCpuCapacity do
+// not all have the same capacity.
+func (s *Sched) IsAsymmetric() bool {
+	s.topoMu.RLock()
+	defer s.topoMu.RUnlock()
+	var first uint32
+	for cpu := range s.cpuCap {
+		c := s.cpuCapacity(cpu)
+		if first == 0 {
+			first = c
+		} else if c != first {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,44 @@
+package core
+
+import "testing"
+
+func TestPerformanceCapacity(t *testing.T) {
+	tests := []struct {
+		name string
+		caps []uint32
+		want uint32
+	}{
+		{"empty", nil, 0},
+		{"symmetric", []uint32{1024, 1024, 1024}, 0},
+		{"big.LITTLE", []uint32{446, 446, 1024, 1024}, 1024},
+		{"favored cores", []uint32{1024, 1009, 1009, 1009, 605, 605}, 1009},
+		{"favored cores only", []uint32{1024, 1009, 1009}, 1024},
+		{"three clusters", []uint32{160, 160, 498, 498, 1024}, 1024},
+		{"mid cluster", []uint32{160, 160, 840, 840, 1024}, 840},
+	}
+	for _, tt := range tests {
+		if got := PerformanceCapacity(tt.caps); got != tt.want {
+			t.Errorf("%s: %d, want %d", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestCapacityRange(t *testing.T) {
+	s := &Sched{cpuCap: map[int32]uint32{0: 1024, 1: 1009, 2: 1009, 3: 605}}
+	for _, tt := range []struct {
+		pref     CapacityPref
+		min, max uint32
+	}{
+		{CapacityPerformance, 1009, MaxCpuCapacity},
+		{CapacityEfficiency, 0, 1008},
+	} {
+		lo, hi, ok := s.capacityRange(tt.pref)
+		if !ok || lo != tt.min || hi != tt.max {
+			t.Errorf("pref %v: [%d, %d] %v, want [%d, %d]", tt.pref, lo, hi, ok, tt.min, tt.max)
+		}
+	}
+	s.cpuCap = map[int32]uint32{0: 1024, 1: 1024}
+	if _, _, ok := s.capacityRange(CapacityPerformance); ok {
+		t.Error("capacity range on a symmetric system")
+	}
+}
@@ -0,0 +1,120 @@
+package core
+
+/*
+#include "wrapper.h"
+*/
+import "C"
+
+import (
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// CongestionPolicy controls the queue of the tasks sent by the BPF side to
+// user space (the queued ring buffer).
+type CongestionPolicy struct {
+	// RingSize is the number of tasks the queue can hold.
+	RingSize int
+	// Watermark is the fill level of the queue, in percent, above which
+	// only the interactive and the priority tasks are sent to user
+	// space: the others are dispatched to the shared DSQ by the BPF side
+	// until the queue is back below half of it. 0 disables it, so that
+	// tasks only bypass user space when the queue is full.
+	Watermark int
+	// InteractiveRuntime is the longest run time since its last sleep of
+	// a task that is still considered interactive.
+	InteractiveRuntime time.Duration
+}
+
+// DefaultRingSize is the number of tasks the queued ring buffer holds
+// unless SetCongestionPolicy changes it.
+const DefaultRingSize = 4096
+
+// defaultCongestionPolicy matches the defaults of the BPF side.
+var defaultCongestionPolicy = CongestionPolicy{
+	RingSize:           DefaultRingSize,
+	InteractiveRuntime: 5 * time.Millisecond,
+}
+
+const (
+	ringbufHdrSize      = 8  // BPF_RINGBUF_HDR_SZ
+	congestionEventSize = 32 // struct congestion_event
+)
+
+// queuedTaskCtxSize returns the size of struct queued_task_ctx, the records
+// of the queued ring buffer, as compiled in the BPF object.
+func queuedTaskCtxSize() int {
+	return int(C.get_queued_task_ctx_size())
+}
+
+// ringBytes returns the size of a ring buffer holding n records of size
+// bytes, rounded up like libbpf does (a power of 2 multiple of the page
+// size).
+func ringBytes(n, size int) uint64 {
+	rec := uint64((size + ringbufHdrSize + 7) &^ 7)
+	want := uint64(n) * rec
+	sz := uint64(os.Getpagesize())
+	for sz < want {
+		sz <<= 1
+	}
+	return sz
+}
+
+// SetCongestionPolicy sets the size of the queued ring buffer and its
+// congestion watermark. With several shards (see SetQueuedShards), the
+// size is split between them and the watermark applies to each one. It
+// must be called before Start.
+func (s *Sched) SetCongestionPolicy(p CongestionPolicy) error {
+	if p.RingSize <= 0 {
+		return fmt.Errorf("invalid ring size %d", p.RingSize)
+	}
+	if p.Watermark < 0 || p.Watermark > 100 {
+		return fmt.Errorf("invalid watermark %d%%", p.Watermark)
+	}
+	if ringBytes(p.RingSize, queuedTaskCtxSize()) > 1<<31 {
+		return fmt.Errorf("ring size %d too large", p.RingSize)
+	}
+	s.policy = p
+	return nil
+}
+
+// CongestionEvent is a change of the congestion state of a shard of the
+// queue of tasks sent to user space (see SetQueuedShards).
+type CongestionEvent struct {
+	Shard     int    // shard of the queue
+	Congested bool   // entered congestion, false when it left it
+	Full      bool   // entered because the shard was full
+	Backlog   uint64 // bytes waiting in the shard
+	Timestamp uint64 // scx_bpf_now() of the change
+}
+
+// CongestionEvents returns the congestion state changes notified by the
+// BPF side. The channel is nil before Start.
+func (s *Sched) CongestionEvents() <-chan CongestionEvent {
+	return s.congestion
+}
+
+func decodeCongestionEvents(raw <-chan []byte, out chan<- CongestionEvent, log *slog.Logger) {
+	for b := range raw {
+		if len(b) < congestionEventSize {
+			log.Warn("short congestion event", "map", "congestion_events", "size", len(b))
+			continue
+		}
+		ev := CongestionEvent{
+			Timestamp: binary.LittleEndian.Uint64(b[0:8]),
+			Backlog:   binary.LittleEndian.Uint64(b[8:16]),
+			Congested: binary.LittleEndian.Uint32(b[16:20]) != 0,
+			Full:      binary.LittleEndian.Uint32(b[20:24]) != 0,
+			Shard:     int(binary.LittleEndian.Uint32(b[24:28])),
+		}
+		select {
+		case out <- ev:
+		default:
+			log.Warn("congestion event dropped", "shard", ev.Shard, "congested", ev.Congested)
+		}
+	}
+	close(out)
+}
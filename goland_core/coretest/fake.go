@@ -0,0 +1,172 @@
+// Package coretest provides an in-memory core.Scheduler for unit-testing
+// policies without BPF privileges. It only depends on the dataplane package,
+// so it builds without cgo.
+package coretest
+
+import (
+	"context"
+	"sync"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+// Fake is an in-memory core.Scheduler. Tasks are fed with Enqueue and the
+// decisions of the policy are collected in Dispatched and Preempted.
+//
+// Fake is safe for concurrent use.
+type Fake struct {
+	mu          sync.Mutex
+	queue       []models.QueuedTask
+	ready       chan struct{}
+	dispatched  []dataplane.DispatchedTask
+	preempted   []int32
+	nrScheduled uint64
+
+	// SelectCPUFunc, if set, implements SelectCPU and DefaultSelectCPU;
+	// otherwise the task is kept on its previous CPU.
+	SelectCPUFunc func(t *models.QueuedTask) (error, int32)
+	// DispatchErr, if set, is returned by DispatchTask and the task is
+	// not recorded.
+	DispatchErr error
+	// PreemptResult is returned by PreemptCpuFor; when it is
+	// dataplane.PreemptKicked the CPU is also recorded in Preempted.
+	PreemptResult dataplane.PreemptResult
+	// Occupancy is returned by CPUOccupancy.
+	Occupancy []dataplane.RunningTask
+}
+
+var _ dataplane.Scheduler = (*Fake)(nil)
+
+// New returns an empty Fake.
+func New() *Fake {
+	return &Fake{ready: make(chan struct{}, 1)}
+}
+
+// Enqueue makes tasks available to DequeueTask, as if the BPF side had
+// queued them.
+func (f *Fake) Enqueue(tasks ...models.QueuedTask) {
+	f.mu.Lock()
+	f.queue = append(f.queue, tasks...)
+	f.mu.Unlock()
+	select {
+	case f.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Dispatched returns a copy of the tasks dispatched so far, in order.
+func (f *Fake) Dispatched() []dataplane.DispatchedTask {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]dataplane.DispatchedTask(nil), f.dispatched...)
+}
+
+// Preempted returns the CPUs passed to PreemptCpu so far, in order.
+func (f *Fake) Preempted() []int32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]int32(nil), f.preempted...)
+}
+
+// Reset drops the queued tasks and the collected decisions.
+func (f *Fake) Reset() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.queue = nil
+	f.dispatched = nil
+	f.preempted = nil
+	f.nrScheduled = 0
+}
+
+func (f *Fake) DequeueTask(task *models.QueuedTask) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.queue) == 0 {
+		task.Pid = -1
+		return
+	}
+	*task = f.queue[0]
+	f.queue = f.queue[1:]
+}
+
+func (f *Fake) ReadyForDequeue() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.queue) > 0
+}
+
+func (f *Fake) BlockTilReadyForDequeue(ctx context.Context) {
+	for {
+		if f.ReadyForDequeue() {
+			return
+		}
+		select {
+		case <-f.ready:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (f *Fake) DefaultSelectCPU(t *models.QueuedTask) (error, int32) {
+	if f.SelectCPUFunc != nil {
+		return f.SelectCPUFunc(t)
+	}
+	return nil, t.Cpu
+}
+
+func (f *Fake) SelectCPU(t *models.QueuedTask) (error, int32) {
+	return f.DefaultSelectCPU(t)
+}
+
+func (f *Fake) DispatchTask(t *dataplane.DispatchedTask) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.DispatchErr != nil {
+		return f.DispatchErr
+	}
+	f.dispatched = append(f.dispatched, *t)
+	return nil
+}
+
+func (f *Fake) GetNrQueued() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return uint64(len(f.queue))
+}
+
+func (f *Fake) GetNrScheduled() uint64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.nrScheduled
+}
+
+func (f *Fake) NotifyComplete(nrPending uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.nrScheduled = nrPending
+	return nil
+}
+
+func (f *Fake) PreemptCpu(cpuId int32) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.preempted = append(f.preempted, cpuId)
+	return nil
+}
+
+func (f *Fake) CPUOccupancy() ([]dataplane.RunningTask, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]dataplane.RunningTask(nil), f.Occupancy...), nil
+}
+
+func (f *Fake) PreemptCpuFor(cpuId int32, pid int32) (dataplane.PreemptResult, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.PreemptResult == dataplane.PreemptKicked {
+		f.preempted = append(f.preempted, cpuId)
+	}
+	return f.PreemptResult, nil
+}
@@ -0,0 +1,145 @@
+package coretest_test
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/coretest"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+	"github.com/Gthulhu/qumun/policy"
+)
+
+func pids(tasks []dataplane.DispatchedTask) []int32 {
+	var p []int32
+	for _, t := range tasks {
+		p = append(p, t.Pid)
+	}
+	return p
+}
+
+// The built-in policy dispatches the queued tasks by deadline and reports
+// the tasks it still holds.
+func TestPolicy(t *testing.T) {
+	f := coretest.New()
+	params := policy.DefaultParams()
+	params.Priority[4] = struct{}{}
+	p := policy.NewTaskPool(f, 16, params)
+	f.Enqueue(
+		models.QueuedTask{Pid: 1, Cpu: 0, Weight: 100, Vtime: 30},
+		models.QueuedTask{Pid: 2, Cpu: 1, Weight: 100, Vtime: 10},
+		models.QueuedTask{Pid: 3, Cpu: 2, Weight: 100, Vtime: 20},
+		models.QueuedTask{Pid: 4, Cpu: 3, Weight: 100, Vtime: 40},
+	)
+	if n := p.DrainQueuedTask(); n != 4 || f.ReadyForDequeue() {
+		t.Fatalf("drained %d tasks, queue ready %v", n, f.ReadyForDequeue())
+	}
+	var pending []uint64
+	for p.DispatchOne() {
+		pending = append(pending, f.GetNrScheduled())
+	}
+	got := f.Dispatched()
+	if want := []int32{2, 3, 1, 4}; !slices.Equal(pids(got), want) {
+		t.Errorf("dispatch order %v, want %v", pids(got), want)
+	}
+	if want := []uint64{3, 2, 1, 0}; !slices.Equal(pending, want) {
+		t.Errorf("NotifyComplete %v, want %v", pending, want)
+	}
+	for _, d := range got {
+		if d.Cpu != int32(d.Pid-1) {
+			t.Errorf("pid %d dispatched to cpu %d", d.Pid, d.Cpu)
+		}
+		if (d.Vtime == 0) != (d.Pid == 4) {
+			t.Errorf("pid %d dispatched with vtime %d", d.Pid, d.Vtime)
+		}
+	}
+	// The first dispatch sees nothing reported yet, the next ones the
+	// tasks left in the pool.
+	if got[0].SliceNs != params.SliceDefault || got[1].SliceNs != params.SliceDefault/4 {
+		t.Errorf("slices %d %d", got[0].SliceNs, got[1].SliceNs)
+	}
+}
+
+func TestSelectCPUFunc(t *testing.T) {
+	f := coretest.New()
+	f.SelectCPUFunc = func(t *models.QueuedTask) (error, int32) {
+		return nil, dataplane.RL_CPU_ANY
+	}
+	p := policy.NewTaskPool(f, 4, policy.DefaultParams())
+	f.Enqueue(models.QueuedTask{Pid: 1, Cpu: 3, Weight: 100})
+	p.DrainQueuedTask()
+	p.DispatchOne()
+	if got := f.Dispatched(); len(got) != 1 || got[0].Cpu != dataplane.RL_CPU_ANY {
+		t.Errorf("dispatched %+v", got)
+	}
+}
+
+func TestDispatchErr(t *testing.T) {
+	f := coretest.New()
+	f.DispatchErr = errors.New("busy")
+	p := policy.NewTaskPool(f, 4, policy.DefaultParams())
+	f.Enqueue(models.QueuedTask{Pid: 1, Weight: 100})
+	p.DrainQueuedTask()
+	if !p.DispatchOne() || p.Len() != 0 {
+		t.Fatalf("DispatchOne: pool holds %d tasks", p.Len())
+	}
+	if got := f.Dispatched(); len(got) != 0 {
+		t.Errorf("failed dispatch recorded: %+v", got)
+	}
+	f.Reset()
+	if f.GetNrQueued() != 0 || f.GetNrScheduled() != 0 {
+		t.Error("Reset left state behind")
+	}
+}
+
+func TestBlockTilReadyForDequeue(t *testing.T) {
+	f := coretest.New()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	f.BlockTilReadyForDequeue(ctx)
+	cancel()
+	if ctx.Err() == nil {
+		t.Fatal("returned before the deadline with an empty queue")
+	}
+
+	done := make(chan struct{})
+	go func() {
+		f.BlockTilReadyForDequeue(context.Background())
+		close(done)
+	}()
+	f.Enqueue(models.QueuedTask{Pid: 1})
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("Enqueue did not wake up BlockTilReadyForDequeue")
+	}
+	var q models.QueuedTask
+	f.DequeueTask(&q)
+	if q.Pid != 1 {
+		t.Errorf("dequeued pid %d", q.Pid)
+	}
+	f.DequeueTask(&q)
+	if q.Pid != -1 {
+		t.Errorf("dequeued pid %d from an empty queue", q.Pid)
+	}
+}
+
+func TestPreempt(t *testing.T) {
+	f := coretest.New()
+	f.Occupancy = []dataplane.RunningTask{{Cpu: 1, Pid: 7}}
+	if occ, _ := f.CPUOccupancy(); len(occ) != 1 || occ[0].Pid != 7 {
+		t.Errorf("CPUOccupancy %+v", occ)
+	}
+	f.PreemptResult = dataplane.PreemptNotLower
+	if res, _ := f.PreemptCpuFor(1, 2); res != dataplane.PreemptNotLower {
+		t.Errorf("PreemptCpuFor %v", res)
+	}
+	f.PreemptResult = dataplane.PreemptKicked
+	f.PreemptCpuFor(1, 2)
+	f.PreemptCpu(3)
+	if got := f.Preempted(); !slices.Equal(got, []int32{1, 3}) {
+		t.Errorf("preempted %v, want [1 3]", got)
+	}
+}
@@ -0,0 +1,134 @@
+// Package dataplane defines the interface between a scheduling policy and
+// its backend, and the values they exchange. Unlike goland_core, which
+// re-exports all of it under the same names, it does not depend on cgo or
+// libbpf: policies, the simulator (package sim), the replay (package record)
+// and the trace writers (package tracing) build and test on any machine.
+package dataplane
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Gthulhu/plugin/models"
+)
+
+const (
+	RL_CPU_ANY = 1 << 20
+)
+
+// MaxWatchdogTimeout is the longest sched_ext watchdog timeout accepted by
+// the kernel (SCX_WATCHDOG_MAX_TIMEOUT).
+const MaxWatchdogTimeout = 30 * time.Second
+
+// Scheduler is the data plane between a scheduling policy and the BPF
+// backend. It is implemented by *core.Sched; policies written against it can
+// be exercised without BPF privileges (see the coretest and sim packages).
+type Scheduler interface {
+	// DequeueTask pops a task queued by the BPF side, or sets task.Pid to
+	// -1 when there is none.
+	DequeueTask(task *models.QueuedTask)
+	// ReadyForDequeue reports whether DequeueTask would return a task.
+	ReadyForDequeue() bool
+	// BlockTilReadyForDequeue waits until a task is queued or ctx is done.
+	BlockTilReadyForDequeue(ctx context.Context)
+	// DefaultSelectCPU picks an idle CPU for t with the built-in policy.
+	DefaultSelectCPU(t *models.QueuedTask) (error, int32)
+	// SelectCPU picks a CPU for t, using the plugin if one is set.
+	SelectCPU(t *models.QueuedTask) (error, int32)
+	// DispatchTask sends a scheduling decision to the BPF side.
+	DispatchTask(t *DispatchedTask) error
+	// GetNrQueued returns the number of tasks queued and not dequeued yet.
+	GetNrQueued() uint64
+	// GetNrScheduled returns the value last passed to NotifyComplete.
+	GetNrScheduled() uint64
+	// NotifyComplete reports how many tasks the policy still holds.
+	NotifyComplete(nrPending uint64) error
+	// PreemptCpu kicks cpuId, preempting its current task.
+	PreemptCpu(cpuId int32) error
+	// CPUOccupancy returns the tasks currently running on each busy CPU.
+	CPUOccupancy() ([]RunningTask, error)
+	// PreemptCpuFor preempts cpuId only if its current task has a lower
+	// priority than task pid.
+	PreemptCpuFor(cpuId int32, pid int32) (PreemptResult, error)
+}
+
+// Task queued for dispatching to the BPF component (see bpf_intf::dispatched_task_ctx).
+type DispatchedTask struct {
+	Pid        int32  // pid that uniquely identifies a task
+	Cpu        int32  // target CPU selected by the scheduler
+	Flags      uint64 // special dispatch flags
+	SliceNs    uint64 // time slice assigned to the task (0 = default)
+	Vtime      uint64 // task deadline / vruntime
+	CpuMaskCnt uint64 // cpumask generation counter (private)
+}
+
+// NewDispatchedTask creates a DispatchedTask from a QueuedTask.
+func NewDispatchedTask(task *models.QueuedTask) *DispatchedTask {
+	return &DispatchedTask{
+		Pid:     task.Pid,
+		Cpu:     task.Cpu,
+		Flags:   task.Flags,
+		SliceNs: 0, // use default time slice
+		Vtime:   0,
+	}
+}
+
+// Recorder receives every task exchanged with the BPF side (see
+// core.Sched.SetRecorder).
+type Recorder interface {
+	RecordQueued(t *models.QueuedTask)
+	RecordDispatched(t *DispatchedTask)
+}
+
+// RunningTask is the task owning a CPU, as recorded by the BPF side in the
+// running_task map.
+type RunningTask struct {
+	Cpu      int32  `json:"cpu"`
+	Pid      int32  `json:"pid"`
+	Tgid     int32  `json:"tgid"`
+	StartTs  uint64 `json:"start_ts"` // scx_bpf_now() when the task started running
+	Priority bool   `json:"priority"` // task is in the priority_tasks map
+}
+
+// PreemptResult is the outcome of a PreemptCpuFor request.
+type PreemptResult int
+
+const (
+	PreemptKicked      PreemptResult = iota // CPU kicked, running task preempted
+	PreemptIdle                             // no task running on the CPU
+	PreemptNotLower                         // running task has an equal or higher priority
+	PreemptNoTask                           // requesting task doesn't exist anymore
+	PreemptRateLimited                      // CPU preempted too recently
+)
+
+func (r PreemptResult) String() string {
+	switch r {
+	case PreemptKicked:
+		return "kicked"
+	case PreemptIdle:
+		return "idle"
+	case PreemptNotLower:
+		return "not-lower"
+	case PreemptNoTask:
+		return "no-task"
+	case PreemptRateLimited:
+		return "rate-limited"
+	}
+	return fmt.Sprintf("PreemptResult(%d)", int(r))
+}
+
+// CapacityPref tells SelectCPUByCapacity which class of CPUs to prefer.
+type CapacityPref int
+
+const (
+	CapacityAny         CapacityPref = iota
+	CapacityPerformance              // highest-capacity CPUs (P-cores, big cores)
+	CapacityEfficiency               // lower-capacity CPUs (E-cores, LITTLE cores)
+)
+
+// CapacityScheduler is implemented by schedulers that know the capacity of
+// each CPU. Policies may type-assert a Scheduler to it.
+type CapacityScheduler interface {
+	SelectCPUByCapacity(t *models.QueuedTask, pref CapacityPref) (error, int32)
+}
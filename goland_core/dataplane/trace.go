@@ -0,0 +1,69 @@
+package dataplane
+
+import "fmt"
+
+// TraceKind is the type of a TraceEvent (see enum trace_event_kind in
+// intf.h).
+type TraceKind uint32
+
+const (
+	TraceEnqueue        TraceKind = iota + 1 // task queued to user space, Arg = enqueue flags
+	TraceDispatch                            // user-space dispatch, Cpu -1 for any CPU, Arg = slice (ns)
+	TraceDirectDispatch                      // dispatched to an idle CPU by the BPF side, Arg = slice (ns)
+	TraceBounce                              // CPU chosen by user space not usable, sent to the shared DSQ
+	TraceCancel                              // user-space dispatch cancelled after an affinity change
+	TraceCongested                           // queue to user space full, dispatched by the BPF side
+	TraceCpuRelease                          // CPU taken by a higher sched_class, Arg = reason
+	TracePrioPreempt                         // CPU preempted for a priority task, Arg = preempted pid
+	TraceWakeup                              // task became runnable, Cpu = waker CPU, Arg = enqueue flags
+	TraceRunning                             // task started running, Arg = wakeup timestamp, 0 if it did not sleep
+	TraceStopping                            // task stopped running, Arg = start timestamp
+	TraceUserschedRun                        // user-space scheduler stopped running, Arg = start timestamp
+	TraceDispatchBatch                       // tasks dispatched by user space drained on Cpu, no task, see Batch
+)
+
+var traceKindNames = [...]string{
+	TraceEnqueue:        "enqueue",
+	TraceDispatch:       "dispatch",
+	TraceDirectDispatch: "direct_dispatch",
+	TraceBounce:         "bounce",
+	TraceCancel:         "cancel",
+	TraceCongested:      "congested",
+	TraceCpuRelease:     "cpu_release",
+	TracePrioPreempt:    "prio_preempt",
+	TraceWakeup:         "wakeup",
+	TraceRunning:        "running",
+	TraceStopping:       "stopping",
+	TraceUserschedRun:   "usersched_run",
+	TraceDispatchBatch:  "dispatch_batch",
+}
+
+func (k TraceKind) String() string {
+	if int(k) < len(traceKindNames) && traceKindNames[k] != "" {
+		return traceKindNames[k]
+	}
+	return fmt.Sprintf("TraceKind(%d)", uint32(k))
+}
+
+// MarshalText encodes the kind by name, e.g. in JSON.
+func (k TraceKind) MarshalText() ([]byte, error) {
+	return []byte(k.String()), nil
+}
+
+// TraceEvent is a structured task event of the BPF side (see struct
+// trace_event in intf.h).
+type TraceEvent struct {
+	Ts   uint64    `json:"ts"` // scx_bpf_now() (ns)
+	Kind TraceKind `json:"kind"`
+	Pid  int32     `json:"pid"`
+	Tgid int32     `json:"tgid"`
+	Cpu  int32     `json:"cpu"`
+	Arg  uint64    `json:"arg"`
+	Comm string    `json:"comm"`
+}
+
+// Batch returns the number of tasks and the duration (ns) of a
+// TraceDispatchBatch event.
+func (ev TraceEvent) Batch() (nr uint32, dur uint64) {
+	return uint32(ev.Arg >> 32), ev.Arg & 0xffffffff
+}
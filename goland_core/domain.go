@@ -0,0 +1,77 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// MAX_CPUS mirrors MAX_CPUS in intf.h.
+const MAX_CPUS = 1024
+
+// Scheduling domain levels (see struct domain_arg in intf.h).
+const (
+	DomainL2   int32 = 2
+	DomainL3   int32 = 3
+	DomainNuma int32 = 4
+)
+
+type domain_mask_arg struct {
+	lvlId int32
+	cpuId int32
+	cpus  [MAX_CPUS / 64]uint64
+}
+
+func (s *Sched) runDomainProg(prog *bpf.BPFProg, name string, arg any) error {
+	if prog == nil {
+		return fmt.Errorf("prog (%s) not found", name)
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, arg)
+	opt := bpf.RunOpts{
+		CtxIn:     data.Bytes(),
+		CtxSizeIn: uint32(data.Len()),
+	}
+	err := prog.Run(&opt)
+	if err != nil {
+		return err
+	}
+	if opt.RetVal != 0 {
+		return fmt.Errorf("retVal: %v", int32(opt.RetVal))
+	}
+	return nil
+}
+
+// DisableSiblingCpu removes siblingCpuId from the lvlId domain of cpuId.
+func (s *Sched) DisableSiblingCpu(lvlId, cpuId, siblingCpuId int32) error {
+	return s.runDomainProg(s.disableSibling, "disableSibling", &domain_arg{
+		lvlId:        lvlId,
+		cpuId:        cpuId,
+		siblingCpuId: siblingCpuId,
+	})
+}
+
+// SetCacheDomain atomically replaces the level domain of cpuId (DomainL2,
+// DomainL3 or DomainNuma) with cpus. Unlike EnableSiblingCpu it can be
+// called again at any time, e.g. to group CPUs by core complex or to move
+// housekeeping CPUs out of a domain.
+func (s *Sched) SetCacheDomain(level int32, cpuId int32, cpus []int) error {
+	arg := &domain_mask_arg{
+		lvlId: level,
+		cpuId: cpuId,
+	}
+	for _, cpu := range cpus {
+		if cpu < 0 || cpu >= MAX_CPUS {
+			return fmt.Errorf("invalid cpu %d", cpu)
+		}
+		arg.cpus[cpu/64] |= 1 << (cpu % 64)
+	}
+	return s.runDomainProg(s.setDomain, "setDomain", arg)
+}
+
+// ResetCacheDomain empties the level domain of cpuId.
+func (s *Sched) ResetCacheDomain(level int32, cpuId int32) error {
+	return s.SetCacheDomain(level, cpuId, nil)
+}
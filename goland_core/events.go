@@ -0,0 +1,124 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// SchedEventsPath is the sysfs file where the kernel reports the sched_ext
+// event counters of the running scheduler.
+const SchedEventsPath = "/sys/kernel/sched_ext/root/events"
+
+// ErrEventsUnsupported is returned by GetSchedEvents on kernels that expose
+// the sched_ext event counters neither through scx_bpf_events() nor sysfs.
+var ErrEventsUnsupported = errors.New("sched_ext events are not supported by this kernel")
+
+// SchedEvents mirrors struct sched_events_arg in intf.h: the sched_ext core
+// event counters (struct scx_event_stats), summed over all CPUs.
+type SchedEvents struct {
+	SelectCpuFallback        int64 `json:"select_cpu_fallback"`         // ops.select_cpu() returned a CPU the task can't use
+	DispatchLocalDsqOffline  int64 `json:"dispatch_local_dsq_offline"`  // Tasks dispatched to the local DSQ of an offline CPU
+	DispatchKeepLast         int64 `json:"dispatch_keep_last"`          // Previous tasks kept running because nothing else was dispatched
+	EnqSkipExiting           int64 `json:"enq_skip_exiting"`            // Exiting tasks dispatched locally without ops.enqueue()
+	EnqSkipMigrationDisabled int64 `json:"enq_skip_migration_disabled"` // Migration disabled tasks dispatched locally without ops.enqueue()
+	RefillSliceDfl           int64 `json:"refill_slice_dfl"`            // Slices refilled with SCX_SLICE_DFL by the core
+	BypassDuration           int64 `json:"bypass_duration"`             // Total time spent in bypass mode (ns)
+	BypassDispatch           int64 `json:"bypass_dispatch"`             // Tasks dispatched in bypass mode
+	BypassActivate           int64 `json:"bypass_activate"`             // Number of times bypass mode was enabled
+}
+
+// sysfs names of the SchedEvents counters.
+var schedEventNames = map[string]func(*SchedEvents) *int64{
+	"SCX_EV_SELECT_CPU_FALLBACK":         func(e *SchedEvents) *int64 { return &e.SelectCpuFallback },
+	"SCX_EV_DISPATCH_LOCAL_DSQ_OFFLINE":  func(e *SchedEvents) *int64 { return &e.DispatchLocalDsqOffline },
+	"SCX_EV_DISPATCH_KEEP_LAST":          func(e *SchedEvents) *int64 { return &e.DispatchKeepLast },
+	"SCX_EV_ENQ_SKIP_EXITING":            func(e *SchedEvents) *int64 { return &e.EnqSkipExiting },
+	"SCX_EV_ENQ_SKIP_MIGRATION_DISABLED": func(e *SchedEvents) *int64 { return &e.EnqSkipMigrationDisabled },
+	"SCX_EV_REFILL_SLICE_DFL":            func(e *SchedEvents) *int64 { return &e.RefillSliceDfl },
+	"SCX_EV_BYPASS_DURATION":             func(e *SchedEvents) *int64 { return &e.BypassDuration },
+	"SCX_EV_BYPASS_DISPATCH":             func(e *SchedEvents) *int64 { return &e.BypassDispatch },
+	"SCX_EV_BYPASS_ACTIVATE":             func(e *SchedEvents) *int64 { return &e.BypassActivate },
+}
+
+// GetSchedEvents returns the sched_ext event counters, read with
+// scx_bpf_events() when the kernel has it and from SchedEventsPath
+// otherwise. It returns ErrEventsUnsupported when neither is available.
+func (s *Sched) GetSchedEvents() (SchedEvents, error) {
+	ev, err := s.readSchedEventsProg()
+	if err == nil {
+		return ev, nil
+	}
+	if !errors.Is(err, ErrEventsUnsupported) {
+		return SchedEvents{}, err
+	}
+	return ReadSchedEvents(SchedEventsPath)
+}
+
+func (s *Sched) readSchedEventsProg() (SchedEvents, error) {
+	if s.schedEvents == nil {
+		return SchedEvents{}, ErrEventsUnsupported
+	}
+	var ev SchedEvents
+	size := binary.Size(ev)
+	opt := bpf.RunOpts{
+		CtxIn:      make([]byte, size),
+		CtxSizeIn:  uint32(size),
+		CtxOut:     make([]byte, size),
+		CtxSizeOut: uint32(size),
+	}
+	if err := s.schedEvents.Run(&opt); err != nil {
+		return SchedEvents{}, err
+	}
+	if ret := int32(opt.RetVal); ret < 0 {
+		if syscall.Errno(-ret) == syscall.EOPNOTSUPP {
+			return SchedEvents{}, ErrEventsUnsupported
+		}
+		return SchedEvents{}, fmt.Errorf("get_sched_events: %w", syscall.Errno(-ret))
+	}
+	if err := binary.Read(bytes.NewReader(opt.CtxOut), binary.LittleEndian, &ev); err != nil {
+		return SchedEvents{}, err
+	}
+	return ev, nil
+}
+
+// ReadSchedEvents parses the "SCX_EV_<NAME> <count>" lines of the sysfs
+// events file at path. Unknown counters are ignored. It returns
+// ErrEventsUnsupported if the file does not exist.
+func ReadSchedEvents(path string) (SchedEvents, error) {
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return SchedEvents{}, ErrEventsUnsupported
+	}
+	if err != nil {
+		return SchedEvents{}, err
+	}
+	defer f.Close()
+
+	var ev SchedEvents
+	sc := bufio.NewScanner(f)
+	for sc.Scan() {
+		name, val, ok := strings.Cut(strings.TrimSpace(sc.Text()), " ")
+		if !ok {
+			continue
+		}
+		field, ok := schedEventNames[name]
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(val), 10, 64)
+		if err != nil {
+			return SchedEvents{}, fmt.Errorf("%s: %s: %w", path, name, err)
+		}
+		*field(&ev) = n
+	}
+	return ev, sc.Err()
+}
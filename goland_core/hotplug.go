@@ -0,0 +1,42 @@
+package core
+
+import (
+	"encoding/binary"
+	"log/slog"
+)
+
+// HotplugEvent reports that a CPU went online or offline (see struct
+// cpu_hotplug_event in intf.h).
+type HotplugEvent struct {
+	Cpu       int32
+	Online    bool
+	Timestamp uint64 // scx_bpf_now() when the event happened
+}
+
+const hotplugEventSize = 16
+
+// HotplugEvents returns the CPU hotplug events notified by the BPF side. The
+// channel is nil before Start.
+func (s *Sched) HotplugEvents() <-chan HotplugEvent {
+	return s.hotplug
+}
+
+func decodeHotplugEvents(raw <-chan []byte, out chan<- HotplugEvent, log *slog.Logger) {
+	for b := range raw {
+		if len(b) < hotplugEventSize {
+			log.Warn("short hotplug event", "map", "hotplug_events", "size", len(b))
+			continue
+		}
+		ev := HotplugEvent{
+			Cpu:       int32(binary.LittleEndian.Uint32(b[0:4])),
+			Online:    binary.LittleEndian.Uint32(b[4:8]) != 0,
+			Timestamp: binary.LittleEndian.Uint64(b[8:16]),
+		}
+		select {
+		case out <- ev:
+		default:
+			log.Warn("hotplug event dropped", "cpu", ev.Cpu, "online", ev.Online)
+		}
+	}
+	close(out)
+}
@@ -0,0 +1,62 @@
+package core
+
+/*
+#include "wrapper.h"
+*/
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"unsafe"
+
+	"github.com/Gthulhu/qumun/goland_core/btf"
+)
+
+// ObjectBytes returns the BPF object embedded in the skeleton.
+func ObjectBytes() []byte {
+	var sz C.size_t
+	p := C.get_elf_bytes(&sz)
+	if p == nil || sz == 0 {
+		return nil
+	}
+	return C.GoBytes(unsafe.Pointer(p), C.int(sz))
+}
+
+func loadLayouts(obj []byte) (bss, rodata *btf.Datasec, err error) {
+	spec, err := btf.LoadELF(obj)
+	if err != nil {
+		return nil, nil, err
+	}
+	if bss, err = spec.Datasec(".bss"); err != nil {
+		return nil, nil, err
+	}
+	if rodata, err = spec.Datasec(".rodata"); err != nil {
+		return nil, nil, err
+	}
+	return bss, rodata, nil
+}
+
+// CheckLayouts reports every BssData and Rodata field that has no matching
+// global in the BPF object obj, or whose size differs from it. It is run by
+// Start on the embedded object, and by TestCheckLayouts on main.bpf.o.
+func CheckLayouts(obj []byte) error {
+	bss, rodata, err := loadLayouts(obj)
+	if err != nil {
+		return err
+	}
+	return errors.Join(btf.Check(bss, BssData{}), btf.Check(rodata, Rodata{}))
+}
+
+func (s *Sched) loadLayouts() error {
+	obj := ObjectBytes()
+	if obj == nil {
+		return fmt.Errorf("skeleton has no embedded object")
+	}
+	if err := CheckLayouts(obj); err != nil {
+		return err
+	}
+	var err error
+	s.bssLayout, s.rodataLayout, err = loadLayouts(obj)
+	return err
+}
@@ -0,0 +1,24 @@
+package core
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"testing"
+)
+
+// TestCheckLayouts fails when BssData or Rodata no longer match the globals
+// of a compiled main.bpf.o (`make main.bpf.o`); it is skipped when the
+// object has not been built.
+func TestCheckLayouts(t *testing.T) {
+	obj, err := os.ReadFile("../main.bpf.o")
+	if errors.Is(err, fs.ErrNotExist) {
+		t.Skip("main.bpf.o not built")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := CheckLayouts(obj); err != nil {
+		t.Errorf("layout drift:\n%v", err)
+	}
+}
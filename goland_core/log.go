@@ -0,0 +1,25 @@
+package core
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Option configures a Sched created by LoadSched.
+type Option func(*Sched)
+
+// WithLogger makes the Sched log to l. By default it logs nothing, so that
+// embedding the package does not write to the process' stderr.
+func WithLogger(l *slog.Logger) Option {
+	return func(s *Sched) {
+		s.log = l
+	}
+}
+
+// discardHandler drops all records (slog.DiscardHandler needs Go 1.24).
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
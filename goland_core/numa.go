@@ -0,0 +1,33 @@
+package core
+
+import "github.com/Gthulhu/plugin/models"
+
+// SetCpuNumaNode records that cpuId belongs to NUMA node node. It is called
+// by util.InitNumaDomains, also while the scheduler runs when the CPU
+// topology changes.
+func (s *Sched) SetCpuNumaNode(cpuId, node int32) {
+	s.topoMu.Lock()
+	defer s.topoMu.Unlock()
+	if s.cpuNode == nil {
+		s.cpuNode = make(map[int32]int32)
+	}
+	s.cpuNode[cpuId] = node
+}
+
+// NumaNodeOf returns the NUMA node of cpuId, or -1 if it is unknown.
+func (s *Sched) NumaNodeOf(cpuId int32) int32 {
+	s.topoMu.RLock()
+	defer s.topoMu.RUnlock()
+	if node, ok := s.cpuNode[cpuId]; ok {
+		return node
+	}
+	return -1
+}
+
+// TaskNumaNode returns the NUMA node of the CPU the task last ran on, which
+// is where most of its recently touched memory lives, or -1 if it is
+// unknown. models.QueuedTask belongs to the plugin module, so the node is
+// looked up here rather than carried in the task.
+func (s *Sched) TaskNumaNode(t *models.QueuedTask) int32 {
+	return s.NumaNodeOf(t.Cpu)
+}
@@ -0,0 +1,31 @@
+package core
+
+import (
+	"sync"
+	"testing"
+)
+
+// The topology is updated on CPU hotplug while the scheduling loops read
+// it; run with -race.
+func TestTopologyConcurrent(t *testing.T) {
+	s := &Sched{}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := int32(0); i < 1000; i++ {
+			s.SetCpuNumaNode(i%8, i%2)
+		}
+	}()
+	for i := int32(0); i < 1000; i++ {
+		if node := s.NumaNodeOf(i % 8); node != -1 && node != i%8%2 {
+			t.Fatalf("cpu %d: node %d", i%8, node)
+		}
+		s.IsAsymmetric()
+		s.capacityRange(CapacityPerformance)
+	}
+	wg.Wait()
+	if node := s.NumaNodeOf(3); node != 1 {
+		t.Errorf("cpu 3: node %d, want 1", node)
+	}
+}
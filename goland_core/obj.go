@@ -4,39 +4,72 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
+	"log/slog"
+	"sync"
+	"sync/atomic"
 	"syscall"
 
 	"github.com/Gthulhu/plugin/models"
 	"github.com/Gthulhu/plugin/plugin"
+	"github.com/Gthulhu/qumun/goland_core/btf"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
 	bpf "github.com/aquasecurity/libbpfgo"
 	"golang.org/x/sys/unix"
 )
 
 const (
-	RL_CPU_ANY = 1 << 20
+	RL_CPU_ANY = dataplane.RL_CPU_ANY
 )
 
 type Sched struct {
-	mod        *bpf.Module
-	plugin     plugin.CustomScheduler
-	bss        *BssMap
-	uei        *UeiMap
-	rodata     *RodataMap
-	structOps  *bpf.BPFMap
-	queue      chan []byte // The map containing tasks that are queued to user space from the kernel.
-	dispatch   chan []byte
-	selectCpu  *bpf.BPFProg
-	preemptCpu *bpf.BPFProg
-	siblingCpu *bpf.BPFProg
-	urb        *bpf.UserRingBuffer
+	mod            *bpf.Module
+	plugin         plugin.CustomScheduler
+	bss            *BssMap
+	uei            *UeiMap
+	rodata         *RodataMap
+	bssLayout      *btf.Datasec
+	rodataLayout   *btf.Datasec
+	structOps      *bpf.BPFMap
+	runningTask    *bpf.BPFMap
+	queue          chan []byte // The map containing tasks that are queued to user space from the kernel.
+	policy         CongestionPolicy
+	queuedShards   int // shards of the queued ring buffer
+	dispatch       chan []byte
+	hotplug        chan HotplugEvent
+	congestion     chan CongestionEvent
+	trace          chan TraceEvent
+	traceLost      atomic.Uint64
+	selectCpu      *bpf.BPFProg
+	selectCpuCap   *bpf.BPFProg
+	setCapacity    *bpf.BPFProg
+	setShard       *bpf.BPFProg
+	getShards      *bpf.BPFProg
+	setPartition   *bpf.BPFProg
+	preemptCpu     *bpf.BPFProg
+	preemptPrio    *bpf.BPFProg
+	siblingCpu     *bpf.BPFProg
+	disableSibling *bpf.BPFProg
+	setDomain      *bpf.BPFProg
+	schedEvents    *bpf.BPFProg
+	urb            *bpf.UserRingBuffer
+	recorder       Recorder
+	recordMu       sync.Mutex // serializes the recorder between workers
+	parallel       bool       // one Worker per shard of the queue
+	workers        []*Worker
+	pendingMu      sync.Mutex
+	nrPending      uint64 // sum of the tasks held by the workers
+	preempt        preemptState
+	topoMu         sync.RWMutex // guards cpuNode and cpuCap, updated on CPU hotplug
+	cpuNode        map[int32]int32
+	cpuCap         map[int32]uint32
+	log            *slog.Logger
 }
 
 func init() {
 	unix.Mlockall(syscall.MCL_CURRENT | syscall.MCL_FUTURE)
 }
 
-func LoadSched(objPath string) *Sched {
+func LoadSched(objPath string, opts ...Option) *Sched {
 	obj := LoadSkel()
 	bpfModule, err := bpf.NewModuleFromFileArgs(bpf.NewModuleArgs{
 		BPFObjPath:     "",
@@ -50,7 +83,13 @@ func LoadSched(objPath string) *Sched {
 	}
 
 	s := &Sched{
-		mod: bpfModule,
+		mod:          bpfModule,
+		policy:       defaultCongestionPolicy,
+		queuedShards: 1,
+		log:          slog.New(discardHandler{}),
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
 
 	return s
@@ -60,29 +99,35 @@ func (s *Sched) SetPlugin(p plugin.CustomScheduler) {
 	s.plugin = p
 }
 
-func (s *Sched) Start() {
+// Start loads the BPF object and sets up its ring buffers; Attach then
+// enables the scheduler. An error leaves the object to be released by Close.
+func (s *Sched) Start() error {
 	var err error
 	bpfModule := s.mod
-	bpfModule.BPFLoadObject()
+	if err := s.loadLayouts(); err != nil {
+		return fmt.Errorf("bpf data layout mismatch: %w", err)
+	}
+	if err := s.resizeQueued(); err != nil {
+		return fmt.Errorf("resize queued ring buffer: %w", err)
+	}
+	if err := bpfModule.BPFLoadObject(); err != nil {
+		return fmt.Errorf("load bpf object: %w", err)
+	}
+	s.queue = make(chan []byte, s.policy.RingSize)
+	if s.parallel {
+		s.initWorkers()
+	}
 	iters := bpfModule.Iterator()
 	for {
 		prog := iters.NextProgram()
 		if prog == nil {
 			break
 		}
-		if prog.Name() == "kprobe_handle_mm_fault" {
-			log.Println("attach kprobe_handle_mm_fault")
+		if prog.Name() == "kprobe_handle_mm_fault" || prog.Name() == "kretprobe_handle_mm_fault" {
+			s.log.Info("attaching probe", "prog", prog.Name())
 			_, err := prog.AttachGeneric()
 			if err != nil {
-				log.Panicf("attach kprobe_handle_mm_fault failed: %v", err)
-			}
-			continue
-		}
-		if prog.Name() == "kretprobe_handle_mm_fault" {
-			log.Println("attach kretprobe_handle_mm_fault")
-			_, err := prog.AttachGeneric()
-			if err != nil {
-				log.Panicf("attach kretprobe_handle_mm_fault failed: %v", err)
+				return fmt.Errorf("attach %s: %w", prog.Name(), err)
 			}
 			continue
 		}
@@ -93,25 +138,62 @@ func (s *Sched) Start() {
 		if m == nil {
 			break
 		}
-		fmt.Printf("map: %s, type: %s, fd: %d\n", m.Name(), m.Type().String(), m.FileDescriptor())
+		s.log.Debug("bpf map", "map", m.Name(), "type", m.Type().String(), "fd", m.FileDescriptor())
 		if m.Name() == "main_bpf.bss" {
 			s.bss = &BssMap{m}
 		} else if m.Name() == "main_bpf.data" {
 			s.uei = &UeiMap{m}
 		} else if m.Name() == "main_bpf.rodata" {
 			s.rodata = &RodataMap{m}
-		} else if m.Name() == "queued" {
-			s.queue = make(chan []byte, 4096)
-			rb, err := s.mod.InitRingBuf("queued", s.queue)
+		} else if m.Name() == "running_task" {
+			s.runningTask = m
+		} else if shard, ok := queuedShard(m.Name()); ok {
+			// All the shards feed the same queue, unless each one has
+			// its own worker.
+			if shard >= s.queuedShards {
+				continue
+			}
+			queue := s.queue
+			if s.parallel {
+				queue = s.workers[shard].queue
+			}
+			rb, err := s.mod.InitRingBuf(m.Name(), queue)
+			if err != nil {
+				return fmt.Errorf("init ring buffer %s: %w", m.Name(), err)
+			}
+			rb.Poll(50)
+		} else if m.Name() == "hotplug_events" {
+			raw := make(chan []byte, 64)
+			rb, err := s.mod.InitRingBuf("hotplug_events", raw)
+			if err != nil {
+				return fmt.Errorf("init ring buffer hotplug_events: %w", err)
+			}
+			rb.Poll(50)
+			s.hotplug = make(chan HotplugEvent, 64)
+			go decodeHotplugEvents(raw, s.hotplug, s.log)
+		} else if m.Name() == "congestion_events" {
+			raw := make(chan []byte, 64)
+			rb, err := s.mod.InitRingBuf("congestion_events", raw)
+			if err != nil {
+				return fmt.Errorf("init ring buffer congestion_events: %w", err)
+			}
+			rb.Poll(50)
+			s.congestion = make(chan CongestionEvent, 64)
+			go decodeCongestionEvents(raw, s.congestion, s.log)
+		} else if m.Name() == "trace_events" {
+			raw := make(chan []byte, 4096)
+			rb, err := s.mod.InitRingBuf("trace_events", raw)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("init ring buffer trace_events: %w", err)
 			}
 			rb.Poll(50)
+			s.trace = make(chan TraceEvent, 4096)
+			go decodeTraceEvents(raw, s.trace, &s.traceLost, s.log)
 		} else if m.Name() == "dispatched" {
 			s.dispatch = make(chan []byte, 4096)
 			s.urb, err = s.mod.InitUserRingBuf("dispatched", s.dispatch)
 			if err != nil {
-				panic(err)
+				return fmt.Errorf("init user ring buffer dispatched: %w", err)
 			}
 			s.urb.Start()
 		}
@@ -131,14 +213,51 @@ func (s *Sched) Start() {
 			s.selectCpu = prog
 		}
 
+		if prog.Name() == "rs_select_cpu_cap" {
+			s.selectCpuCap = prog
+		}
+
+		if prog.Name() == "set_cpu_capacity" {
+			s.setCapacity = prog
+		}
+
+		if prog.Name() == "set_queued_shard" {
+			s.setShard = prog
+		}
+
+		if prog.Name() == "get_queued_shards" {
+			s.getShards = prog
+		}
+
+		if prog.Name() == "set_cpu_partition" {
+			s.setPartition = prog
+		}
+
 		if prog.Name() == "enable_sibling_cpu" {
 			s.siblingCpu = prog
 		}
 
+		if prog.Name() == "disable_sibling_cpu" {
+			s.disableSibling = prog
+		}
+
+		if prog.Name() == "set_cache_domain" {
+			s.setDomain = prog
+		}
+
 		if prog.Name() == "do_preempt" {
 			s.preemptCpu = prog
 		}
+
+		if prog.Name() == "preempt_if_lower_prio" {
+			s.preemptPrio = prog
+		}
+
+		if prog.Name() == "get_sched_events" {
+			s.schedEvents = prog
+		}
 	}
+	return nil
 }
 
 type task_cpu_arg struct {
@@ -241,7 +360,12 @@ func (s *Sched) Attach() error {
 	return err
 }
 
+// Close releases the BPF object, also after a failed Start.
 func (s *Sched) Close() {
-	s.urb.Close()
-	s.mod.Close()
+	if s.urb != nil {
+		s.urb.Close()
+	}
+	if s.mod != nil {
+		s.mod.Close()
+	}
 }
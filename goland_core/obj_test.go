@@ -0,0 +1,16 @@
+package core
+
+import "testing"
+
+// A Sched whose Start failed, before or after loading the object, can
+// still be closed.
+func TestCloseAfterFailedStart(t *testing.T) {
+	(&Sched{}).Close()
+
+	s := LoadSched("")
+	if err := s.Start(); err == nil {
+		s.Close()
+		t.Skip("Start succeeded")
+	}
+	s.Close()
+}
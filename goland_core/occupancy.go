@@ -0,0 +1,64 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"syscall"
+	"unsafe"
+
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+// RunningTask is the task owning a CPU, as recorded by the BPF side in the
+// running_task map.
+type RunningTask = dataplane.RunningTask
+
+// running_task_info mirrors struct running_task_info in intf.h.
+type running_task_info struct {
+	Pid     uint32
+	Tgid    uint32
+	StartTs uint64
+	IsPrio  uint32
+	_       uint32
+}
+
+// CPUOccupancy returns a snapshot of the CPUs currently running a task
+// managed by the scheduler, sorted by CPU. Idle CPUs and CPUs running the
+// user-space scheduler are not reported.
+func (s *Sched) CPUOccupancy() ([]RunningTask, error) {
+	if s.runningTask == nil {
+		return nil, fmt.Errorf("map (running_task) not found")
+	}
+	var tasks []RunningTask
+	it := s.runningTask.Iterator()
+	for it.Next() {
+		cpu := int32(binary.LittleEndian.Uint32(it.Key()))
+		b, err := s.runningTask.GetValue(unsafe.Pointer(&cpu))
+		if err != nil {
+			if errors.Is(err, syscall.ENOENT) {
+				// The CPU went idle in the meantime.
+				continue
+			}
+			return nil, err
+		}
+		var info running_task_info
+		if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &info); err != nil {
+			return nil, err
+		}
+		tasks = append(tasks, RunningTask{
+			Cpu:      cpu,
+			Pid:      int32(info.Pid),
+			Tgid:     int32(info.Tgid),
+			StartTs:  info.StartTs,
+			Priority: info.IsPrio != 0,
+		})
+	}
+	if err := it.Err(); err != nil {
+		return nil, err
+	}
+	sort.Slice(tasks, func(i, j int) bool { return tasks[i].Cpu < tasks[j].Cpu })
+	return tasks, nil
+}
@@ -0,0 +1,80 @@
+package core
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+
+	"golang.org/x/sys/unix"
+)
+
+// CpuPartition is the partition a CPU belongs to (see enum cpu_partition in
+// intf.h).
+type CpuPartition uint32
+
+const (
+	PartitionGeneral   CpuPartition = iota // usable by every task
+	PartitionUsersched                     // reserved to the user-space scheduler
+	PartitionReserved                      // reserved to priority tasks
+)
+
+type cpu_partition_arg struct {
+	cpuId     int32
+	partition uint32
+}
+
+// SetCpuPartition moves cpuId to partition part. CPUs of PartitionUsersched
+// and PartitionReserved are skipped by the BPF idle CPU selection for
+// regular tasks and don't consume the shared DSQ; a task dispatched to a CPU
+// its partitions exclude is bounced to the shared DSQ.
+func (s *Sched) SetCpuPartition(cpuId int32, part CpuPartition) error {
+	return s.runDomainProg(s.setPartition, "setPartition", &cpu_partition_arg{
+		cpuId:     cpuId,
+		partition: uint32(part),
+	})
+}
+
+// SetUserschedCpus dedicates cpus to the user-space scheduler: they are
+// moved to PartitionUsersched and every thread of the scheduler process is
+// bound to them. Threads created later inherit the affinity.
+func (s *Sched) SetUserschedCpus(cpus []int) error {
+	if len(cpus) == 0 {
+		return nil
+	}
+	var set unix.CPUSet
+	for _, cpu := range cpus {
+		if err := s.SetCpuPartition(int32(cpu), PartitionUsersched); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+		set.Set(cpu)
+	}
+	return setProcessAffinity(&set)
+}
+
+// SetReservedCpus reserves cpus to priority tasks.
+func (s *Sched) SetReservedCpus(cpus []int) error {
+	for _, cpu := range cpus {
+		if err := s.SetCpuPartition(int32(cpu), PartitionReserved); err != nil {
+			return fmt.Errorf("cpu %d: %w", cpu, err)
+		}
+	}
+	return nil
+}
+
+// setProcessAffinity binds every thread of the current process to set.
+func setProcessAffinity(set *unix.CPUSet) error {
+	entries, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		tid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		if err := unix.SchedSetaffinity(tid, set); err != nil {
+			return fmt.Errorf("sched_setaffinity(%d): %w", tid, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,167 @@
+package core
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// PreemptResult is the outcome of a PreemptCpuFor request.
+type PreemptResult = dataplane.PreemptResult
+
+const (
+	PreemptKicked      = dataplane.PreemptKicked      // CPU kicked, running task preempted
+	PreemptIdle        = dataplane.PreemptIdle        // no task running on the CPU
+	PreemptNotLower    = dataplane.PreemptNotLower    // running task has an equal or higher priority
+	PreemptNoTask      = dataplane.PreemptNoTask      // requesting task doesn't exist anymore
+	PreemptRateLimited = dataplane.PreemptRateLimited // CPU preempted too recently
+)
+
+// PreemptStats counts the PreemptCpuFor requests. Every request is either
+// performed, suppressed or failed.
+type PreemptStats struct {
+	Requested   uint64 `json:"requested"`
+	Performed   uint64 `json:"performed"`
+	Suppressed  uint64 `json:"suppressed"` // sum of the reasons below
+	Idle        uint64 `json:"idle"`
+	NotLower    uint64 `json:"not_lower"`
+	NoTask      uint64 `json:"no_task"`
+	RateLimited uint64 `json:"rate_limited"`
+	Errors      uint64 `json:"errors"` // requests that failed to run the BPF program
+}
+
+type preemptState struct {
+	mu          sync.Mutex
+	minInterval time.Duration
+	lastKick    map[int32]time.Time
+
+	requested, performed           atomic.Uint64
+	idle, notLower, noTask, rlimit atomic.Uint64
+	errors                         atomic.Uint64
+}
+
+type preempt_prio_arg struct {
+	cpuId int32
+	pid   int32
+}
+
+// SetPreemptRateLimit sets the minimum interval between two preemptions of
+// the same CPU performed by PreemptCpuFor (0 disables rate limiting).
+func (s *Sched) SetPreemptRateLimit(minInterval time.Duration) {
+	s.preempt.mu.Lock()
+	defer s.preempt.mu.Unlock()
+	s.preempt.minInterval = minInterval
+}
+
+// reserve claims the next preemption of cpuId at now, unless the CPU was
+// preempted less than minInterval ago. The claim keeps concurrent requests
+// for the same CPU from all going through; it must be given back with
+// unreserve if the CPU is not kicked.
+func (p *preemptState) reserve(cpuId int32, now time.Time) (prev time.Time, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	prev = p.lastKick[cpuId]
+	if p.minInterval > 0 && !prev.IsZero() && now.Sub(prev) < p.minInterval {
+		return prev, false
+	}
+	if p.lastKick == nil {
+		p.lastKick = make(map[int32]time.Time)
+	}
+	p.lastKick[cpuId] = now
+	return prev, true
+}
+
+// unreserve restores the last preemption of cpuId to prev after a reserve
+// at now that did not kick the CPU.
+func (p *preemptState) unreserve(cpuId int32, now, prev time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !p.lastKick[cpuId].Equal(now) {
+		return
+	}
+	if prev.IsZero() {
+		delete(p.lastKick, cpuId)
+	} else {
+		p.lastKick[cpuId] = prev
+	}
+}
+
+// PreemptCpuFor preempts cpuId on behalf of task pid, only if the task
+// running on cpuId (see the running_task map) has a lower priority: priority
+// tasks win over regular tasks, then the higher weight wins.
+func (s *Sched) PreemptCpuFor(cpuId int32, pid int32) (PreemptResult, error) {
+	p := &s.preempt
+	p.requested.Add(1)
+
+	now := time.Now()
+	prev, ok := p.reserve(cpuId, now)
+	if !ok {
+		p.rlimit.Add(1)
+		return PreemptRateLimited, nil
+	}
+	res, err := s.runPreemptPrio(cpuId, pid)
+	if err != nil {
+		p.unreserve(cpuId, now, prev)
+		p.errors.Add(1)
+		return PreemptIdle, err
+	}
+	if res != PreemptKicked {
+		p.unreserve(cpuId, now, prev)
+	}
+	switch res {
+	case PreemptKicked:
+		p.performed.Add(1)
+	case PreemptIdle:
+		p.idle.Add(1)
+	case PreemptNotLower:
+		p.notLower.Add(1)
+	case PreemptNoTask:
+		p.noTask.Add(1)
+	}
+	return res, nil
+}
+
+func (s *Sched) runPreemptPrio(cpuId int32, pid int32) (PreemptResult, error) {
+	if s.preemptPrio == nil {
+		return PreemptIdle, fmt.Errorf("prog (preemptPrio) not found")
+	}
+	arg := &preempt_prio_arg{
+		cpuId: cpuId,
+		pid:   pid,
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, arg)
+	opt := bpf.RunOpts{
+		CtxIn:     data.Bytes(),
+		CtxSizeIn: uint32(data.Len()),
+	}
+	if err := s.preemptPrio.Run(&opt); err != nil {
+		return PreemptIdle, err
+	}
+	if int32(opt.RetVal) < 0 {
+		return PreemptIdle, fmt.Errorf("retVal: %v", int32(opt.RetVal))
+	}
+	return PreemptResult(opt.RetVal), nil
+}
+
+// GetPreemptStats returns the PreemptCpuFor counters.
+func (s *Sched) GetPreemptStats() PreemptStats {
+	p := &s.preempt
+	st := PreemptStats{
+		Requested:   p.requested.Load(),
+		Performed:   p.performed.Load(),
+		Idle:        p.idle.Load(),
+		NotLower:    p.notLower.Load(),
+		NoTask:      p.noTask.Load(),
+		RateLimited: p.rlimit.Load(),
+		Errors:      p.errors.Load(),
+	}
+	st.Suppressed = st.Idle + st.NotLower + st.NoTask + st.RateLimited
+	return st
+}
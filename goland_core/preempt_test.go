@@ -0,0 +1,63 @@
+package core
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+// Concurrent requests for the same CPU within the interval get a single
+// reservation.
+func TestPreemptReserve(t *testing.T) {
+	p := &preemptState{minInterval: time.Hour}
+	now := time.Now()
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var granted int
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := p.reserve(1, now); ok {
+				mu.Lock()
+				granted++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if granted != 1 {
+		t.Fatalf("%d reservations granted, want 1", granted)
+	}
+	if _, ok := p.reserve(2, now); !ok {
+		t.Error("reservation of another CPU refused")
+	}
+}
+
+// A reservation that did not kick the CPU does not rate limit it.
+func TestPreemptUnreserve(t *testing.T) {
+	p := &preemptState{minInterval: time.Millisecond}
+	t0 := time.Now()
+	prev, ok := p.reserve(0, t0)
+	if !ok || !prev.IsZero() {
+		t.Fatalf("reserve: %v %v", prev, ok)
+	}
+	p.unreserve(0, t0, prev)
+	if _, ok := p.reserve(0, t0); !ok {
+		t.Fatal("CPU rate limited after unreserve")
+	}
+
+	// Kicked at t0, then a failed request after the interval.
+	t1 := t0.Add(2 * time.Millisecond)
+	prev, ok = p.reserve(0, t1)
+	if !ok || !prev.Equal(t0) {
+		t.Fatalf("reserve: %v %v", prev, ok)
+	}
+	p.unreserve(0, t1, prev)
+	if got := p.lastKick[0]; !got.Equal(t0) {
+		t.Errorf("last kick %v, want %v", got, t0)
+	}
+	if _, ok := p.reserve(0, t0.Add(time.Millisecond/2)); ok {
+		t.Error("CPU not rate limited by its last kick")
+	}
+}
@@ -6,15 +6,16 @@ package core
 import "C"
 
 import (
-	"bytes"
-	"encoding/binary"
 	"fmt"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
+	"time"
 	"unsafe"
 
+	"github.com/Gthulhu/qumun/goland_core/btf"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
 	bpf "github.com/aquasecurity/libbpfgo"
 )
 
@@ -22,63 +23,70 @@ type RodataMap struct {
 	*bpf.BPFMap
 }
 
+// Rodata is the content of the .rodata section of main.bpf.c. Fields are
+// decoded by the name in their btf tag (see the btf package), so their
+// order does not have to follow the C declarations. The SCX enum values are
+// only present when the object references them.
 type Rodata struct {
-	DefaultSlice           uint64   `json:"default_slice"`
-	SmtEnabled             bool     `json:"smt_enabled"`
-	Debug                  bool     `json:"debug"`
-	Pad0                   [54]byte `json:"-"` // __pad0[54]
-	SCXOpsNameLen          uint64   `json:"scx_ops_name_len"`
-	SCXSliceDfl            uint64   `json:"scx_slice_dfl"`
-	SCXSliceInf            uint64   `json:"scx_slice_inf"`
-	SCXRqOnline            uint64   `json:"scx_rq_online"`
-	SCXRqCanStopTick       uint64   `json:"scx_rq_can_stop_tick"`
-	SCXRqBalPending        uint64   `json:"scx_rq_bal_pending"`
-	SCXRqBalKeep           uint64   `json:"scx_rq_bal_keep"`
-	SCXRqBypassing         uint64   `json:"scx_rq_bypassing"`
-	SCXRqClkValid          uint64   `json:"scx_rq_clk_valid"`
-	SCXRqInWakeup          uint64   `json:"scx_rq_in_wakeup"`
-	SCXRqInBalance         uint64   `json:"scx_rq_in_balance"`
-	SCXDsqFlagBuiltin      uint64   `json:"scx_dsq_flag_builtin"`
-	SCXDsqFlagLocalOn      uint64   `json:"scx_dsq_flag_local_on"`
-	SCXDsqInvalid          uint64   `json:"scx_dsq_invalid"`
-	SCXDsqGlobal           uint64   `json:"scx_dsq_global"`
-	SCXDsqLocal            uint64   `json:"scx_dsq_local"`
-	SCXDsqLocalOn          uint64   `json:"scx_dsq_local_on"`
-	SCXDsqLocalCpuMask     uint64   `json:"scx_dsq_local_cpu_mask"`
-	SCXTaskQueued          uint64   `json:"scx_task_queued"`
-	SCXTaskResetRunnableAt uint64   `json:"scx_task_reset_runnable_at"`
-	SCXTaskDeqdForSleep    uint64   `json:"scx_task_deqd_for_sleep"`
-	SCXTaskStateShift      uint64   `json:"scx_task_state_shift"`
-	SCXTaskStateBits       uint64   `json:"scx_task_state_bits"`
-	SCXTaskStateMask       uint64   `json:"scx_task_state_mask"`
-	SCXTaskCursor          uint64   `json:"scx_task_cursor"`
-	SCXTaskNone            uint64   `json:"scx_task_none"`
-	SCXTaskInit            uint64   `json:"scx_task_init"`
-	SCXTaskReady           uint64   `json:"scx_task_ready"`
-	SCXTaskEnabled         uint64   `json:"scx_task_enabled"`
-	SCXTaskNrStates        uint64   `json:"scx_task_nr_states"`
-	SCXTaskDsqOnPriq       uint64   `json:"scx_task_dsq_on_priq"`
-	SCXKickIdle            uint64   `json:"scx_kick_idle"`
-	SCXKickPreempt         uint64   `json:"scx_kick_preempt"`
-	SCXKickWait            uint64   `json:"scx_kick_wait"`
-	SCXEnqWakeup           uint64   `json:"scx_enq_wakeup"`
-	SCXEnqHead             uint64   `json:"scx_enq_head"`
-	SCXEnqPreempt          uint64   `json:"scx_enq_preempt"`
-	SCXEnqReenq            uint64   `json:"scx_enq_reenq"`
-	SCXEnqLast             uint64   `json:"scx_enq_last"`
-	SCXEnqClearOpss        uint64   `json:"scx_enq_clear_opss"`
-	SCXEnqDsqPriq          uint64   `json:"scx_enq_dsq_priq"`
-	UeiDumpLen             uint32   `json:"uei_dump_len"`
-	UserschedPid           uint32   `json:"usersched_pid"`
-	KhugepagePid           uint32   `json:"khugepage_pid"`
-	SwitchPartial          bool     `json:"switch_partial"`
-	EarlyProcessing        bool     `json:"early_processing"`
-	BuiltinIdle            bool     `json:"builtin_idle"`
+	DefaultSlice           uint64 `json:"default_slice" btf:"default_slice"`
+	UserschedTimerNs       uint64 `json:"usersched_timer_ns" btf:"usersched_timer_ns"`
+	QueuedRingBytes        uint64 `json:"queued_ring_bytes" btf:"queued_ring_bytes"`
+	QueuedHighWatermark    uint64 `json:"queued_high_watermark" btf:"queued_high_watermark"`
+	InteractiveRuntimeNs   uint64 `json:"interactive_runtime_ns" btf:"interactive_runtime_ns"`
+	SmtEnabled             bool   `json:"smt_enabled" btf:"smt_enabled"`
+	Debug                  bool   `json:"debug" btf:"debug"`
+	SCXOpsNameLen          uint64 `json:"scx_ops_name_len" btf:"__SCX_OPS_NAME_LEN,optional"`
+	SCXSliceDfl            uint64 `json:"scx_slice_dfl" btf:"__SCX_SLICE_DFL,optional"`
+	SCXSliceInf            uint64 `json:"scx_slice_inf" btf:"__SCX_SLICE_INF,optional"`
+	SCXRqOnline            uint64 `json:"scx_rq_online" btf:"__SCX_RQ_ONLINE,optional"`
+	SCXRqCanStopTick       uint64 `json:"scx_rq_can_stop_tick" btf:"__SCX_RQ_CAN_STOP_TICK,optional"`
+	SCXRqBalPending        uint64 `json:"scx_rq_bal_pending" btf:"__SCX_RQ_BAL_PENDING,optional"`
+	SCXRqBalKeep           uint64 `json:"scx_rq_bal_keep" btf:"__SCX_RQ_BAL_KEEP,optional"`
+	SCXRqBypassing         uint64 `json:"scx_rq_bypassing" btf:"__SCX_RQ_BYPASSING,optional"`
+	SCXRqClkValid          uint64 `json:"scx_rq_clk_valid" btf:"__SCX_RQ_CLK_VALID,optional"`
+	SCXRqInWakeup          uint64 `json:"scx_rq_in_wakeup" btf:"__SCX_RQ_IN_WAKEUP,optional"`
+	SCXRqInBalance         uint64 `json:"scx_rq_in_balance" btf:"__SCX_RQ_IN_BALANCE,optional"`
+	SCXDsqFlagBuiltin      uint64 `json:"scx_dsq_flag_builtin" btf:"__SCX_DSQ_FLAG_BUILTIN,optional"`
+	SCXDsqFlagLocalOn      uint64 `json:"scx_dsq_flag_local_on" btf:"__SCX_DSQ_FLAG_LOCAL_ON,optional"`
+	SCXDsqInvalid          uint64 `json:"scx_dsq_invalid" btf:"__SCX_DSQ_INVALID,optional"`
+	SCXDsqGlobal           uint64 `json:"scx_dsq_global" btf:"__SCX_DSQ_GLOBAL,optional"`
+	SCXDsqLocal            uint64 `json:"scx_dsq_local" btf:"__SCX_DSQ_LOCAL,optional"`
+	SCXDsqLocalOn          uint64 `json:"scx_dsq_local_on" btf:"__SCX_DSQ_LOCAL_ON,optional"`
+	SCXDsqLocalCpuMask     uint64 `json:"scx_dsq_local_cpu_mask" btf:"__SCX_DSQ_LOCAL_CPU_MASK,optional"`
+	SCXTaskQueued          uint64 `json:"scx_task_queued" btf:"__SCX_TASK_QUEUED,optional"`
+	SCXTaskResetRunnableAt uint64 `json:"scx_task_reset_runnable_at" btf:"__SCX_TASK_RESET_RUNNABLE_AT,optional"`
+	SCXTaskDeqdForSleep    uint64 `json:"scx_task_deqd_for_sleep" btf:"__SCX_TASK_DEQD_FOR_SLEEP,optional"`
+	SCXTaskStateShift      uint64 `json:"scx_task_state_shift" btf:"__SCX_TASK_STATE_SHIFT,optional"`
+	SCXTaskStateBits       uint64 `json:"scx_task_state_bits" btf:"__SCX_TASK_STATE_BITS,optional"`
+	SCXTaskStateMask       uint64 `json:"scx_task_state_mask" btf:"__SCX_TASK_STATE_MASK,optional"`
+	SCXTaskCursor          uint64 `json:"scx_task_cursor" btf:"__SCX_TASK_CURSOR,optional"`
+	SCXTaskNone            uint64 `json:"scx_task_none" btf:"__SCX_TASK_NONE,optional"`
+	SCXTaskInit            uint64 `json:"scx_task_init" btf:"__SCX_TASK_INIT,optional"`
+	SCXTaskReady           uint64 `json:"scx_task_ready" btf:"__SCX_TASK_READY,optional"`
+	SCXTaskEnabled         uint64 `json:"scx_task_enabled" btf:"__SCX_TASK_ENABLED,optional"`
+	SCXTaskNrStates        uint64 `json:"scx_task_nr_states" btf:"__SCX_TASK_NR_STATES,optional"`
+	SCXTaskDsqOnPriq       uint64 `json:"scx_task_dsq_on_priq" btf:"__SCX_TASK_DSQ_ON_PRIQ,optional"`
+	SCXKickIdle            uint64 `json:"scx_kick_idle" btf:"__SCX_KICK_IDLE,optional"`
+	SCXKickPreempt         uint64 `json:"scx_kick_preempt" btf:"__SCX_KICK_PREEMPT,optional"`
+	SCXKickWait            uint64 `json:"scx_kick_wait" btf:"__SCX_KICK_WAIT,optional"`
+	SCXEnqWakeup           uint64 `json:"scx_enq_wakeup" btf:"__SCX_ENQ_WAKEUP,optional"`
+	SCXEnqHead             uint64 `json:"scx_enq_head" btf:"__SCX_ENQ_HEAD,optional"`
+	SCXEnqPreempt          uint64 `json:"scx_enq_preempt" btf:"__SCX_ENQ_PREEMPT,optional"`
+	SCXEnqReenq            uint64 `json:"scx_enq_reenq" btf:"__SCX_ENQ_REENQ,optional"`
+	SCXEnqLast             uint64 `json:"scx_enq_last" btf:"__SCX_ENQ_LAST,optional"`
+	SCXEnqClearOpss        uint64 `json:"scx_enq_clear_opss" btf:"__SCX_ENQ_CLEAR_OPSS,optional"`
+	SCXEnqDsqPriq          uint64 `json:"scx_enq_dsq_priq" btf:"__SCX_ENQ_DSQ_PRIQ,optional"`
+	UeiDumpLen             uint32 `json:"uei_dump_len" btf:"uei_dump_len"`
+	UserschedPid           uint32 `json:"usersched_pid" btf:"usersched_pid"`
+	KhugepagePid           uint32 `json:"khugepage_pid" btf:"khugepaged_pid"`
+	SwitchPartial          bool   `json:"switch_partial" btf:"switch_partial"`
+	EarlyProcessing        bool   `json:"early_processing" btf:"early_processing"`
+	BuiltinIdle            bool   `json:"builtin_idle" btf:"builtin_idle"`
 }
 
 func (s *Sched) GetRoData() (Rodata, error) {
 	if s.rodata == nil {
-		return Rodata{}, fmt.Errorf("BssMap is nil")
+		return Rodata{}, fmt.Errorf("RodataMap is nil")
 	}
 	i := 0
 	b, err := s.rodata.BPFMap.GetValue(unsafe.Pointer(&i))
@@ -86,9 +94,7 @@ func (s *Sched) GetRoData() (Rodata, error) {
 		return Rodata{}, err
 	}
 	var ro Rodata
-	buff := bytes.NewBuffer(b)
-	err = binary.Read(buff, binary.LittleEndian, &ro)
-	if err != nil {
+	if err := btf.Decode(s.rodataLayout, b, &ro); err != nil {
 		return Rodata{}, err
 	}
 	return ro, nil
@@ -116,6 +122,35 @@ func (s *Sched) SetDefaultSlice(t uint64) {
 	C.set_default_slice(C.u64(t))
 }
 
+// SetSwitchPartial enables SCX_OPS_SWITCH_PARTIAL: only the tasks moved to
+// SCHED_EXT (see SwitchToExt) are scheduled by qumun, the others stay in
+// the fair class. It must be called before Start.
+func (s *Sched) SetSwitchPartial(enabled bool) {
+	C.set_switch_partial(C.bool(enabled))
+}
+
+// SetHeartbeatPeriod sets the period of the BPF timer that wakes up the
+// user-space scheduler when it has not run for that long. It must be called
+// before Start.
+func (s *Sched) SetHeartbeatPeriod(d time.Duration) {
+	C.set_heartbeat_period(C.u64(d))
+}
+
+// MaxWatchdogTimeout is the longest timeout accepted by the kernel
+// (SCX_WATCHDOG_MAX_TIMEOUT).
+const MaxWatchdogTimeout = dataplane.MaxWatchdogTimeout
+
+// SetWatchdogTimeout sets the timeout_ms of the struct_ops: the kernel
+// ejects the scheduler when a runnable task does not run within d, between
+// 1ms and MaxWatchdogTimeout. It must be called before Attach.
+func (s *Sched) SetWatchdogTimeout(d time.Duration) error {
+	if d < time.Millisecond || d > MaxWatchdogTimeout {
+		return fmt.Errorf("watchdog timeout must be between 1ms and %v, got %v", MaxWatchdogTimeout, d)
+	}
+	C.set_timeout_ms(C.u32(d.Milliseconds()))
+	return nil
+}
+
 // KhugepagePid finds and returns the PID of the khugepaged process
 func KhugepagePid() uint32 {
 	procDir := "/proc"
@@ -2,8 +2,15 @@ package core
 
 import (
 	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
 )
 
+// Scheduler is the data plane between a scheduling policy and the BPF
+// backend (see dataplane.Scheduler).
+type Scheduler = dataplane.Scheduler
+
+var _ Scheduler = (*Sched)(nil)
+
 func (s *Sched) DrainQueuedTask() int {
 	if s.plugin != nil {
 		return s.plugin.DrainQueuedTask(s)
@@ -0,0 +1,171 @@
+package core
+
+/*
+#include "wrapper.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	bpf "github.com/aquasecurity/libbpfgo"
+)
+
+// MaxQueuedShards is the number of queued ring buffers of the BPF side
+// (MAX_QUEUED_SHARDS in intf.h).
+const MaxQueuedShards = 32
+
+// queuedShard returns the shard of the queued ring buffer named name.
+func queuedShard(name string) (int, bool) {
+	if name == "queued" {
+		return 0, true
+	}
+	n, ok := strings.CutPrefix(name, "queued_")
+	if !ok {
+		return 0, false
+	}
+	shard, err := strconv.Atoi(n)
+	if err != nil || shard <= 0 || shard >= MaxQueuedShards {
+		return 0, false
+	}
+	return shard, true
+}
+
+func queuedShardName(shard int) string {
+	if shard == 0 {
+		return "queued"
+	}
+	return fmt.Sprintf("queued_%d", shard)
+}
+
+// SetQueuedShards splits the queue of the tasks sent to user space in n
+// ring buffers (1 - MaxQueuedShards), so that the CPUs enqueueing tasks
+// contend less on it. The CPUs use shard 0 until SetQueuedShard assigns
+// them another one. It must be called before Start.
+func (s *Sched) SetQueuedShards(n int) error {
+	if n <= 0 || n > MaxQueuedShards {
+		return fmt.Errorf("invalid number of queued shards %d", n)
+	}
+	s.queuedShards = n
+	C.set_nr_queued_shards(C.u32(n))
+	return nil
+}
+
+// QueuedShards returns the number of shards of the queue.
+func (s *Sched) QueuedShards() int {
+	return s.queuedShards
+}
+
+// resizeQueued splits the ring size of the congestion policy between the
+// shards in use and shrinks the others to a page.
+func (s *Sched) resizeQueued() error {
+	p := s.policy
+	per := (p.RingSize + s.queuedShards - 1) / s.queuedShards
+	size := ringBytes(per, queuedTaskCtxSize())
+	for shard := 0; shard < MaxQueuedShards; shard++ {
+		m, err := s.mod.GetMap(queuedShardName(shard))
+		if err != nil {
+			return err
+		}
+		sz := size
+		if shard >= s.queuedShards {
+			sz = uint64(os.Getpagesize())
+		}
+		if err := m.SetMaxEntries(uint32(sz)); err != nil {
+			return fmt.Errorf("%s: %w", m.Name(), err)
+		}
+	}
+	C.set_congestion(C.u64(size), C.u64(size*uint64(p.Watermark)/100), C.u64(max(p.InteractiveRuntime, 0)))
+	return nil
+}
+
+type queued_shard_arg struct {
+	cpuId int32
+	shard uint32
+}
+
+// SetQueuedShard makes cpuId enqueue its tasks to shard. It must be called
+// after Start.
+func (s *Sched) SetQueuedShard(cpuId int32, shard uint32) error {
+	if s.setShard == nil {
+		return fmt.Errorf("prog (setShard) not found")
+	}
+	arg := &queued_shard_arg{
+		cpuId: cpuId,
+		shard: shard,
+	}
+	var data bytes.Buffer
+	binary.Write(&data, binary.LittleEndian, arg)
+	opt := bpf.RunOpts{
+		CtxIn:     data.Bytes(),
+		CtxSizeIn: uint32(data.Len()),
+	}
+	err := s.setShard.Run(&opt)
+	if err != nil {
+		return err
+	}
+	if opt.RetVal != 0 {
+		return fmt.Errorf("retVal: %v", int32(opt.RetVal))
+	}
+	return nil
+}
+
+// QueuedShard is the utilization of a shard of the queue.
+type QueuedShard struct {
+	Shard    int     `json:"shard"`
+	Backlog  uint64  `json:"backlog"`  // bytes waiting to be dequeued
+	Size     uint64  `json:"size"`     // bytes
+	Fill     float64 `json:"fill"`     // backlog in percent of size
+	Enqueued uint64  `json:"enqueued"` // tasks ever sent through the shard
+}
+
+// queued_shard_stats mirrors struct queued_shard_stats in intf.h.
+type queued_shard_stats struct {
+	Backlog  uint64
+	Size     uint64
+	Produced uint64
+}
+
+// QueuedShardStats returns the utilization of the shards in use.
+func (s *Sched) QueuedShardStats() ([]QueuedShard, error) {
+	if s.getShards == nil {
+		return nil, fmt.Errorf("prog (getShards) not found")
+	}
+	var raw [MaxQueuedShards]queued_shard_stats
+	size := binary.Size(raw)
+	opt := bpf.RunOpts{
+		CtxIn:      make([]byte, size),
+		CtxSizeIn:  uint32(size),
+		CtxOut:     make([]byte, size),
+		CtxSizeOut: uint32(size),
+	}
+	if err := s.getShards.Run(&opt); err != nil {
+		return nil, err
+	}
+	if opt.RetVal != 0 {
+		return nil, fmt.Errorf("retVal: %v", int32(opt.RetVal))
+	}
+	if err := binary.Read(bytes.NewReader(opt.CtxOut), binary.LittleEndian, &raw); err != nil {
+		return nil, err
+	}
+	rec := uint64((queuedTaskCtxSize() + ringbufHdrSize + 7) &^ 7)
+	shards := make([]QueuedShard, s.queuedShards)
+	for i := range shards {
+		st := raw[i]
+		shards[i] = QueuedShard{
+			Shard:    i,
+			Backlog:  st.Backlog,
+			Size:     st.Size,
+			Enqueued: st.Produced / rec,
+		}
+		if st.Size > 0 {
+			shards[i].Fill = float64(st.Backlog) * 100 / float64(st.Size)
+		}
+	}
+	return shards, nil
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	SCHED_NORMAL = 0
+	SCHED_EXT    = 7
+)
+
+// SwitchToExt moves the thread tid to SCHED_EXT, keeping its nice value. In
+// partial switch mode (see SetSwitchPartial) only such threads are scheduled
+// by qumun; threads they fork inherit the policy.
+func SwitchToExt(tid int) error {
+	return setPolicy(tid, SCHED_EXT)
+}
+
+// SwitchToNormal moves the thread tid back to SCHED_NORMAL.
+func SwitchToNormal(tid int) error {
+	return setPolicy(tid, SCHED_NORMAL)
+}
+
+func setPolicy(tid int, policy uint32) error {
+	attr, err := unix.SchedGetAttr(tid, 0)
+	if err != nil {
+		return fmt.Errorf("sched_getattr(%d): %w", tid, err)
+	}
+	attr.Policy = policy
+	attr.Flags = 0
+	// Only SCHED_FIFO/SCHED_RR use the priority and only SCHED_DEADLINE the
+	// runtime parameters: sched_setattr() rejects them with other policies.
+	attr.Priority = 0
+	attr.Runtime = 0
+	attr.Deadline = 0
+	attr.Period = 0
+	if err := unix.SchedSetAttr(tid, attr, 0); err != nil {
+		return fmt.Errorf("sched_setattr(%d): %w", tid, err)
+	}
+	return nil
+}
+
+// SwitchProcessTree moves every thread of process pid and of all its
+// descendants to SCHED_EXT. It returns the number of threads moved; threads
+// that exit in the meantime are ignored and threads that can't be moved are
+// logged and skipped.
+func SwitchProcessTree(pid int) (int, error) {
+	n := 0
+	seen := map[int]bool{}
+	queue := []int{pid}
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		tids, err := listInts(filepath.Join("/proc", strconv.Itoa(p), "task"))
+		if err != nil {
+			if p != pid && errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			return n, err
+		}
+		for _, tid := range tids {
+			if err := SwitchToExt(tid); err == nil {
+				n++
+			} else if !errors.Is(err, unix.ESRCH) {
+				slog.Warn("switching thread to SCHED_EXT failed", "pid", p, "tid", tid, "err", err)
+			}
+			children, _ := readInts(filepath.Join("/proc", strconv.Itoa(p), "task", strconv.Itoa(tid), "children"))
+			queue = append(queue, children...)
+		}
+	}
+	return n, nil
+}
+
+// SwitchCgroup moves every thread of the cgroup (v2) at path, e.g.
+// /sys/fs/cgroup/system.slice/foo.service, to SCHED_EXT. It returns the
+// number of threads moved.
+func SwitchCgroup(path string) (int, error) {
+	tids, err := readInts(filepath.Join(path, "cgroup.threads"))
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, tid := range tids {
+		if err := SwitchToExt(tid); err != nil {
+			if errors.Is(err, unix.ESRCH) {
+				continue
+			}
+			return n, err
+		}
+		n++
+	}
+	return n, nil
+}
+
+// listInts returns the numeric entries of dir.
+func listInts(dir string) ([]int, error) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	for _, e := range entries {
+		if id, err := strconv.Atoi(e.Name()); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// readInts returns the whitespace-separated integers of the file at path.
+func readInts(path string) ([]int, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ids []int
+	sc := bufio.NewScanner(f)
+	sc.Split(bufio.ScanWords)
+	for sc.Scan() {
+		id, err := strconv.Atoi(strings.TrimSpace(sc.Text()))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, sc.Err()
+}
@@ -4,44 +4,66 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"os"
 	"strconv"
 	"strings"
 	"unsafe"
 
 	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
 )
 
 func (s *Sched) BlockTilReadyForDequeue(ctx context.Context) {
+	blockTilReady(ctx, s.queue)
+}
+
+func (s *Sched) ReadyForDequeue() bool {
+	return readyForDequeue(s.queue)
+}
+
+func blockTilReady(ctx context.Context, queue chan []byte) {
 	select {
-	case t, ok := <-s.queue:
+	case t, ok := <-queue:
 		if !ok {
 			return
 		}
-		s.queue <- t
+		queue <- t
 		return
 	case <-ctx.Done():
 		return
 	}
 }
 
-func (s *Sched) ReadyForDequeue() bool {
+func readyForDequeue(queue chan []byte) bool {
 	select {
-	case t, ok := <-s.queue:
+	case t, ok := <-queue:
 		if !ok {
 			return false
 		}
-		s.queue <- t
+		queue <- t
 		return true
 	default:
 		return false
 	}
 }
 
+// Recorder receives every task exchanged with the BPF side (see SetRecorder).
+type Recorder = dataplane.Recorder
+
+// SetRecorder starts recording the decoded queued tasks and the dispatched
+// tasks to r; a nil r stops recording. It must be called before the
+// scheduling loop starts.
+func (s *Sched) SetRecorder(r Recorder) {
+	s.recorder = r
+}
+
 func (s *Sched) DequeueTask(task *models.QueuedTask) {
+	s.dequeue(s.queue, task)
+}
+
+func (s *Sched) dequeue(queue chan []byte, task *models.QueuedTask) {
 	select {
-	case t := <-s.queue:
+	case t := <-queue:
 		err := fastDecode(t, task)
 		if err != nil {
 			task.Pid = -1
@@ -49,10 +71,15 @@ func (s *Sched) DequeueTask(task *models.QueuedTask) {
 		}
 		err = s.SubNrQueued()
 		if err != nil {
+			s.log.Error("SubNrQueued failed", "pid", task.Pid, "err", err)
 			task.Pid = -1
-			log.Printf("SubNrQueued err: %v", err)
 			return
 		}
+		if s.recorder != nil {
+			s.recordMu.Lock()
+			s.recorder.RecordQueued(task)
+			s.recordMu.Unlock()
+		}
 		return
 	default:
 		task.Pid = -1
@@ -61,30 +88,22 @@ func (s *Sched) DequeueTask(task *models.QueuedTask) {
 }
 
 // Task queued for dispatching to the BPF component (see bpf_intf::dispatched_task_ctx).
-type DispatchedTask struct {
-	Pid        int32  // pid that uniquely identifies a task
-	Cpu        int32  // target CPU selected by the scheduler
-	Flags      uint64 // special dispatch flags
-	SliceNs    uint64 // time slice assigned to the task (0 = default)
-	Vtime      uint64 // task deadline / vruntime
-	CpuMaskCnt uint64 // cpumask generation counter (private)
-}
+type DispatchedTask = dataplane.DispatchedTask
 
 // NewDispatchedTask creates a DispatchedTask from a QueuedTask.
 func NewDispatchedTask(task *models.QueuedTask) *DispatchedTask {
-	return &DispatchedTask{
-		Pid:     task.Pid,
-		Cpu:     task.Cpu,
-		Flags:   task.Flags,
-		SliceNs: 0, // use default time slice
-		Vtime:   0,
-	}
+	return dataplane.NewDispatchedTask(task)
 }
 
 func (s *Sched) DispatchTask(t *DispatchedTask) error {
 	if err := s.urb.Error(); err != nil {
 		return err
 	}
+	if s.recorder != nil {
+		s.recordMu.Lock()
+		s.recorder.RecordDispatched(t)
+		s.recordMu.Unlock()
+	}
 	s.dispatch <- fastEncode(t)
 	return nil
 }
@@ -0,0 +1,88 @@
+package core
+
+/*
+#include "wrapper.h"
+*/
+import "C"
+
+import (
+	"bytes"
+	"encoding/binary"
+	"log/slog"
+	"sync/atomic"
+
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+// TraceKind is the type of a TraceEvent.
+type TraceKind = dataplane.TraceKind
+
+// TraceEvent is a structured task event of the BPF side (see struct
+// trace_event in intf.h).
+type TraceEvent = dataplane.TraceEvent
+
+const (
+	TraceEnqueue        = dataplane.TraceEnqueue
+	TraceDispatch       = dataplane.TraceDispatch
+	TraceDirectDispatch = dataplane.TraceDirectDispatch
+	TraceBounce         = dataplane.TraceBounce
+	TraceCancel         = dataplane.TraceCancel
+	TraceCongested      = dataplane.TraceCongested
+	TraceCpuRelease     = dataplane.TraceCpuRelease
+	TracePrioPreempt    = dataplane.TracePrioPreempt
+	TraceWakeup         = dataplane.TraceWakeup
+	TraceRunning        = dataplane.TraceRunning
+	TraceStopping       = dataplane.TraceStopping
+	TraceUserschedRun   = dataplane.TraceUserschedRun
+	TraceDispatchBatch  = dataplane.TraceDispatchBatch
+)
+
+const traceEventSize = 48
+
+// SetTraceSampling sends one task event out of rate to user space, 0 turns
+// tracing off. It can be changed while the scheduler runs.
+func (s *Sched) SetTraceSampling(rate uint32) {
+	C.set_trace_sample_rate(C.u32(rate))
+}
+
+// TraceEvents returns the task events sent by the BPF side. The channel is
+// nil before Start. Events are dropped (see TraceLost) when it is not
+// drained fast enough.
+func (s *Sched) TraceEvents() <-chan TraceEvent {
+	return s.trace
+}
+
+// TraceLost returns the number of task events dropped in user space because
+// the TraceEvents channel was full. Events lost in the BPF ring buffer are
+// counted in BssData.Nr_trace_drops.
+func (s *Sched) TraceLost() uint64 {
+	return s.traceLost.Load()
+}
+
+func decodeTraceEvents(raw <-chan []byte, out chan<- TraceEvent, lost *atomic.Uint64, log *slog.Logger) {
+	for b := range raw {
+		if len(b) < traceEventSize {
+			log.Warn("short trace event", "map", "trace_events", "size", len(b))
+			continue
+		}
+		comm := b[32:48]
+		if i := bytes.IndexByte(comm, 0); i >= 0 {
+			comm = comm[:i]
+		}
+		ev := TraceEvent{
+			Ts:   binary.LittleEndian.Uint64(b[0:8]),
+			Pid:  int32(binary.LittleEndian.Uint32(b[8:12])),
+			Tgid: int32(binary.LittleEndian.Uint32(b[12:16])),
+			Cpu:  int32(binary.LittleEndian.Uint32(b[16:20])),
+			Kind: TraceKind(binary.LittleEndian.Uint32(b[20:24])),
+			Arg:  binary.LittleEndian.Uint64(b[24:32]),
+			Comm: string(comm),
+		}
+		select {
+		case out <- ev:
+		default:
+			lost.Add(1)
+		}
+	}
+	close(out)
+}
@@ -6,7 +6,6 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
-	"log"
 	"unsafe"
 
 	bpf "github.com/aquasecurity/libbpfgo"
@@ -32,11 +31,11 @@ type UeiMap struct {
 func (s *Sched) Stopped() bool {
 	uei, err := s.GetUeiData()
 	if err != nil {
-		log.Printf("uei: %v", err)
+		s.log.Error("reading uei failed", "err", err)
 		return true
 	}
 	if uei.Kind != 0 || uei.ExitCode != 0 {
-		log.Printf("uei.kind %v, uei.ExitCode: %v", uei.Kind, uei.ExitCode)
+		s.log.Info("scheduler exited", "kind", uei.Kind, "exit_code", uei.ExitCode)
 		return true
 	}
 	return false
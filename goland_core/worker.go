@@ -0,0 +1,114 @@
+package core
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/Gthulhu/plugin/models"
+	"golang.org/x/sys/unix"
+)
+
+// Worker is the view of a Sched used by one dispatcher goroutine in the
+// parallel dispatch mode (see SetParallelDispatch): it dequeues the tasks of
+// a single shard of the queue, and accounts the tasks it holds separately
+// from the other workers. The methods it does not override act on the Sched
+// and are safe for concurrent use.
+type Worker struct {
+	*Sched
+	shard   int
+	queue   chan []byte
+	pending uint64 // tasks held by the worker, guarded by Sched.pendingMu
+}
+
+var _ Scheduler = (*Worker)(nil)
+
+// SetParallelDispatch gives each shard of the queue (see SetQueuedShards)
+// its own Worker, so that the shards can be scheduled by concurrent
+// dispatchers. The tasks are then only dequeued through the workers. It
+// must be called before Start.
+func (s *Sched) SetParallelDispatch(enabled bool) {
+	s.parallel = enabled
+}
+
+// Workers returns the Worker of each shard of the queue, nil unless
+// SetParallelDispatch enabled them. It must be called after Start.
+func (s *Sched) Workers() []*Worker {
+	return s.workers
+}
+
+func (s *Sched) initWorkers() {
+	per := (s.policy.RingSize + s.queuedShards - 1) / s.queuedShards
+	s.workers = make([]*Worker, s.queuedShards)
+	for i := range s.workers {
+		s.workers[i] = &Worker{
+			Sched: s,
+			shard: i,
+			queue: make(chan []byte, per),
+		}
+	}
+}
+
+// Shard returns the shard of the queue served by the worker.
+func (w *Worker) Shard() int {
+	return w.shard
+}
+
+func (w *Worker) DequeueTask(task *models.QueuedTask) {
+	w.dequeue(w.queue, task)
+}
+
+func (w *Worker) ReadyForDequeue() bool {
+	return readyForDequeue(w.queue)
+}
+
+func (w *Worker) BlockTilReadyForDequeue(ctx context.Context) {
+	blockTilReady(ctx, w.queue)
+}
+
+// NotifyComplete reports that the worker still holds nrPending tasks. The
+// BPF side is given the sum over all the workers, so that it keeps the
+// user-space scheduler running while any of them has tasks to dispatch.
+func (w *Worker) NotifyComplete(nrPending uint64) error {
+	s := w.Sched
+	s.pendingMu.Lock()
+	defer s.pendingMu.Unlock()
+	s.nrPending = s.nrPending - w.pending + nrPending
+	w.pending = nrPending
+	return NotifyComplete(s.nrPending)
+}
+
+// DrainQueuedTask runs the DrainQueuedTask of the plugin on the shard of the
+// worker. The plugin must be safe for concurrent use.
+func (w *Worker) DrainQueuedTask() int {
+	if w.plugin != nil {
+		return w.plugin.DrainQueuedTask(w)
+	}
+	return 0
+}
+
+// SelectQueuedTask runs the SelectQueuedTask of the plugin on the shard of
+// the worker. The plugin must be safe for concurrent use.
+func (w *Worker) SelectQueuedTask() *models.QueuedTask {
+	if w.plugin != nil {
+		return w.plugin.SelectQueuedTask(w)
+	}
+	return nil
+}
+
+// LockToCPUs wires the calling goroutine to its OS thread and restricts the
+// thread to cpus, so that the worker of a domain runs next to the CPUs it
+// dispatches to. An empty cpus leaves the affinity unchanged, e.g. the
+// usersched CPUs of SetUserschedCpus. The goroutine must run the worker until
+// it exits.
+func (w *Worker) LockToCPUs(cpus []int) error {
+	runtime.LockOSThread()
+	if len(cpus) == 0 {
+		return nil
+	}
+	var set unix.CPUSet
+	set.Zero()
+	for _, cpu := range cpus {
+		set.Set(cpu)
+	}
+	return unix.SchedSetaffinity(0, &set)
+}
@@ -44,6 +44,12 @@ typedef int pid_t;
  * cpu_map that is used to store the idle state and CPU ownership).
  */
 #define MAX_CPUS 1024
+
+/*
+ * Capacity of the fastest CPU of the system (see
+ * /sys/devices/system/cpu/cpuN/cpu_capacity).
+ */
+#define MAX_CPU_CAPACITY 1024
 #define SCX_DSQ_LOCAL_ON 13835058055282163712ULL
 #define SCX_ENQ_PREEMPT 4294967296ULL
 #define SCX_ENQ_HEAD 16ULL
@@ -68,12 +74,102 @@ struct task_cpu_arg {
 	u64 flags;
 };
 
+/*
+ * Select an idle CPU for @pid among the CPUs with a capacity in
+ * [@min_cap, @max_cap].
+ */
+struct task_cpu_cap_arg {
+	pid_t pid;
+	s32 cpu;
+	u64 flags;
+	u32 min_cap;
+	u32 max_cap;
+};
+
+/*
+ * Set the capacity of @cpu_id (0 - MAX_CPU_CAPACITY).
+ */
+struct cpu_capacity_arg {
+	s32 cpu_id;
+	u32 capacity;
+};
+
+/*
+ * Maximum number of shards of the queue of tasks sent to user-space.
+ */
+#define MAX_QUEUED_SHARDS 32
+
+struct queued_shard_arg {
+	s32 cpu_id;
+	u32 shard;
+};
+
+/*
+ * Occupancy of a shard of the queue, copied out by the get_queued_shards
+ * syscall program.
+ */
+struct queued_shard_stats {
+	u64 backlog; /* bytes waiting in the shard */
+	u64 size; /* size of the shard (bytes) */
+	u64 produced; /* bytes ever produced in the shard */
+};
+
+struct queued_shards_arg {
+	struct queued_shard_stats shards[MAX_QUEUED_SHARDS];
+};
+
+/*
+ * CPU partitions.
+ */
+enum cpu_partition {
+	CPU_PARTITION_GENERAL	= 0, /* usable by every task */
+	CPU_PARTITION_USERSCHED	= 1, /* reserved to the user-space scheduler */
+	CPU_PARTITION_RESERVED	= 2, /* reserved to priority tasks */
+};
+
+/*
+ * Move @cpu_id to @partition (see enum cpu_partition).
+ */
+struct cpu_partition_arg {
+	s32 cpu_id;
+	u32 partition;
+};
+
 struct preempt_cpu_arg {
 	s32 cpu_id;
 };
 
+/*
+ * Task currently running on a CPU (value of the running_task map).
+ */
+struct running_task_info {
+	u32 pid;
+	u32 tgid;
+	u64 start_ts;	/* time the task started running on the CPU */
+	u32 is_prio;	/* task is in the priority_tasks map */
+	u32 pad;
+};
+
+/*
+ * Preempt @cpu_id only if its running task has a lower priority than @pid.
+ */
+struct preempt_prio_arg {
+	s32 cpu_id;
+	s32 pid;
+};
+
+/* Outcome of a preempt_prio_arg request */
+enum preempt_result {
+	PREEMPT_KICKED		= 0, /* CPU kicked with SCX_KICK_PREEMPT */
+	PREEMPT_IDLE		= 1, /* no task is running on the CPU */
+	PREEMPT_NOT_LOWER	= 2, /* running task has an equal or higher priority */
+	PREEMPT_NO_TASK		= 3, /* requesting task doesn't exist anymore */
+};
+
 /*
  * Specify a sibling CPU relationship for a specific scheduling domain.
+ *
+ * @lvl_id: 2 = L2 cache, 3 = L3 cache, 4 = NUMA node.
  */
 struct domain_arg {
 	s32 lvl_id;
@@ -81,6 +177,16 @@ struct domain_arg {
 	s32 sibling_cpu_id;
 };
 
+/*
+ * Replace the scheduling domain @lvl_id of @cpu_id with the CPUs set in
+ * @cpus (bit N of @cpus[N / 64] = CPU N).
+ */
+struct domain_mask_arg {
+	s32 lvl_id;
+	s32 cpu_id;
+	u64 cpus[MAX_CPUS / 64];
+};
+
 /*
  * Task sent to the user-space scheduler by the BPF dispatcher.
  *
@@ -113,4 +219,80 @@ struct dispatched_task_ctx {
 	u64 vtime; /* task deadline / vruntime */
 };
 
+/*
+ * CPU hotplug notification sent to the user-space scheduler.
+ */
+struct cpu_hotplug_event {
+	s32 cpu;
+	u32 online; /* 1 = CPU went online, 0 = CPU went offline */
+	u64 ts; /* scx_bpf_now() when the event happened */
+};
+
+/*
+ * Change of the congestion state of a shard of the @queued ring buffer,
+ * sent to the user-space scheduler.
+ */
+struct congestion_event {
+	u64 ts; /* scx_bpf_now() when the state changed */
+	u64 backlog; /* bytes waiting in the shard */
+	u32 congested; /* 1 = entered congestion, 0 = left it */
+	u32 full; /* 1 = entered because the shard was full */
+	u32 shard; /* shard of @queued */
+	u32 pad;
+};
+
+/*
+ * Structured task events (see trace_task() in main.bpf.c).
+ */
+enum trace_event_kind {
+	TRACE_ENQUEUE = 1,	/* task queued to user-space, arg = enq_flags */
+	TRACE_DISPATCH,		/* user-space dispatch, cpu -1 for any, arg = slice */
+	TRACE_DIRECT_DISPATCH,	/* dispatched to an idle CPU by BPF, arg = slice */
+	TRACE_BOUNCE,		/* invalid user-space CPU, sent to the shared DSQ */
+	TRACE_CANCEL,		/* user-space dispatch cancelled (affinity change) */
+	TRACE_CONGESTED,	/* dispatched by BPF, arg = 0 @queued full, 1 above watermark */
+	TRACE_CPU_RELEASE,	/* CPU taken by a higher sched_class, arg = reason */
+	TRACE_PRIO_PREEMPT,	/* CPU preempted for a priority task, arg = old pid */
+	TRACE_WAKEUP,		/* task became runnable, cpu = waker, arg = enq_flags */
+	TRACE_RUNNING,		/* task started running, arg = wakeup ts or 0 */
+	TRACE_STOPPING,		/* task stopped running, arg = start ts */
+	TRACE_USERSCHED_RUN,	/* user-space scheduler stopped, arg = start ts */
+	TRACE_DISPATCH_BATCH,	/* dispatched tasks drained, no task, see below */
+};
+
+/*
+ * arg of TRACE_DISPATCH_BATCH: number of tasks in the upper 32 bits,
+ * duration of the drain (ns) in the lower 32 bits.
+ */
+#define TRACE_BATCH_SHIFT 32
+
+#define TRACE_COMM_LEN 16
+
+struct trace_event {
+	u64 ts; /* scx_bpf_now() */
+	s32 pid;
+	s32 tgid;
+	s32 cpu;
+	u32 kind; /* enum trace_event_kind */
+	u64 arg;
+	char comm[TRACE_COMM_LEN];
+};
+
+/*
+ * sched_ext core event counters (struct scx_event_stats), copied out by the
+ * get_sched_events syscall program. Counters the running kernel does not
+ * have are left at 0.
+ */
+struct sched_events_arg {
+	s64 select_cpu_fallback;
+	s64 dispatch_local_dsq_offline;
+	s64 dispatch_keep_last;
+	s64 enq_skip_exiting;
+	s64 enq_skip_migration_disabled;
+	s64 refill_slice_dfl;
+	s64 bypass_duration;
+	s64 bypass_dispatch;
+	s64 bypass_activate;
+};
+
 #endif /* __INTF_H */
@@ -98,6 +98,39 @@ volatile u64 nr_user_dispatches, nr_kernel_dispatches,
 /* Failure statistics */
 volatile u64 nr_failed_dispatches, nr_sched_congested;
 
+/* CPU hotplug statistics */
+volatile u64 nr_cpu_online_events, nr_cpu_offline_events;
+
+/* Times the heartbeat had to wake up an inactive user-space scheduler */
+volatile u64 nr_heartbeat_kicks;
+
+/*
+ * Task event tracing (see trace_task()): one event out of
+ * @trace_sample_rate is sent to user-space, 0 disables tracing. Set at
+ * runtime by user-space.
+ */
+volatile u32 trace_sample_rate;
+volatile u64 nr_trace_events, nr_trace_drops;
+
+/*
+ * Starvation accounting (see account_runnable_wait()): runs of tasks that
+ * waited at least @starvation_ns for a CPU, 0 disables it. Set at runtime
+ * by user-space.
+ */
+volatile u64 starvation_ns;
+volatile u64 nr_starved_runs;
+
+/*
+ * Number of possible CPUs that are currently offline.
+ */
+static u64 nr_offline_cpus;
+
+/*
+ * Number of offline CPUs that went offline while the scheduler was attached:
+ * only their DSQ can hold tasks (see consume_offline_dsqs()).
+ */
+static u64 nr_offline_dsqs;
+
 /* Report additional debugging information */
 const volatile bool debug;
 
@@ -108,6 +141,12 @@ const volatile u64 default_slice = 20000000ULL;
 /* Rely on the in-kernel idle CPU selection policy */
 const volatile bool builtin_idle;
 
+/*
+ * Only the tasks explicitly moved to SCHED_EXT are scheduled by this
+ * scheduler (SCX_OPS_SWITCH_PARTIAL, see set_switch_partial() in wrapper.c).
+ */
+const volatile bool switch_partial;
+
 /* Allow to use bpf_printk() only when @debug is set */
 #define dbg_msg(_fmt, ...) do {						\
 	if (debug)										\
@@ -152,15 +191,80 @@ static int calloc_cpumask(struct bpf_cpumask **p_cpumask)
 #define MAX_DISPATCH_SLOT (MAX_ENQUEUED_TASKS / 8)
 
 /*
- * The map containing tasks that are queued to user space from the kernel.
+ * The maps containing tasks that are queued to user space from the kernel.
  *
- * This map is drained by the user-space scheduler.
+ * The queue is split in @nr_queued_shards ring buffers (shards) to reduce
+ * the contention between the CPUs enqueueing tasks: each CPU uses the shard
+ * set by user-space (see set_queued_shard()), shard 0 (@queued) by default.
+ * The shards are drained by the user-space scheduler, which resizes them
+ * before load (the unused ones to the minimum size).
  */
-struct {
+struct queued_ring {
 	__uint(type, BPF_MAP_TYPE_RINGBUF);
 	__uint(max_entries, MAX_ENQUEUED_TASKS *
 				sizeof(struct queued_task_ctx));
-} queued SEC(".maps");
+};
+
+struct queued_ring queued SEC(".maps"),
+	queued_1 SEC(".maps"), queued_2 SEC(".maps"), queued_3 SEC(".maps"),
+	queued_4 SEC(".maps"), queued_5 SEC(".maps"), queued_6 SEC(".maps"),
+	queued_7 SEC(".maps"), queued_8 SEC(".maps"), queued_9 SEC(".maps"),
+	queued_10 SEC(".maps"), queued_11 SEC(".maps"), queued_12 SEC(".maps"),
+	queued_13 SEC(".maps"), queued_14 SEC(".maps"), queued_15 SEC(".maps"),
+	queued_16 SEC(".maps"), queued_17 SEC(".maps"), queued_18 SEC(".maps"),
+	queued_19 SEC(".maps"), queued_20 SEC(".maps"), queued_21 SEC(".maps"),
+	queued_22 SEC(".maps"), queued_23 SEC(".maps"), queued_24 SEC(".maps"),
+	queued_25 SEC(".maps"), queued_26 SEC(".maps"), queued_27 SEC(".maps"),
+	queued_28 SEC(".maps"), queued_29 SEC(".maps"), queued_30 SEC(".maps"),
+	queued_31 SEC(".maps");
+
+struct {
+	__uint(type, BPF_MAP_TYPE_ARRAY_OF_MAPS);
+	__uint(max_entries, MAX_QUEUED_SHARDS);
+	__type(key, u32);
+	__array(values, struct queued_ring);
+} queued_shards SEC(".maps") = {
+	.values = {
+		&queued, &queued_1, &queued_2, &queued_3,
+		&queued_4, &queued_5, &queued_6, &queued_7,
+		&queued_8, &queued_9, &queued_10, &queued_11,
+		&queued_12, &queued_13, &queued_14, &queued_15,
+		&queued_16, &queued_17, &queued_18, &queued_19,
+		&queued_20, &queued_21, &queued_22, &queued_23,
+		&queued_24, &queued_25, &queued_26, &queued_27,
+		&queued_28, &queued_29, &queued_30, &queued_31,
+	},
+};
+
+const volatile u32 nr_queued_shards = 1;
+
+/*
+ * Congestion policy of @queued (see set_congestion() in wrapper.c), applied
+ * to each shard: sizes and watermark are per shard.
+ *
+ * When @queued_high_watermark bytes are waiting in a shard, only the
+ * interactive tasks (that ran less than @interactive_runtime_ns since they
+ * last slept) and the priority tasks are still sent to user-space, the
+ * others are dispatched to SHARED_DSQ by BPF. Congestion ends below half
+ * of the watermark (or half of @queued_ring_bytes when it was only caused
+ * by @queued being full). A zero watermark disables the policy.
+ */
+const volatile u64 queued_ring_bytes = MAX_ENQUEUED_TASKS * sizeof(struct queued_task_ctx);
+
+/*
+ * Size of the records of @queued, read by user-space to size the shards.
+ */
+const volatile u32 queued_task_ctx_size = sizeof(struct queued_task_ctx);
+const volatile u64 queued_high_watermark;
+const volatile u64 interactive_runtime_ns = NSEC_PER_SEC / 200;
+
+/*
+ * Shards of @queued that are congested (set by update_queued_congestion()).
+ */
+static volatile u32 queued_congested[MAX_QUEUED_SHARDS];
+
+/* Tasks dispatched by BPF because @queued was above the high watermark */
+volatile u64 nr_watermark_dispatches;
 
 /*
  * The user ring buffer containing pids that are dispatched from user space to
@@ -174,6 +278,30 @@ struct {
 				sizeof(struct dispatched_task_ctx));
 } dispatched SEC(".maps");
 
+/*
+ * Congestion state changes of @queued sent to the user-space scheduler.
+ */
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 256 * sizeof(struct congestion_event));
+} congestion_events SEC(".maps");
+
+/*
+ * CPU hotplug events sent to the user-space scheduler.
+ */
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 4096 * sizeof(struct cpu_hotplug_event));
+} hotplug_events SEC(".maps");
+
+/*
+ * Structured task events sent to user-space (see trace_task()).
+ */
+struct {
+	__uint(type, BPF_MAP_TYPE_RINGBUF);
+	__uint(max_entries, 16384 * sizeof(struct trace_event));
+} trace_events SEC(".maps");
+
 /*
  * Map to track PIDs with vtime==0 (priority tasks).
  *
@@ -190,7 +318,7 @@ struct {
 struct {
 	__uint(type, BPF_MAP_TYPE_HASH);
 	__type(key, s32);    /* CPU */
-	__type(value, u32);   /* PID */
+	__type(value, struct running_task_info);
 	__uint(max_entries, MAX_CPUS);
 } running_task SEC(".maps");
 
@@ -200,6 +328,28 @@ struct {
 struct cpu_ctx {
 	struct bpf_cpumask __kptr *l2_cpumask;
 	struct bpf_cpumask __kptr *l3_cpumask;
+	struct bpf_cpumask __kptr *numa_cpumask;
+
+	/*
+	 * Relative CPU capacity (0 = unknown, MAX_CPU_CAPACITY = fastest CPU).
+	 */
+	u32 capacity;
+
+	/*
+	 * The CPU is offline: tasks must not be dispatched to its DSQ.
+	 */
+	bool offline;
+
+	/*
+	 * The CPU went offline while the scheduler was attached, so its DSQ
+	 * may still hold tasks (counted in nr_offline_dsqs).
+	 */
+	bool offline_dsq;
+
+	/*
+	 * Shard of @queued where the tasks enqueued from this CPU go.
+	 */
+	u32 queued_shard;
 };
 
 struct {
@@ -229,6 +379,12 @@ struct task_ctx {
 	 */
 	struct bpf_cpumask __kptr *l2_cpumask;
 	struct bpf_cpumask __kptr *l3_cpumask;
+	struct bpf_cpumask __kptr *numa_cpumask;
+
+	/*
+	 * Temporary cpumask for the CPUs allowed by the CPU partitions.
+	 */
+	struct bpf_cpumask __kptr *part_cpumask;
 
 	/*
 	 * Timestamp since last time the task ran on a CPU.
@@ -244,6 +400,12 @@ struct task_ctx {
 	 * Execution time (in nanoseconds) since the last sleep event.
 	 */
 	u64 exec_runtime;
+
+	/*
+	 * Timestamp of the last wakeup, cleared when the task starts running
+	 * (only used for tracing).
+	 */
+	u64 wakeup_ts;
 };
 
 /* Map that contains task-local storage. */
@@ -288,9 +450,10 @@ struct {
 
 /*
  * Time period of the scheduler heartbeat, used to periodically kick the
- * user-space scheduler and check if there is any pending activity.
+ * user-space scheduler and check if there is any pending activity (see
+ * set_heartbeat_period() in wrapper.c).
  */
-#define USERSCHED_TIMER_NS (NSEC_PER_SEC / 10)
+const volatile u64 usersched_timer_ns = NSEC_PER_SEC / 10;
 
 /*
  * Return true if the target task @p is the user-space scheduler.
@@ -308,6 +471,52 @@ static inline bool is_belong_usersched_task(const struct task_struct *p)
 	return p->tgid == usersched_pid;
 }
 
+/*
+ * Return true if @pid is a priority task (see update_priority_task_map()).
+ */
+static bool is_priority_task(u32 pid)
+{
+	return bpf_map_lookup_elem(&priority_tasks, &pid) != NULL;
+}
+
+/*
+ * Send a @kind event about task @p (NULL for events not related to a task)
+ * to user-space, subject to sampling. @cpu is the CPU the event refers to
+ * and @arg a kind specific value (see enum trace_event_kind).
+ */
+static void trace_task(u32 kind, const struct task_struct *p, s32 cpu, u64 arg)
+{
+	struct trace_event *ev;
+	u32 rate = trace_sample_rate;
+
+	if (!rate)
+		return;
+	if (rate > 1 && bpf_get_prandom_u32() % rate)
+		return;
+
+	ev = bpf_ringbuf_reserve(&trace_events, sizeof(*ev), 0);
+	if (!ev) {
+		__sync_fetch_and_add(&nr_trace_drops, 1);
+		return;
+	}
+	ev->ts = scx_bpf_now();
+	ev->cpu = cpu;
+	ev->kind = kind;
+	ev->arg = arg;
+	if (p) {
+		ev->pid = p->pid;
+		ev->tgid = p->tgid;
+		bpf_probe_read_kernel_str(ev->comm, sizeof(ev->comm), p->comm);
+	} else {
+		ev->pid = 0;
+		ev->tgid = 0;
+		__builtin_memset(ev->comm, 0, sizeof(ev->comm));
+	}
+	bpf_ringbuf_submit(ev, 0);
+
+	__sync_fetch_and_add(&nr_trace_events, 1);
+}
+
 /*
  * Return true if the target task @p is a kernel thread.
  */
@@ -396,10 +605,18 @@ static bool test_and_clear_usersched_needed(void)
  */
 static bool usersched_has_pending_tasks(void)
 {
+	void *rb;
+	u32 i;
+
 	if (nr_scheduled)
 		return true;
 
-	return bpf_ringbuf_query(&queued, BPF_RB_AVAIL_DATA) > 0;
+	bpf_for(i, 0, nr_queued_shards) {
+		rb = bpf_map_lookup_elem(&queued_shards, &i);
+		if (rb && bpf_ringbuf_query(rb, BPF_RB_AVAIL_DATA) > 0)
+			return true;
+	}
+	return false;
 }
 
 /*
@@ -428,6 +645,89 @@ static void update_priority_task_map(u32 pid, u64 vtime, u64 slice)
 	}
 }
 
+/*
+ * CPU partitions (see set_cpu_partition()): CPUs reserved to the user-space
+ * scheduler and CPUs reserved to priority tasks.
+ */
+private(GOLAND) struct bpf_cpumask __kptr *usersched_cpumask;
+private(GOLAND) struct bpf_cpumask __kptr *reserved_cpumask;
+static u64 nr_usersched_cpus, nr_reserved_cpus;
+
+static bool is_partitioned(void)
+{
+	return nr_usersched_cpus || nr_reserved_cpus;
+}
+
+/*
+ * Return true if @cpu is reserved to the user-space scheduler or to priority
+ * tasks.
+ */
+static bool is_restricted_cpu(s32 cpu)
+{
+	struct bpf_cpumask *usersched, *reserved;
+
+	if (!is_partitioned())
+		return false;
+
+	usersched = usersched_cpumask;
+	if (usersched && bpf_cpumask_test_cpu(cpu, cast_mask(usersched)))
+		return true;
+
+	reserved = reserved_cpumask;
+	if (reserved && bpf_cpumask_test_cpu(cpu, cast_mask(reserved)))
+		return true;
+
+	return false;
+}
+
+/*
+ * Return the CPUs that @p can use according to its affinity and to the CPU
+ * partitions: the CPUs of the user-space scheduler are never used, reserved
+ * CPUs are used only by priority tasks.
+ *
+ * If the partitions leave no CPU to the task, fall back to its affinity.
+ */
+static const struct cpumask *task_allowed_cpumask(const struct task_struct *p,
+						  struct task_ctx *tctx)
+{
+	struct bpf_cpumask *mask, *usersched, *reserved;
+
+	if (!is_partitioned())
+		return p->cpus_ptr;
+
+	mask = tctx->part_cpumask;
+	usersched = usersched_cpumask;
+	reserved = reserved_cpumask;
+	if (!mask || !usersched || !reserved)
+		return p->cpus_ptr;
+
+	bpf_cpumask_andnot(mask, p->cpus_ptr, cast_mask(usersched));
+	if (!is_priority_task(p->pid))
+		bpf_cpumask_andnot(mask, cast_mask(mask), cast_mask(reserved));
+	if (bpf_cpumask_empty(cast_mask(mask)))
+		return p->cpus_ptr;
+
+	return cast_mask(mask);
+}
+
+/*
+ * Return true if the CPU partitions let @p run on @cpu (see
+ * task_allowed_cpumask()).
+ */
+static bool is_partition_allowed(const struct task_struct *p, s32 cpu)
+{
+	struct task_ctx *tctx;
+
+	if (!is_partitioned())
+		return true;
+
+	tctx = try_lookup_task_ctx(p);
+	if (!tctx)
+		return true;
+
+	return bpf_cpumask_test_cpu(cpu, task_allowed_cpumask(p, tctx));
+}
+
 /*
  * Find an idle CPU in the system for the task.
  *
@@ -439,9 +739,9 @@ static void update_priority_task_map(u32 pid, u64 vtime, u64 slice)
  */
 static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 {
-	const struct cpumask *idle_smtmask;
-	struct bpf_cpumask *l2_domain, *l3_domain;
-	struct bpf_cpumask *l2_mask, *l3_mask;
+	const struct cpumask *idle_smtmask, *allowed;
+	struct bpf_cpumask *l2_domain, *l3_domain, *numa_domain;
+	struct bpf_cpumask *l2_mask, *l3_mask, *numa_mask;
 	struct task_ctx *tctx;
 	struct cpu_ctx *cctx;
 	s32 cpu;
@@ -465,6 +765,11 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 	if (!cctx)
 		return -ENOENT;
 
+	/*
+	 * CPUs usable by the task according to the CPU partitions.
+	 */
+	allowed = task_allowed_cpumask(p, tctx);
+
 	/*
 	 * Acquire the CPU masks to determine the idle CPUs in the system.
 	 */
@@ -475,19 +780,24 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 	 */
 	l2_domain = cctx->l2_cpumask;
 	if (!l2_domain)
-		l2_domain = (struct bpf_cpumask *)p->cpus_ptr;
+		l2_domain = (struct bpf_cpumask *)allowed;
 
 	l3_domain = cctx->l3_cpumask;
 	if (!l3_domain)
-		l3_domain = (struct bpf_cpumask *)p->cpus_ptr;
+		l3_domain = (struct bpf_cpumask *)allowed;
+
+	numa_domain = cctx->numa_cpumask;
+	if (!numa_domain)
+		numa_domain = (struct bpf_cpumask *)allowed;
 
-	if (p->nr_cpus_allowed == nr_cpu_ids) {
+	if (allowed == p->cpus_ptr && p->nr_cpus_allowed == nr_cpu_ids) {
 		l2_mask = l2_domain;
 		l3_mask = l3_domain;
+		numa_mask = numa_domain;
 	} else {
 		/*
 		 * Determine the cache domain as the intersection of the
-		 * task's primary cpumask and the cache domain mask of the
+		 * task's allowed cpumask and the cache domain mask of the
 		 * previously used CPU (ignore if the cache cpumask
 		 * completely overlaps with the task's cpumask).
 		 */
@@ -497,7 +807,7 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 			cpu = -ENOENT;
 			goto out_put_cpumask;
 		}
-		if (!bpf_cpumask_and(l2_mask, p->cpus_ptr, cast_mask(l2_domain)))
+		if (!bpf_cpumask_and(l2_mask, allowed, cast_mask(l2_domain)))
 			l2_mask = NULL;
 
 		l3_mask = tctx->l3_cpumask;
@@ -506,8 +816,17 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 			cpu = -ENOENT;
 			goto out_put_cpumask;
 		}
-		if (!bpf_cpumask_and(l3_mask, p->cpus_ptr, cast_mask(l3_domain)))
+		if (!bpf_cpumask_and(l3_mask, allowed, cast_mask(l3_domain)))
 			l3_mask = NULL;
+
+		numa_mask = tctx->numa_cpumask;
+		if (!numa_mask) {
+			scx_bpf_error("NUMA cpumask not initialized");
+			cpu = -ENOENT;
+			goto out_put_cpumask;
+		}
+		if (!bpf_cpumask_and(numa_mask, allowed, cast_mask(numa_domain)))
+			numa_mask = NULL;
 	}
 
 	/*
@@ -518,7 +837,8 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 		 * If the task can still run on the previously used CPU and
 		 * it's a full-idle core, keep using it.
 		 */
-		if (bpf_cpumask_test_cpu(prev_cpu, idle_smtmask) &&
+		if (bpf_cpumask_test_cpu(prev_cpu, allowed) &&
+		    bpf_cpumask_test_cpu(prev_cpu, idle_smtmask) &&
 		    scx_bpf_test_and_clear_cpu_idle(prev_cpu)) {
 			cpu = prev_cpu;
 			goto out_put_cpumask;
@@ -544,10 +864,20 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 				goto out_put_cpumask;
 		}
 
+		/*
+		 * Search for any full-idle CPU in the task domain that
+		 * belongs to the same NUMA node.
+		 */
+		if (numa_mask) {
+			cpu = scx_bpf_pick_idle_cpu(cast_mask(numa_mask), SCX_PICK_IDLE_CORE);
+			if (cpu >= 0)
+				goto out_put_cpumask;
+		}
+
 		/*
 		 * Otherwise, search for another usable full-idle core.
 		 */
-		cpu = scx_bpf_pick_idle_cpu(p->cpus_ptr, SCX_PICK_IDLE_CORE);
+		cpu = scx_bpf_pick_idle_cpu(allowed, SCX_PICK_IDLE_CORE);
 		if (cpu >= 0)
 			goto out_put_cpumask;
 	}
@@ -556,7 +886,8 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 	 * If a full-idle core can't be found (or if this is not an SMT system)
 	 * try to re-use the same CPU, even if it's not in a full-idle core.
 	 */
-	if (scx_bpf_test_and_clear_cpu_idle(prev_cpu)) {
+	if (bpf_cpumask_test_cpu(prev_cpu, allowed) &&
+	    scx_bpf_test_and_clear_cpu_idle(prev_cpu)) {
 		cpu = prev_cpu;
 		goto out_put_cpumask;
 	}
@@ -581,11 +912,21 @@ static s32 pick_idle_cpu(const struct task_struct *p, s32 prev_cpu)
 			goto out_put_cpumask;
 	}
 
+	/*
+	 * Search for any idle CPU in the primary domain that belongs to the
+	 * same NUMA node, before crossing nodes.
+	 */
+	if (numa_mask) {
+		cpu = scx_bpf_pick_idle_cpu(cast_mask(numa_mask), 0);
+		if (cpu >= 0)
+			goto out_put_cpumask;
+	}
+
 	/*
 	 * If all the previous attempts have failed, try to use any idle CPU in
 	 * the system.
 	 */
-	cpu = scx_bpf_pick_idle_cpu(p->cpus_ptr, 0);
+	cpu = scx_bpf_pick_idle_cpu(allowed, 0);
 	if (cpu >= 0)
 		goto out_put_cpumask;
 
@@ -607,7 +948,14 @@ out_put_cpumask:
  */
 static void kick_task_cpu(const struct task_struct *p, s32 cpu)
 {
-	if (!bpf_cpumask_test_cpu(cpu, p->cpus_ptr)) {
+	const struct cpumask *allowed = p->cpus_ptr;
+	struct task_ctx *tctx;
+
+	tctx = try_lookup_task_ctx(p);
+	if (tctx)
+		allowed = task_allowed_cpumask(p, tctx);
+
+	if (!bpf_cpumask_test_cpu(cpu, allowed)) {
 		/*
 		 * Kick the target CPU anyway, since it may be locked and
 		 * needs to go back to idle to reset its state.
@@ -617,13 +965,50 @@ static void kick_task_cpu(const struct task_struct *p, s32 cpu)
 		/*
 		 * Pick any other idle CPU that the task can use.
 		 */
-		cpu = scx_bpf_pick_idle_cpu(p->cpus_ptr, 0);
+		cpu = scx_bpf_pick_idle_cpu(allowed, 0);
 		if (cpu < 0)
 			return;
 	}
 	scx_bpf_kick_cpu(cpu, SCX_KICK_IDLE);
 }
 
+/*
+ * Return true if @cpu is offline.
+ */
+static bool is_cpu_offline(s32 cpu)
+{
+	struct cpu_ctx *cctx;
+
+	if (!nr_offline_cpus)
+		return false;
+	cctx = try_lookup_cpu_ctx(cpu);
+
+	return cctx && cctx->offline;
+}
+
+/*
+ * Move a task left in the DSQ of an offline CPU to the local DSQ of the
+ * current CPU. Return true if a task has been consumed.
+ */
+static bool consume_offline_dsqs(void)
+{
+	struct cpu_ctx *cctx;
+	s32 cpu;
+
+	if (!nr_offline_dsqs)
+		return false;
+
+	bpf_for(cpu, 0, nr_cpu_ids) {
+		cctx = try_lookup_cpu_ctx(cpu);
+		if (!cctx || !cctx->offline_dsq)
+			continue;
+		if (scx_bpf_dsq_move_to_local(cpu_to_dsq(cpu)))
+			return true;
+	}
+
+	return false;
+}
+
 /*
  * Dispatch a task to a target per-CPU DSQ, waking up the corresponding CPU, if
  * needed.
@@ -646,6 +1031,7 @@ static void dispatch_task(const struct dispatched_task_ctx *task)
 	if (task->cpu == RL_CPU_ANY) {
 		scx_bpf_dsq_insert_vtime(p, SHARED_DSQ,
 					 task->slice_ns, task->vtime, task->flags);
+		trace_task(TRACE_DISPATCH, p, -1, task->slice_ns);
 		kick_task_cpu(p, prev_cpu);
 
 		goto out_release;
@@ -653,13 +1039,16 @@ static void dispatch_task(const struct dispatched_task_ctx *task)
 
 	/*
 	 * If the target CPU selected by the user-space scheduler is not
-	 * valid, dispatch it to the SHARED_DSQ, independently on what the
+	 * valid (it went offline or the CPU partitions exclude it from the
+	 * task), dispatch it to the SHARED_DSQ, independently on what the
 	 * user-space scheduler has decided.
 	 */
-	if (!bpf_cpumask_test_cpu(task->cpu, p->cpus_ptr)) {
+	if (!bpf_cpumask_test_cpu(task->cpu, p->cpus_ptr) ||
+	    is_cpu_offline(task->cpu) || !is_partition_allowed(p, task->cpu)) {
 		scx_bpf_dsq_insert_vtime(p, SHARED_DSQ,
 					 task->slice_ns, task->vtime, task->flags);
 		__sync_fetch_and_add(&nr_bounce_dispatches, 1);
+		trace_task(TRACE_BOUNCE, p, task->cpu, task->slice_ns);
 		kick_task_cpu(p, prev_cpu);
 
 		goto out_release;
@@ -673,6 +1062,7 @@ static void dispatch_task(const struct dispatched_task_ctx *task)
 		scx_bpf_dsq_insert_vtime(p, cpu_to_dsq(task->cpu),
 				task->slice_ns, task->vtime, task->flags);
 		__sync_fetch_and_add(&nr_user_dispatches, 1);
+		trace_task(TRACE_DISPATCH, p, task->cpu, task->slice_ns);
 	} else {
 		s32 cur_pid;
 		u64* elem;
@@ -682,6 +1072,7 @@ static void dispatch_task(const struct dispatched_task_ctx *task)
 			scx_bpf_dsq_insert_vtime(p, cpu_to_dsq(task->cpu),
 				task->slice_ns, task->vtime, task->flags);
 			__sync_fetch_and_add(&nr_user_dispatches, 1);
+			trace_task(TRACE_DISPATCH, p, task->cpu, task->slice_ns);
 		}
 	}
 	update_priority_task_map(task->pid, task->vtime, task->slice_ns);
@@ -698,6 +1089,7 @@ static void dispatch_task(const struct dispatched_task_ctx *task)
 	if (!bpf_cpumask_test_cpu(task->cpu, p->cpus_ptr)) {
 		scx_bpf_dispatch_cancel();
 		__sync_fetch_and_add(&nr_cancel_dispatches, 1);
+		trace_task(TRACE_CANCEL, p, task->cpu, 0);
 
 		goto out_release;
 	}
@@ -778,6 +1170,7 @@ static s32 try_direct_dispatch(struct task_struct *p,
 		scx_bpf_dsq_insert_vtime(p, cpu_to_dsq(cpu),
 					 SCX_SLICE_DFL, p->scx.dsq_vtime, enq_flags);
 		__sync_fetch_and_add(&nr_kernel_dispatches, 1);
+		trace_task(TRACE_DIRECT_DISPATCH, p, cpu, SCX_SLICE_DFL);
 		*dispatched = true;
 	}
 
@@ -816,6 +1209,99 @@ int do_preempt(struct preempt_cpu_arg *input)
 	return 0;
 }
 
+/*
+ * Return true if task @p is more important than task @curr: priority tasks
+ * win over regular tasks, then the higher weight wins.
+ */
+static bool task_has_higher_prio(const struct task_struct *p,
+				 const struct task_struct *curr)
+{
+	bool p_prio = is_priority_task(p->pid);
+	bool curr_prio = is_priority_task(curr->pid);
+
+	if (p_prio != curr_prio)
+		return p_prio;
+
+	return p->scx.weight > curr->scx.weight;
+}
+
+/*
+ * Preempt a CPU on behalf of a task, only if the task currently running on
+ * that CPU has a lower priority.
+ */
+SEC("syscall")
+int preempt_if_lower_prio(struct preempt_prio_arg *input)
+{
+	struct running_task_info *cur;
+	struct task_struct *p, *curr;
+	s32 cpu = input->cpu_id;
+	int ret;
+
+	if (cpu < 0 || cpu >= nr_cpu_ids)
+		return -EINVAL;
+
+	cur = bpf_map_lookup_elem(&running_task, &cpu);
+	if (!cur)
+		return PREEMPT_IDLE;
+
+	p = bpf_task_from_pid(input->pid);
+	if (!p)
+		return PREEMPT_NO_TASK;
+
+	curr = bpf_task_from_pid(cur->pid);
+	if (!curr) {
+		bpf_task_release(p);
+		return PREEMPT_IDLE;
+	}
+
+	if (task_has_higher_prio(p, curr)) {
+		scx_bpf_kick_cpu(cpu, SCX_KICK_PREEMPT);
+		dbg_msg("preempt: cpu=%d pid=%d -> pid=%d", cpu, curr->pid, p->pid);
+		trace_task(TRACE_PRIO_PREEMPT, p, cpu, curr->pid);
+		ret = PREEMPT_KICKED;
+	} else {
+		ret = PREEMPT_NOT_LOWER;
+	}
+
+	bpf_task_release(curr);
+	bpf_task_release(p);
+
+	return ret;
+}
+
+#define copy_event(dst, ev, name)					\
+	((dst) = bpf_core_field_exists((ev).name) ? (ev).name : 0)
+
+/*
+ * Copy the sched_ext core event counters to user-space.
+ *
+ * Return -EOPNOTSUPP on kernels without scx_bpf_events(), so that
+ * user-space can fall back to sysfs or report the events as absent.
+ */
+SEC("syscall")
+int get_sched_events(struct sched_events_arg *input)
+{
+	struct scx_event_stats events;
+
+	if (!bpf_ksym_exists(scx_bpf_events))
+		return -EOPNOTSUPP;
+
+	__builtin_memset(&events, 0, sizeof(events));
+	scx_bpf_events(&events, sizeof(events));
+
+	copy_event(input->select_cpu_fallback, events, SCX_EV_SELECT_CPU_FALLBACK);
+	copy_event(input->dispatch_local_dsq_offline, events, SCX_EV_DISPATCH_LOCAL_DSQ_OFFLINE);
+	copy_event(input->dispatch_keep_last, events, SCX_EV_DISPATCH_KEEP_LAST);
+	copy_event(input->enq_skip_exiting, events, SCX_EV_ENQ_SKIP_EXITING);
+	copy_event(input->enq_skip_migration_disabled, events, SCX_EV_ENQ_SKIP_MIGRATION_DISABLED);
+	copy_event(input->refill_slice_dfl, events, SCX_EV_REFILL_SLICE_DFL);
+	copy_event(input->bypass_duration, events, SCX_EV_BYPASS_DURATION);
+	copy_event(input->bypass_dispatch, events, SCX_EV_BYPASS_DISPATCH);
+	copy_event(input->bypass_activate, events, SCX_EV_BYPASS_ACTIVATE);
+
+	return 0;
+}
+
 /*
  * Select and wake-up an idle CPU for a specific task from the user-space
  * scheduler.
@@ -840,53 +1326,236 @@ int rs_select_cpu(struct task_cpu_arg *input)
 }
 
 /*
- * Fill @task with all the information that need to be sent to the user-space
- * scheduler.
+ * Return true if the capacity of @cpu is within [@min_cap, @max_cap]; CPUs
+ * with an unknown capacity are considered as fast as the fastest CPU.
  */
-static void get_task_info(struct queued_task_ctx *task,
-			  const struct task_struct *p, u64 enq_flags)
+static bool cpu_has_capacity(s32 cpu, u32 min_cap, u32 max_cap)
 {
-	struct task_ctx *tctx = try_lookup_task_ctx(p);
+	struct cpu_ctx *cctx;
+	u32 cap;
 
-	task->pid = p->pid;
-	task->cpu = scx_bpf_task_cpu(p);
-	task->nr_cpus_allowed = p->nr_cpus_allowed;
-	task->flags = enq_flags;
-	task->start_ts = tctx ? tctx->start_ts : 0;
-	task->stop_ts = tctx ? tctx->stop_ts : 0;
-	task->exec_runtime = tctx ? tctx->exec_runtime : 0;
-	task->weight = p->scx.weight;
-	task->vtime = p->scx.dsq_vtime;
-	task->tgid = p->tgid;
-}
+	cctx = try_lookup_cpu_ctx(cpu);
+	if (!cctx)
+		return false;
+	cap = cctx->capacity ? : MAX_CPU_CAPACITY;
 
-/*
- * User-space scheduler is congested: log that and increment congested counter.
- */
-static void sched_congested(struct task_struct *p)
-{
-	dbg_msg("congested: pid=%d (%s)", p->pid, p->comm);
-	__sync_fetch_and_add(&nr_sched_congested, 1);
+	return cap >= min_cap && cap <= max_cap;
 }
 
 /*
- * Return true if a task has been enqueued as a remote wakeup, false
- * otherwise.
+ * Select and wake-up an idle CPU for a specific task from the user-space
+ * scheduler, preferring the CPUs with a capacity in the requested range.
+ *
+ * If none of them is idle fall back to the regular idle CPU selection.
  */
-static bool is_queued_wakeup(const struct task_struct *p, u64 enq_flags)
+SEC("syscall")
+int rs_select_cpu_cap(struct task_cpu_cap_arg *input)
 {
-	return !__COMPAT_is_enq_cpu_selected(enq_flags) && !scx_bpf_task_running(p);
-}
+	struct task_struct *p;
+	s32 prev_cpu = input->cpu;
+	s32 cpu = -EBUSY, i;
 
-/*
- * Task @p becomes ready to run. We can dispatch the task directly here if the
- * user-space scheduler is not required, or enqueue it to be processed by the
- * scheduler.
- */
+	p = bpf_task_from_pid(input->pid);
+	if (!p)
+		return -EINVAL;
+
+	bpf_rcu_read_lock();
+
+	/*
+	 * Keep using the previous CPU if it is idle and it has the requested
+	 * capacity.
+	 */
+	if (prev_cpu >= 0 && prev_cpu < nr_cpu_ids &&
+	    bpf_cpumask_test_cpu(prev_cpu, p->cpus_ptr) &&
+	    cpu_has_capacity(prev_cpu, input->min_cap, input->max_cap) &&
+	    scx_bpf_test_and_clear_cpu_idle(prev_cpu)) {
+		cpu = prev_cpu;
+		goto out;
+	}
+
+	bpf_for(i, 0, nr_cpu_ids) {
+		if (!bpf_cpumask_test_cpu(i, p->cpus_ptr) ||
+		    !cpu_has_capacity(i, input->min_cap, input->max_cap))
+			continue;
+		if (scx_bpf_test_and_clear_cpu_idle(i)) {
+			cpu = i;
+			goto out;
+		}
+	}
+
+	cpu = pick_idle_cpu(p, prev_cpu);
+out:
+	bpf_rcu_read_unlock();
+
+	bpf_task_release(p);
+
+	return cpu;
+}
+
+/*
+ * Fill @task with all the information that need to be sent to the user-space
+ * scheduler.
+ */
+static void get_task_info(struct queued_task_ctx *task,
+			  const struct task_struct *p, u64 enq_flags)
+{
+	struct task_ctx *tctx = try_lookup_task_ctx(p);
+
+	task->pid = p->pid;
+	task->cpu = scx_bpf_task_cpu(p);
+	task->nr_cpus_allowed = p->nr_cpus_allowed;
+	task->flags = enq_flags;
+	task->start_ts = tctx ? tctx->start_ts : 0;
+	task->stop_ts = tctx ? tctx->stop_ts : 0;
+	task->exec_runtime = tctx ? tctx->exec_runtime : 0;
+	task->weight = p->scx.weight;
+	task->vtime = p->scx.dsq_vtime;
+	task->tgid = p->tgid;
+}
+
+/*
+ * User-space scheduler is congested: log that and increment congested counter.
+ */
+static void sched_congested(struct task_struct *p)
+{
+	dbg_msg("congested: pid=%d (%s)", p->pid, p->comm);
+	__sync_fetch_and_add(&nr_sched_congested, 1);
+	trace_task(TRACE_CONGESTED, p, scx_bpf_task_cpu(p), 0);
+}
+
+/*
+ * Notify the user-space scheduler that @shard of @queued entered or left
+ * congestion.
+ */
+static void notify_congestion(u32 shard, bool congested, bool full, u64 backlog)
+{
+	struct congestion_event *ev;
+
+	ev = bpf_ringbuf_reserve(&congestion_events, sizeof(*ev), 0);
+	if (!ev)
+		return;
+	ev->ts = scx_bpf_now();
+	ev->backlog = backlog;
+	ev->congested = congested;
+	ev->full = full;
+	ev->shard = shard;
+	ev->pad = 0;
+	bpf_ringbuf_submit(ev, 0);
+}
+
+/*
+ * Return the shard of @queued used by the current CPU, and its index in
+ * @shard.
+ */
+static void *lookup_queued_shard(u32 *shard)
+{
+	struct cpu_ctx *cctx;
+	u32 i = 0;
+
+	if (nr_queued_shards > 1) {
+		cctx = try_lookup_cpu_ctx(bpf_get_smp_processor_id());
+		if (cctx && cctx->queued_shard < MAX_QUEUED_SHARDS)
+			i = cctx->queued_shard;
+	}
+	*shard = i;
+
+	return bpf_map_lookup_elem(&queued_shards, &i);
+}
+
+/*
+ * Update the congestion state of the shard @rb (index @shard) of @queued
+ * from its backlog and return true if the tasks that are not interactive
+ * must be dispatched by BPF.
+ */
+static bool update_queued_congestion(void *rb, u32 shard)
+{
+	u64 backlog = bpf_ringbuf_query(rb, BPF_RB_AVAIL_DATA);
+	u64 high = queued_high_watermark ? : queued_ring_bytes;
+
+	if (shard >= MAX_QUEUED_SHARDS)
+		return false;
+
+	if (queued_high_watermark && backlog >= high) {
+		if (!__sync_val_compare_and_swap(&queued_congested[shard], 0, 1))
+			notify_congestion(shard, true, false, backlog);
+	} else if (backlog < high / 2) {
+		if (__sync_val_compare_and_swap(&queued_congested[shard], 1, 0))
+			notify_congestion(shard, false, false, backlog);
+	}
+
+	return queued_high_watermark && queued_congested[shard];
+}
+
+/*
+ * The shard @rb (index @shard) of @queued is full: enter congestion
+ * whatever the watermark.
+ */
+static void set_queued_full(void *rb, u32 shard)
+{
+	if (shard >= MAX_QUEUED_SHARDS)
+		return;
+
+	if (!__sync_val_compare_and_swap(&queued_congested[shard], 0, 1))
+		notify_congestion(shard, true, true,
+				  bpf_ringbuf_query(rb, BPF_RB_AVAIL_DATA));
+}
+
+/*
+ * Return true if @p ran less than @interactive_runtime_ns since it last
+ * slept.
+ */
+static bool is_interactive(const struct task_struct *p)
+{
+	struct task_ctx *tctx = try_lookup_task_ctx(p);
+
+	return tctx && tctx->exec_runtime < interactive_runtime_ns;
+}
+
+/*
+ * Return true if a task has been enqueued as a remote wakeup, false
+ * otherwise.
+ */
+static bool is_queued_wakeup(const struct task_struct *p, u64 enq_flags)
+{
+	return !__COMPAT_is_enq_cpu_selected(enq_flags) && !scx_bpf_task_running(p);
+}
+
+/*
+ * Pick an idle CPU for the priority task @p, trying the reserved CPUs first.
+ */
+static s32 pick_idle_prio_cpu(const struct task_struct *p)
+{
+	struct bpf_cpumask *reserved, *mask;
+	struct task_ctx *tctx;
+	s32 cpu;
+
+	tctx = try_lookup_task_ctx(p);
+	if (!tctx)
+		return scx_bpf_pick_idle_cpu(p->cpus_ptr, 0);
+
+	reserved = reserved_cpumask;
+	mask = tctx->part_cpumask;
+	if (nr_reserved_cpus && reserved && mask &&
+	    bpf_cpumask_and(mask, p->cpus_ptr, cast_mask(reserved))) {
+		cpu = scx_bpf_pick_idle_cpu(cast_mask(mask), 0);
+		if (cpu >= 0)
+			return cpu;
+	}
+
+	return scx_bpf_pick_idle_cpu(task_allowed_cpumask(p, tctx), 0);
+}
+
+/*
+ * Task @p becomes ready to run. We can dispatch the task directly here if the
+ * user-space scheduler is not required, or enqueue it to be processed by the
+ * scheduler.
+ */
 void BPF_STRUCT_OPS(goland_enqueue, struct task_struct *p, u64 enq_flags)
 {
 	struct queued_task_ctx *task;
 	s32 cpu = -EBUSY;
+	u32 shard;
+	void *rb;
 
 	/*
 	 * Scheduler is dispatched directly in .dispatch() when needed, so
@@ -949,33 +1618,52 @@ void BPF_STRUCT_OPS(goland_enqueue, struct task_struct *p, u64 enq_flags)
 	u32 pid = p->pid;
 	s32 prio_cpu = -EBUSY;
 	u64 prio_enq_flags = SCX_ENQ_PREEMPT;
-	u32* cur_pid_val;
-    u32 cur_pid;
+	struct running_task_info *cur;
 
 	elem = bpf_map_lookup_elem(&priority_tasks, &pid);
 	if (elem) {
-		prio_cpu = scx_bpf_pick_idle_cpu(p->cpus_ptr, 0);
+		prio_cpu = pick_idle_prio_cpu(p);
 		if (prio_cpu == -EBUSY) {
 			prio_cpu = scx_bpf_task_cpu(p);
+			if (!is_partition_allowed(p, prio_cpu))
+				prio_cpu = -EBUSY;
 		}
 		slice = *elem;
 		if (prio_cpu >= 0) {
-			cur_pid_val = bpf_map_lookup_elem(&running_task, &prio_cpu);
-			if (cur_pid_val) {
-				cur_pid = *cur_pid_val;
-				elem = bpf_map_lookup_elem(&priority_tasks, &cur_pid);
-				// If current running task is prioritized, do not preempt it (SCX_ENQ_HEAD).
-				// Otherwise, keep the flag equals to SCX_ENQ_PREEMPT
-				if (elem) {
-					prio_enq_flags = SCX_ENQ_HEAD;
-				}
+			cur = bpf_map_lookup_elem(&running_task, &prio_cpu);
+			// If current running task is prioritized, do not preempt it (SCX_ENQ_HEAD).
+			// Otherwise, keep the flag equals to SCX_ENQ_PREEMPT
+			if (cur && cur->is_prio) {
+				prio_enq_flags = SCX_ENQ_HEAD;
 			}
 			scx_bpf_dsq_insert(p, SCX_DSQ_LOCAL_ON | prio_cpu,
 				slice, prio_enq_flags);
 			__sync_fetch_and_add(&nr_user_dispatches, 1);
+			if (prio_enq_flags & SCX_ENQ_PREEMPT)
+				trace_task(TRACE_PRIO_PREEMPT, p, prio_cpu,
+					   cur ? cur->pid : 0);
 		}
 	}
 
+	/*
+	 * Above the high watermark of @queued, keep the user-space
+	 * scheduler for the tasks where its decisions matter most and
+	 * dispatch the others directly, so that the backlog shrinks before
+	 * @queued is full.
+	 */
+	rb = lookup_queued_shard(&shard);
+	if (!rb) {
+		scx_bpf_error("Failed to lookup queued shard");
+		return;
+	}
+	if (update_queued_congestion(rb, shard) && !elem && !is_interactive(p)) {
+		__sync_fetch_and_add(&nr_watermark_dispatches, 1);
+		trace_task(TRACE_CONGESTED, p, scx_bpf_task_cpu(p), 1);
+		scx_bpf_dsq_insert_vtime(p, SHARED_DSQ, SCX_SLICE_DFL, p->scx.dsq_vtime, enq_flags);
+		__sync_fetch_and_add(&nr_kernel_dispatches, 1);
+		goto out_kick;
+	}
+
 	/*
 	 * Add tasks to the @queued list, they will be processed by the
 	 * user-space scheduler.
@@ -984,8 +1672,9 @@ void BPF_STRUCT_OPS(goland_enqueue, struct task_struct *p, u64 enq_flags)
 	 * will be dispatched directly from the kernel (using the first CPU
 	 * available in this case).
 	 */
-	task = bpf_ringbuf_reserve(&queued, sizeof(*task), 0);
+	task = bpf_ringbuf_reserve(rb, sizeof(*task), 0);
 	if (!task) {
+		set_queued_full(rb, shard);
 		sched_congested(p);
 		scx_bpf_dsq_insert_vtime(p, SHARED_DSQ, SCX_SLICE_DFL, p->scx.dsq_vtime, enq_flags);
 		__sync_fetch_and_add(&nr_kernel_dispatches, 1);
@@ -994,6 +1683,7 @@ void BPF_STRUCT_OPS(goland_enqueue, struct task_struct *p, u64 enq_flags)
 	get_task_info(task, p, enq_flags);
 	dbg_msg("enqueue: pid=%d (%s)", p->pid, p->comm);
 	bpf_ringbuf_submit(task, 0);
+	trace_task(TRACE_ENQUEUE, p, scx_bpf_task_cpu(p), enq_flags);
 
 	__sync_fetch_and_add(&nr_queued, 1);
 
@@ -1069,10 +1759,15 @@ void BPF_STRUCT_OPS(goland_dispatch, s32 cpu, struct task_struct *prev)
 	 * dispatch them on the target CPU decided by the user-space
 	 * scheduler.
 	 */
+	u64 drain_start = scx_bpf_now();
 	s32 ret = bpf_user_ringbuf_drain(&dispatched,
 									 handle_dispatched_task, NULL, BPF_RB_NO_WAKEUP);
 	if (ret < 0)
 		dbg_msg("User ringbuf drain error: %d", ret);
+	else if (ret > 0)
+		trace_task(TRACE_DISPATCH_BATCH, NULL, cpu,
+			   (u64)ret << TRACE_BATCH_SHIFT |
+			   (u32)time_delta(scx_bpf_now(), drain_start));
 
 	/*
 	 * Consume a task from the per-CPU DSQ.
@@ -1081,9 +1776,18 @@ void BPF_STRUCT_OPS(goland_dispatch, s32 cpu, struct task_struct *prev)
 		return;
 
 	/*
-	 * Consume a task from the shared DSQ.
+	 * Consume a task from the shared DSQ (CPUs reserved to the
+	 * user-space scheduler or to priority tasks only run the tasks
+	 * explicitly dispatched to them).
+	 */
+	if (!is_restricted_cpu(cpu) && scx_bpf_dsq_move_to_local(SHARED_DSQ))
+		return;
+
+	/*
+	 * Rescue the tasks left in the DSQ of CPUs that went offline (not
+	 * on restricted CPUs, for the same reason).
 	 */
-	if (scx_bpf_dsq_move_to_local(SHARED_DSQ))
+	if (!is_restricted_cpu(cpu) && consume_offline_dsqs())
 		return;
 
 	/*
@@ -1107,7 +1811,8 @@ void BPF_STRUCT_OPS(goland_dispatch, s32 cpu, struct task_struct *prev)
 	 * wants to run, simply replenish its time slice and let it run for
 	 * another round on the same CPU.
 	 */
-	if (prev && is_queued(prev) && !is_usersched_task(prev))
+	if (prev && is_queued(prev) && !is_usersched_task(prev) &&
+	    is_partition_allowed(prev, cpu))
 		prev->scx.slice = SCX_SLICE_DFL;
 }
 
@@ -1123,6 +1828,25 @@ void BPF_STRUCT_OPS(goland_runnable, struct task_struct *p, u64 enq_flags)
 		return;
 
 	tctx->exec_runtime = 0;
+	tctx->wakeup_ts = scx_bpf_now();
+
+	trace_task(TRACE_WAKEUP, p, bpf_get_smp_processor_id(), enq_flags);
+}
+
+/*
+ * Count the run of a task that waited too long for a CPU since it became
+ * runnable, either woken up or preempted, wherever it waited (user-space
+ * scheduler or DSQ).
+ */
+static void account_runnable_wait(const struct task_ctx *tctx, u64 now)
+{
+	u64 threshold = starvation_ns;
+	u64 since = tctx->wakeup_ts ? : tctx->stop_ts;
+
+	if (!threshold || !since)
+		return;
+	if (time_delta(now, since) >= threshold)
+		__sync_fetch_and_add(&nr_starved_runs, 1);
 }
 
 /*
@@ -1131,15 +1855,23 @@ void BPF_STRUCT_OPS(goland_runnable, struct task_struct *p, u64 enq_flags)
 void BPF_STRUCT_OPS(goland_running, struct task_struct *p)
 {
 	s32 cpu = scx_bpf_task_cpu(p);
+	struct running_task_info info = {};
 	struct task_ctx *tctx;
+	u64 now = scx_bpf_now();
 
 	if (is_usersched_task(p)) {
-		usersched_last_run_at = scx_bpf_now();
+		usersched_last_run_at = now;
 		return;
 	}
 
-	u32 pid = p->pid;
-	bpf_map_update_elem(&running_task, &cpu, &pid, BPF_ANY);
+	tctx = try_lookup_task_ctx(p);
+	trace_task(TRACE_RUNNING, p, cpu, tctx ? tctx->wakeup_ts : 0);
+
+	info.pid = p->pid;
+	info.tgid = p->tgid;
+	info.start_ts = now;
+	info.is_prio = is_priority_task(p->pid);
+	bpf_map_update_elem(&running_task, &cpu, &info, BPF_ANY);
 
 	dbg_msg("start: pid=%d (%s) cpu=%ld", p->pid, p->comm, cpu);
 
@@ -1149,10 +1881,11 @@ void BPF_STRUCT_OPS(goland_running, struct task_struct *p)
 	 */
 	__sync_fetch_and_add(&nr_running, 1);
 
-	tctx = try_lookup_task_ctx(p);
 	if (!tctx)
 		return;
-	tctx->start_ts = scx_bpf_now();
+	account_runnable_wait(tctx, now);
+	tctx->start_ts = now;
+	tctx->wakeup_ts = 0;
 }
 
 /*
@@ -1164,11 +1897,19 @@ void BPF_STRUCT_OPS(goland_stopping, struct task_struct *p, bool runnable)
 	s32 cpu = scx_bpf_task_cpu(p);
 	struct task_ctx *tctx;
 
-	if (is_usersched_task(p))
+	if (is_usersched_task(p)) {
+		trace_task(TRACE_USERSCHED_RUN, p, cpu, usersched_last_run_at);
 		return;
+	}
 
 	dbg_msg("stop: pid=%d (%s) cpu=%ld", p->pid, p->comm, cpu);
 
+	/*
+	 * The CPU is no longer owned by @p: it is either going idle or
+	 * about to run another task, which will set a new owner.
+	 */
+	bpf_map_delete_elem(&running_task, &cpu);
+
 	__sync_fetch_and_sub(&nr_running, 1);
 
 	tctx = try_lookup_task_ctx(p);
@@ -1176,12 +1917,78 @@ void BPF_STRUCT_OPS(goland_stopping, struct task_struct *p, bool runnable)
 		return;
 	tctx->stop_ts = now;
 
+	trace_task(TRACE_STOPPING, p, cpu, tctx->start_ts);
+
 	/*
 	 * Update the partial execution time since last sleep.
 	 */
 	tctx->exec_runtime += now - tctx->start_ts;
 }
 
+/*
+ * Notify the user-space scheduler that @cpu went online or offline.
+ */
+static void notify_hotplug(s32 cpu, bool online)
+{
+	struct cpu_hotplug_event *ev;
+
+	ev = bpf_ringbuf_reserve(&hotplug_events, sizeof(*ev), 0);
+	if (!ev)
+		return;
+	ev->cpu = cpu;
+	ev->online = online;
+	ev->ts = scx_bpf_now();
+	bpf_ringbuf_submit(ev, 0);
+}
+
+/*
+ * A CPU becomes available to the scheduler.
+ */
+void BPF_STRUCT_OPS(goland_cpu_online, s32 cpu)
+{
+	struct cpu_ctx *cctx;
+
+	cctx = try_lookup_cpu_ctx(cpu);
+	if (cctx && cctx->offline) {
+		cctx->offline = false;
+		__sync_fetch_and_sub(&nr_offline_cpus, 1);
+	}
+	if (cctx && cctx->offline_dsq) {
+		cctx->offline_dsq = false;
+		__sync_fetch_and_sub(&nr_offline_dsqs, 1);
+	}
+	__sync_fetch_and_add(&nr_online_cpus, 1);
+	__sync_fetch_and_add(&nr_cpu_online_events, 1);
+
+	dbg_msg("cpu online: cpu=%d", cpu);
+	notify_hotplug(cpu, true);
+}
+
+/*
+ * A CPU is going away: from now on tasks dispatched to it are bounced to the
+ * shared DSQ, and the ones already in its DSQ are consumed by the other CPUs
+ * (see consume_offline_dsqs()).
+ */
+void BPF_STRUCT_OPS(goland_cpu_offline, s32 cpu)
+{
+	struct cpu_ctx *cctx;
+
+	cctx = try_lookup_cpu_ctx(cpu);
+	if (cctx && !cctx->offline) {
+		cctx->offline = true;
+		__sync_fetch_and_add(&nr_offline_cpus, 1);
+	}
+	if (cctx && !cctx->offline_dsq) {
+		cctx->offline_dsq = true;
+		__sync_fetch_and_add(&nr_offline_dsqs, 1);
+	}
+	__sync_fetch_and_sub(&nr_online_cpus, 1);
+	__sync_fetch_and_add(&nr_cpu_offline_events, 1);
+
+	dbg_msg("cpu offline: cpu=%d", cpu);
+	notify_hotplug(cpu, false);
+}
+
 /*
  * A CPU is taken away from the scheduler, preempting the current task by
  * another one running in a higher priority sched_class.
@@ -1195,6 +2002,7 @@ void BPF_STRUCT_OPS(goland_cpu_release, s32 cpu,
 	 * re-schedule it immediately.
 	 */
 	dbg_msg("cpu preemption: pid=%d (%s)", p->pid, p->comm);
+	trace_task(TRACE_CPU_RELEASE, p, cpu, args->reason);
 	if (is_belong_usersched_task(p))
 		set_usersched_needed();
 
@@ -1252,6 +2060,26 @@ s32 BPF_STRUCT_OPS(goland_init_task, struct task_struct *p,
 	if (cpumask)
 		bpf_cpumask_release(cpumask);
 
+	/*
+	 * Create task's NUMA node cpumask.
+	 */
+	cpumask = bpf_cpumask_create();
+	if (!cpumask)
+		return -ENOMEM;
+	cpumask = bpf_kptr_xchg(&tctx->numa_cpumask, cpumask);
+	if (cpumask)
+		bpf_cpumask_release(cpumask);
+
+	/*
+	 * Create task's CPU partitions cpumask.
+	 */
+	cpumask = bpf_cpumask_create();
+	if (!cpumask)
+		return -ENOMEM;
+	cpumask = bpf_kptr_xchg(&tctx->part_cpumask, cpumask);
+	if (cpumask)
+		bpf_cpumask_release(cpumask);
+
 	return 0;
 }
 
@@ -1271,16 +2099,22 @@ static int usersched_timer_fn(void *map, int *key, struct bpf_timer *timer)
 
 	/*
 	 * Trigger the user-space scheduler if it has been inactive for
-	 * more than USERSCHED_TIMER_NS.
+	 * more than @usersched_timer_ns.
 	 */
-	if (time_delta(scx_bpf_now(), usersched_last_run_at) >= USERSCHED_TIMER_NS) {
+	if (time_delta(scx_bpf_now(), usersched_last_run_at) >= usersched_timer_ns) {
 		bpf_rcu_read_lock();
 		p = bpf_task_from_pid(usersched_pid);
 		if (p) {
+			const struct cpumask *allowed = p->cpus_ptr;
+			struct task_ctx *tctx;
 			s32 cpu;
 
 			set_usersched_needed();
-			cpu = scx_bpf_pick_idle_cpu(p->cpus_ptr, 0);
+			__sync_fetch_and_add(&nr_heartbeat_kicks, 1);
+			tctx = try_lookup_task_ctx(p);
+			if (tctx)
+				allowed = task_allowed_cpumask(p, tctx);
+			cpu = scx_bpf_pick_idle_cpu(allowed, 0);
 			if (cpu >= 0)
 				scx_bpf_kick_cpu(cpu, SCX_KICK_IDLE);
 			bpf_task_release(p);
@@ -1289,7 +2123,7 @@ static int usersched_timer_fn(void *map, int *key, struct bpf_timer *timer)
 	}
 
 	/* Re-arm the timer */
-	err = bpf_timer_start(timer, USERSCHED_TIMER_NS, 0);
+	err = bpf_timer_start(timer, usersched_timer_ns, 0);
 	if (err)
 		scx_bpf_error("Failed to arm stats timer");
 
@@ -1312,7 +2146,7 @@ static int usersched_timer_init(void)
 	}
 	bpf_timer_init(timer, &usersched_timer, CLOCK_BOOTTIME);
 	bpf_timer_set_callback(timer, usersched_timer_fn);
-	err = bpf_timer_start(timer, USERSCHED_TIMER_NS, 0);
+	err = bpf_timer_start(timer, usersched_timer_ns, 0);
 	if (err)
 		scx_bpf_error("Failed to arm scheduler timer");
 
@@ -1340,6 +2174,31 @@ static s32 get_nr_online_cpus(void)
 	return cpus;
 }
 
+/*
+ * Mark the possible CPUs that are not online at initialization time. No task
+ * can be queued to their DSQ, so consume_offline_dsqs() ignores them.
+ */
+static void init_offline_cpus(void)
+{
+	const struct cpumask *online_cpumask;
+	struct cpu_ctx *cctx;
+	s32 cpu;
+
+	online_cpumask = scx_bpf_get_online_cpumask();
+
+	bpf_for(cpu, 0, nr_cpu_ids) {
+		if (bpf_cpumask_test_cpu(cpu, online_cpumask))
+			continue;
+		cctx = try_lookup_cpu_ctx(cpu);
+		if (!cctx)
+			continue;
+		cctx->offline = true;
+		__sync_fetch_and_add(&nr_offline_cpus, 1);
+	}
+
+	scx_bpf_put_cpumask(online_cpumask);
+}
+
 /*
  * Create a DSQ for each CPU available in the system and a global shared DSQ.
  *
@@ -1356,6 +2215,7 @@ static int dsq_init(void)
 
 	/* Initialize amount of online CPUs */
 	nr_online_cpus = get_nr_online_cpus();
+	init_offline_cpus();
 
 	/* Create per-CPU DSQs */
 	bpf_for(cpu, 0, nr_cpu_ids) {
@@ -1407,6 +2267,149 @@ static int init_cpumask(struct bpf_cpumask **cpumask)
 	return err;
 }
 
+SEC("syscall")
+int set_cpu_partition(struct cpu_partition_arg *input)
+{
+	struct bpf_cpumask *usersched, *reserved;
+	s32 cpu = input->cpu_id;
+	int err;
+
+	if (cpu < 0 || cpu >= nr_cpu_ids)
+		return -EINVAL;
+
+	err = init_cpumask(&usersched_cpumask);
+	if (err)
+		return err;
+	err = init_cpumask(&reserved_cpumask);
+	if (err)
+		return err;
+
+	bpf_rcu_read_lock();
+	usersched = usersched_cpumask;
+	reserved = reserved_cpumask;
+	if (!usersched || !reserved) {
+		err = -ENOMEM;
+		goto out;
+	}
+
+	if (bpf_cpumask_test_and_clear_cpu(cpu, usersched))
+		__sync_fetch_and_sub(&nr_usersched_cpus, 1);
+	if (bpf_cpumask_test_and_clear_cpu(cpu, reserved))
+		__sync_fetch_and_sub(&nr_reserved_cpus, 1);
+
+	switch (input->partition) {
+	case CPU_PARTITION_GENERAL:
+		break;
+	case CPU_PARTITION_USERSCHED:
+		bpf_cpumask_set_cpu(cpu, usersched);
+		__sync_fetch_and_add(&nr_usersched_cpus, 1);
+		break;
+	case CPU_PARTITION_RESERVED:
+		bpf_cpumask_set_cpu(cpu, reserved);
+		__sync_fetch_and_add(&nr_reserved_cpus, 1);
+		break;
+	default:
+		err = -EINVAL;
+	}
+out:
+	bpf_rcu_read_unlock();
+
+	return err;
+}
+
+SEC("syscall")
+int set_cpu_capacity(struct cpu_capacity_arg *input)
+{
+	struct cpu_ctx *cctx;
+
+	if (input->capacity > MAX_CPU_CAPACITY)
+		return -EINVAL;
+
+	cctx = try_lookup_cpu_ctx(input->cpu_id);
+	if (!cctx)
+		return -ENOENT;
+	cctx->capacity = input->capacity;
+
+	return 0;
+}
+
+SEC("syscall")
+int set_queued_shard(struct queued_shard_arg *input)
+{
+	struct cpu_ctx *cctx;
+
+	if (input->shard >= nr_queued_shards)
+		return -EINVAL;
+
+	cctx = try_lookup_cpu_ctx(input->cpu_id);
+	if (!cctx)
+		return -ENOENT;
+	cctx->queued_shard = input->shard;
+
+	return 0;
+}
+
+/*
+ * Scratch buffer of get_queued_shards(), too large for the stack.
+ */
+struct {
+	__uint(type, BPF_MAP_TYPE_PERCPU_ARRAY);
+	__uint(max_entries, 1);
+	__type(key, u32);
+	__type(value, struct queued_shards_arg);
+} queued_shards_buf SEC(".maps");
+
+SEC("syscall")
+int get_queued_shards(struct queued_shards_arg *input)
+{
+	struct queued_shards_arg *buf;
+	struct queued_shard_stats *st;
+	u32 zero = 0;
+	void *rb;
+	u32 i;
+
+	/*
+	 * The verifier rejects variable-offset writes to the context: fill
+	 * the scratch buffer and copy it out at once.
+	 */
+	buf = bpf_map_lookup_elem(&queued_shards_buf, &zero);
+	if (!buf)
+		return -ENOENT;
+	__builtin_memset(buf, 0, sizeof(*buf));
+
+	bpf_for(i, 0, nr_queued_shards) {
+		if (i >= MAX_QUEUED_SHARDS)
+			break;
+		rb = bpf_map_lookup_elem(&queued_shards, &i);
+		if (!rb)
+			return -ENOENT;
+		st = &buf->shards[i];
+		st->backlog = bpf_ringbuf_query(rb, BPF_RB_AVAIL_DATA);
+		st->size = bpf_ringbuf_query(rb, BPF_RB_RING_SIZE);
+		st->produced = bpf_ringbuf_query(rb, BPF_RB_PROD_POS);
+	}
+	__builtin_memcpy(input, buf, sizeof(*input));
+
+	return 0;
+}
+
+/*
+ * Return the slot of the @lvl_id scheduling domain cpumask of @cctx.
+ */
+static struct bpf_cpumask **lookup_domain_mask(struct cpu_ctx *cctx, s32 lvl_id)
+{
+	switch (lvl_id) {
+	case 2:
+		return &cctx->l2_cpumask;
+	case 3:
+		return &cctx->l3_cpumask;
+	case 4:
+		return &cctx->numa_cpumask;
+	default:
+		return NULL;
+	}
+}
+
 SEC("syscall")
 int enable_sibling_cpu(struct domain_arg *input)
 {
@@ -1419,16 +2422,9 @@ int enable_sibling_cpu(struct domain_arg *input)
 		return -ENOENT;
 
 	/* Make sure the target CPU mask is initialized */
-	switch (input->lvl_id) {
-	case 2:
-		pmask = &cctx->l2_cpumask;
-		break;
-	case 3:
-		pmask = &cctx->l3_cpumask;
-		break;
-	default:
+	pmask = lookup_domain_mask(cctx, input->lvl_id);
+	if (!pmask)
 		return -EINVAL;
-	}
 	err = init_cpumask(pmask);
 	if (err)
 		return err;
@@ -1442,6 +2438,76 @@ int enable_sibling_cpu(struct domain_arg *input)
 	return err;
 }
 
+SEC("syscall")
+int disable_sibling_cpu(struct domain_arg *input)
+{
+	struct cpu_ctx *cctx;
+	struct bpf_cpumask *mask, **pmask;
+
+	cctx = try_lookup_cpu_ctx(input->cpu_id);
+	if (!cctx)
+		return -ENOENT;
+
+	pmask = lookup_domain_mask(cctx, input->lvl_id);
+	if (!pmask)
+		return -EINVAL;
+
+	bpf_rcu_read_lock();
+	mask = *pmask;
+	if (mask)
+		bpf_cpumask_clear_cpu(input->sibling_cpu_id, mask);
+	bpf_rcu_read_unlock();
+
+	return 0;
+}
+
+/*
+ * Replace a scheduling domain cpumask as a whole: the new mask is fully built
+ * before being published, so the idle CPU selection never observes a
+ * partially updated domain.
+ */
+SEC("syscall")
+int set_cache_domain(struct domain_mask_arg *input)
+{
+	struct cpu_ctx *cctx;
+	struct bpf_cpumask *mask, **pmask;
+	u64 cpus[MAX_CPUS / 64];
+	s32 cpu;
+
+	/*
+	 * The verifier rejects variable-offset accesses to the context: copy
+	 * the CPU bitmap to the stack before walking it.
+	 */
+	__builtin_memcpy(cpus, input->cpus, sizeof(cpus));
+
+	cctx = try_lookup_cpu_ctx(input->cpu_id);
+	if (!cctx)
+		return -ENOENT;
+
+	pmask = lookup_domain_mask(cctx, input->lvl_id);
+	if (!pmask)
+		return -EINVAL;
+
+	mask = bpf_cpumask_create();
+	if (!mask)
+		return -ENOMEM;
+
+	bpf_for(cpu, 0, nr_cpu_ids) {
+		u32 word = cpu / 64;
+
+		if (word >= MAX_CPUS / 64)
+			break;
+		if (cpus[word] & (1ULL << (cpu % 64)))
+			bpf_cpumask_set_cpu(cpu, mask);
+	}
+
+	mask = bpf_kptr_xchg(pmask, mask);
+	if (mask)
+		bpf_cpumask_release(mask);
+
+	return 0;
+}
+
 /*
  * Initialize the scheduling class.
  */
@@ -1497,11 +2563,13 @@ SCX_OPS_DEFINE(goland,
 	       .running			= (void *)goland_running,
 	       .stopping		= (void *)goland_stopping,
 	       .cpu_release		= (void *)goland_cpu_release,
+	       .cpu_online		= (void *)goland_cpu_online,
+	       .cpu_offline		= (void *)goland_cpu_offline,
 	       .enable			= (void *)goland_enable,
 	       .init_task		= (void *)goland_init_task,
 	       .exit_task		= (void *)goland_exit_task,
 	       .init			= (void *)goland_init,
 	       .exit			= (void *)goland_exit,
-	       .timeout_ms		= 5000,
+	       .timeout_ms		= 5000, /* see set_timeout_ms() in wrapper.c */
 	       .dispatch_max_batch	= MAX_DISPATCH_SLOT,
 	       .name			= "goland");
\ No newline at end of file
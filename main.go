@@ -2,230 +2,711 @@ package main
 
 import (
 	"context"
-	"log"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"syscall"
 	"time"
 
-	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/config"
+	"github.com/Gthulhu/qumun/control"
 	core "github.com/Gthulhu/qumun/goland_core"
+	"github.com/Gthulhu/qumun/policy"
+	"github.com/Gthulhu/qumun/record"
+	"github.com/Gthulhu/qumun/tracing"
 	"github.com/Gthulhu/qumun/util"
 )
 
 const (
 	MAX_LATENCY_WEIGHT = 1000
-	SLICE_NS_DEFAULT   = 5000 * 1000 // 5ms
-	SLICE_NS_MIN       = 500 * 1000
 	SCX_ENQ_WAKEUP     = 1
 	NSEC_PER_SEC       = 1000000000 // 1 second in nanoseconds
 	PF_WQ_WORKER       = 0x00000020
 )
 
-const taskPoolSize = 4096
+// params are the policy tunables, overridden by the configuration in
+// main() and by the control API.
+var params = policy.DefaultParams()
 
-var taskPool = make([]Task, taskPoolSize)
-var taskPoolCount = 0
-var taskPoolHead, taskPoolTail int
+var taskPoolSize = 4096
 
-func DrainQueuedTask(s *core.Sched) int {
-	var count int
-	for (taskPoolTail+1)%taskPoolSize != taskPoolHead {
-		var newQueuedTask models.QueuedTask
-		s.DequeueTask(&newQueuedTask)
-		if newQueuedTask.Pid == -1 {
-			return count
+// poolBatch is the number of tasks a scheduling loop pools before
+// dispatching again once its pool is empty (-pool-batch).
+var poolBatch = 10
+
+// schedMu serializes the scheduling loops with the control API: it guards
+// the task pools, params and starvation. A scheduling loop only reads the
+// parameters and changes its own pool, so the loops of the parallel
+// dispatch mode hold it as readers.
+var schedMu sync.RWMutex
+
+// taskPools has one pool per scheduling loop: a single one, or one per
+// dispatch worker in the parallel dispatch mode.
+var taskPools []*policy.TaskPool
+
+// poolCount returns the number of tasks of all the pools, under schedMu.
+func poolCount() int {
+	var n int
+	for _, p := range taskPools {
+		n += p.Len()
+	}
+	return n
+}
+
+// runPool is the scheduling loop of p, serving the given shard of the queue,
+// or all of them when shard is negative.
+func runPool(s core.Scheduler, p *policy.TaskPool, shard int) {
+	for true {
+		schedMu.RLock()
+		if shardCongested(shard) {
+			p.DrainQueuedTask()
+		}
+		dispatched := p.DispatchOne()
+		schedMu.RUnlock()
+		if dispatched {
+			continue
 		}
-		deadline := updatedEnqueueTask(s, &newQueuedTask)
-		t := Task{
-			QueuedTask: &newQueuedTask,
-			Deadline:   deadline,
+		// Pool a few tasks before dispatching again, but never more
+		// than the pool holds: DrainQueuedTask stops once it is full.
+		for p.Len() < min(poolBatch, p.Cap()) {
+			schedMu.RLock()
+			num := p.DrainQueuedTask()
+			schedMu.RUnlock()
+			if num == 0 {
+				s.BlockTilReadyForDequeue(context.TODO())
+			}
 		}
-		InsertTaskToPool(t)
-		count++
 	}
-	return 0
 }
 
-var timeout = uint64(3 * NSEC_PER_SEC)
+// startSchedLoops starts the scheduling loop or, in the parallel dispatch
+// mode, one loop per worker, each on the CPUs of the shard it serves unless
+// pin is false. The usersched CPUs take precedence over the shard CPUs: the
+// workers are not pinned when they are set, so that they keep the affinity
+// given by SetUserschedCpus.
+func startSchedLoops(s *core.Sched, shards util.QueuedShards, pin bool) {
+	workers := s.Workers()
+	pools := make([]*policy.TaskPool, max(len(workers), 1))
+	if len(workers) == 0 {
+		pools[0] = policy.NewTaskPool(s, taskPoolSize, params)
+	}
+	for i, w := range workers {
+		pools[i] = policy.NewTaskPool(w, taskPoolSize, params)
+	}
+	schedMu.Lock()
+	taskPools = pools
+	schedMu.Unlock()
+
+	if len(workers) == 0 {
+		go runPool(s, pools[0], -1)
+		return
+	}
+	for i, w := range workers {
+		go func(w *core.Worker, p *policy.TaskPool) {
+			var cpus []int
+			if pin {
+				cpus = shards.CPUs(w.Shard())
+			}
+			if err := w.LockToCPUs(cpus); err != nil {
+				slog.Warn("LockToCPUs failed", "shard", w.Shard(), "cpus", cpus, "err", err)
+			}
+			runPool(w, p, w.Shard())
+		}(w, pools[i])
+	}
+}
+
+// starvation counts the tasks found by the starvation watchdog, guarded by
+// schedMu.
+var starvation policy.StarvationStats
+
+// congestedShards has the shards of the queue of tasks sent to user space
+// that the BPF side reports as congested, nrCongested counts them. The
+// scheduling loop of a congested shard drains it before each dispatch, so
+// that it shrinks as fast as the pool allows.
+var (
+	congestedShards [core.MaxQueuedShards]atomic.Bool
+	nrCongested     atomic.Int32
+)
+
+// shardCongested reports whether shard, or any shard when it is negative,
+// is congested.
+func shardCongested(shard int) bool {
+	if shard < 0 || shard >= len(congestedShards) {
+		return nrCongested.Load() > 0
+	}
+	return congestedShards[shard].Load()
+}
+
+// watchCongestion follows the congestion state of the shards of the queue
+// until ch is closed.
+func watchCongestion(ch <-chan core.CongestionEvent) {
+	for ev := range ch {
+		if ev.Shard < 0 || ev.Shard >= len(congestedShards) {
+			continue
+		}
+		if congestedShards[ev.Shard].Swap(ev.Congested) != ev.Congested {
+			if ev.Congested {
+				nrCongested.Add(1)
+			} else {
+				nrCongested.Add(-1)
+			}
+		}
+		if ev.Congested {
+			slog.Warn("queue congested", "shard", ev.Shard, "full", ev.Full, "backlog", ev.Backlog)
+		} else {
+			slog.Info("queue no longer congested", "shard", ev.Shard, "backlog", ev.Backlog)
+		}
+	}
+}
+
+// setCpuPartitions applies the usersched and reserved CPU sets.
+func setCpuPartitions(s *core.Sched, cfg config.SchedulerConfig) error {
+	usersched, err := util.ParseCPUList(cfg.UserschedCpus)
+	if err != nil {
+		return fmt.Errorf("usersched_cpus: %w", err)
+	}
+	reserved, err := util.ParseCPUList(cfg.ReservedCpus)
+	if err != nil {
+		return fmt.Errorf("reserved_cpus: %w", err)
+	}
+	for _, u := range usersched {
+		for _, r := range reserved {
+			if u == r {
+				return fmt.Errorf("cpu %d is both in usersched_cpus and reserved_cpus", u)
+			}
+		}
+	}
+	if err := s.SetUserschedCpus(usersched); err != nil {
+		return err
+	}
+	return s.SetReservedCpus(reserved)
+}
 
-func updatedEnqueueTask(s *core.Sched, t *models.QueuedTask) uint64 {
-	if minVruntime < t.Vtime {
-		minVruntime = t.Vtime
+// switchPartial moves the configured process trees and cgroups to SCHED_EXT.
+// Failures are logged: the other workloads can still be scheduled.
+func switchPartial(cfg config.PartialConfig) {
+	for _, pid := range cfg.Pids {
+		n, err := core.SwitchProcessTree(pid)
+		if err != nil {
+			slog.Warn("SwitchProcessTree failed", "pid", pid, "err", err)
+			continue
+		}
+		slog.Info("process tree switched to SCHED_EXT", "pid", pid, "threads", n)
 	}
-	minVruntimeLocal := saturating_sub(minVruntime, SLICE_NS_DEFAULT)
-	if t.Vtime == 0 {
-		t.Vtime = minVruntimeLocal + (SLICE_NS_DEFAULT * 100 / t.Weight)
-	} else if t.Vtime < minVruntimeLocal {
-		t.Vtime = minVruntimeLocal
+	for _, cg := range cfg.Cgroups {
+		n, err := core.SwitchCgroup(cg)
+		if err != nil {
+			slog.Warn("SwitchCgroup failed", "cgroup", cg, "err", err)
+			continue
+		}
+		slog.Info("cgroup switched to SCHED_EXT", "cgroup", cg, "threads", n)
 	}
-	t.Vtime += (t.StopTs - t.StartTs) * t.Weight / 100
+}
 
-	return t.Vtime + min(t.SumExecRuntime, SLICE_NS_DEFAULT*100)
+// replay runs the policy offline on a recorded trace and prints how its
+// decisions differ from the recorded ones.
+func replay(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	rd, err := record.NewReader(f)
+	if err != nil {
+		return err
+	}
+	diff, err := record.Replay(rd, func(rp *record.Replayer) {
+		p := policy.NewTaskPool(rp, taskPoolSize, params)
+		for p.DrainQueuedTask() > 0 || p.Len() > 0 {
+			for p.DispatchOne() {
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Print(diff)
+	return nil
 }
 
-func GetTaskFromPool() *models.QueuedTask {
-	if taskPoolHead == taskPoolTail {
+// schedEvents returns the sched_ext event counters, or nil when the kernel
+// does not provide them.
+func schedEvents(s *core.Sched) *core.SchedEvents {
+	ev, err := s.GetSchedEvents()
+	if err != nil {
+		if !errors.Is(err, core.ErrEventsUnsupported) {
+			slog.Warn("GetSchedEvents failed", "err", err)
+		}
 		return nil
 	}
-	t := &taskPool[taskPoolHead]
-	taskPoolHead = (taskPoolHead + 1) % taskPoolSize
-	taskPoolCount--
-	return t.QueuedTask
+	return &ev
+}
+
+// startTracing writes the task events selected by cfg to cfg.Output. The
+// returned function stops tracing and completes the file.
+func startTracing(s *core.Sched, cfg config.TraceConfig) (func(), error) {
+	w, err := tracing.Create(cfg.Output, cfg.Format)
+	if err != nil {
+		return nil, err
+	}
+	f := tracing.Filter{Comms: cfg.Comms}
+	for _, pid := range cfg.Pids {
+		f.Pids = append(f.Pids, int32(pid))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := tracing.Run(ctx, s.TraceEvents(), f, w); err != nil {
+			slog.Error("tracing stopped", "path", cfg.Output, "err", err)
+		}
+	}()
+	s.SetTraceSampling(cfg.SampleRate)
+	return func() {
+		s.SetTraceSampling(0)
+		cancel()
+		<-done
+		if err := w.Close(); err != nil {
+			slog.Warn("closing trace failed", "path", cfg.Output, "err", err)
+		}
+	}, nil
+}
+
+// schedStats is the document served by /stats and the control API.
+type schedStats struct {
+	Bss        core.BssData           `json:"bss"`
+	PoolCount  int                    `json:"pool_count"`
+	Preempt    core.PreemptStats      `json:"preempt"`
+	Running    []core.RunningTask     `json:"running"`
+	Events     *core.SchedEvents      `json:"events,omitempty"`
+	TraceLost  uint64                 `json:"trace_lost"` // task events dropped in user space
+	Congested  bool                   `json:"congested"`  // the queue from the BPF side is above its watermark
+	Starvation policy.StarvationStats `json:"starvation"`
+	Shards     []core.QueuedShard     `json:"queued_shards,omitempty"` // utilization of each shard of the queue, when split
+}
+
+func collectStats(s *core.Sched) (schedStats, error) {
+	bss, err := s.GetBssData()
+	if err != nil {
+		return schedStats{}, err
+	}
+	running, err := s.CPUOccupancy()
+	if err != nil {
+		return schedStats{}, err
+	}
+	schedMu.Lock()
+	poolCount := poolCount()
+	starved := starvation
+	schedMu.Unlock()
+	var shards []core.QueuedShard
+	if s.QueuedShards() > 1 {
+		shards, err = s.QueuedShardStats()
+		if err != nil {
+			return schedStats{}, err
+		}
+	}
+	return schedStats{bss, poolCount, s.GetPreemptStats(), running, schedEvents(s), s.TraceLost(), nrCongested.Load() > 0, starved, shards}, nil
+}
+
+// serveStats exposes the BPF counters and the pool occupancy as JSON.
+func serveStats(addr string, s *core.Sched) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		stats, err := collectStats(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(stats)
+	})
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		slog.Error("stats server stopped", "addr", addr, "err", err)
+	}
 }
 
-var minVruntime uint64 = 0 // global vruntime
+// controlBackend serves the control API (see the control package) from the
+// running scheduler.
+type controlBackend struct {
+	s      *core.Sched
+	cfg    config.Config // guarded by schedMu
+	detach chan<- struct{}
+}
 
-func now() uint64 {
-	return uint64(time.Now().UnixNano())
+func (b *controlBackend) Stats() (any, error) {
+	return collectStats(b.s)
 }
 
-func calcAvg(oldVal uint64, newVal uint64) uint64 {
-	return (oldVal - (oldVal >> 2)) + (newVal >> 2)
+func (b *controlBackend) Config() (any, error) {
+	schedMu.Lock()
+	cfg := b.cfg
+	schedMu.Unlock()
+	return cfg.Document()
 }
 
-func saturating_sub(a, b uint64) uint64 {
-	if a > b {
-		return a - b
+func tunablesOf(c config.SchedulerConfig) control.Tunables {
+	return control.Tunables{
+		SliceDefault:    c.SliceNsDefault,
+		SliceMin:        c.SliceNsMin,
+		Policy:          c.Policy,
+		CapacityAware:   c.CapacityAware,
+		PreemptInterval: c.PreemptInterval,
 	}
-	return 0
 }
 
-type Task struct {
-	*models.QueuedTask
-	Deadline  uint64
-	Timestamp uint64
+func (b *controlBackend) Tunables() control.Tunables {
+	schedMu.Lock()
+	defer schedMu.Unlock()
+	return tunablesOf(b.cfg.Scheduler)
 }
 
-func LessQueuedTask(
-	a, b *Task,
-) bool {
-	if a.Deadline != b.Deadline {
-		return a.Deadline < b.Deadline
+// SetTunables validates the updated configuration as a whole before
+// applying it, so that a bad update leaves the scheduler untouched.
+func (b *controlBackend) SetTunables(u control.TunablesUpdate) (control.Tunables, error) {
+	schedMu.Lock()
+	defer schedMu.Unlock()
+	cfg := b.cfg
+	t := u.Apply(tunablesOf(cfg.Scheduler))
+	cfg.Scheduler.SliceNsDefault = t.SliceDefault
+	cfg.Scheduler.SliceNsMin = t.SliceMin
+	cfg.Scheduler.Policy = t.Policy
+	cfg.Scheduler.CapacityAware = t.CapacityAware
+	cfg.Scheduler.PreemptInterval = t.PreemptInterval
+	if err := cfg.Validate(); err != nil {
+		return tunablesOf(b.cfg.Scheduler), err
 	}
-	if a.Timestamp != b.Timestamp {
-		return a.Timestamp < b.Timestamp
+	b.cfg = cfg
+	params.SliceDefault = uint64(t.SliceDefault)
+	params.SliceMin = uint64(t.SliceMin)
+	params.Fifo = t.Policy == config.PolicyFifo
+	params.CapacityAware = t.CapacityAware
+	b.s.SetPreemptRateLimit(t.PreemptInterval)
+	slog.Info("tunables updated", "tunables", t)
+	return t, nil
+}
+
+func (b *controlBackend) PriorityTasks() []int32 {
+	schedMu.Lock()
+	defer schedMu.Unlock()
+	pids := make([]int32, 0, len(params.Priority))
+	for pid := range params.Priority {
+		pids = append(pids, pid)
 	}
-	return a.Pid < b.Pid
+	slices.Sort(pids)
+	return pids
 }
 
-func InsertTaskToPool(
-	newTask Task,
-) bool {
-	if taskPoolCount >= taskPoolSize-1 {
-		return false
+func (b *controlBackend) SetPriorityTask(pid int32, priority bool) error {
+	if priority {
+		if _, err := os.Stat(fmt.Sprintf("/proc/%d", pid)); err != nil {
+			return fmt.Errorf("no task %d", pid)
+		}
 	}
-	insertIdx := taskPoolTail
-	for i := 0; i < taskPoolCount; i++ {
-		idx := (taskPoolHead + i) % taskPoolSize
-		if LessQueuedTask(
-			&newTask,
-			&taskPool[idx],
-		) {
-			insertIdx = idx
-			break
+	schedMu.Lock()
+	defer schedMu.Unlock()
+	if priority {
+		params.Priority[pid] = struct{}{}
+	} else {
+		delete(params.Priority, pid)
+	}
+	slog.Info("priority task updated", "pid", pid, "priority", priority)
+	return nil
+}
+
+func (b *controlBackend) QueuedTasks() []control.QueuedTask {
+	schedMu.Lock()
+	defer schedMu.Unlock()
+	tasks := make([]control.QueuedTask, 0, poolCount())
+	for _, p := range taskPools {
+		for _, t := range p.Tasks() {
+			tasks = append(tasks, control.QueuedTask{
+				Pid:            t.Pid,
+				Tgid:           t.Tgid,
+				Cpu:            t.Cpu,
+				Weight:         t.Weight,
+				Vtime:          t.Vtime,
+				SumExecRuntime: t.SumExecRuntime,
+				Deadline:       t.Deadline,
+				Timestamp:      t.Timestamp,
+			})
 		}
 	}
+	return tasks
+}
 
-	cur := taskPoolTail
-	for cur != insertIdx {
-		next := (cur - 1 + taskPoolSize) % taskPoolSize
-		taskPool[cur] = taskPool[next]
-		cur = next
+func (b *controlBackend) Topology() (any, error) {
+	return util.GetTopology()
+}
+
+func (b *controlBackend) ExitInfo() (control.ExitInfo, error) {
+	uei, err := b.s.GetUeiData()
+	if err != nil {
+		return control.ExitInfo{}, err
+	}
+	info := control.ExitInfo{
+		Running:  uei.Kind == 0 && uei.ExitCode == 0,
+		Kind:     uei.Kind,
+		ExitCode: uei.ExitCode,
+		Reason:   uei.GetReason(),
+		Message:  uei.GetMessage(),
 	}
-	taskPool[insertIdx] = newTask
-	taskPoolTail = (taskPoolTail + 1) % taskPoolSize
-	taskPoolCount++
-	return true
+	if ev := schedEvents(b.s); ev != nil {
+		info.Events = ev
+	}
+	return info, nil
+}
+
+func (b *controlBackend) Detach() error {
+	select {
+	case b.detach <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// planQueuedShards maps the CPUs to the shards of the queue from the BPF
+// side for mode (none, cpu or llc).
+func planQueuedShards(mode string) (util.QueuedShards, error) {
+	if mode == util.ShardNone {
+		return util.PlanQueuedShards(mode, &util.Topology{})
+	}
+	topo, err := util.GetTopology()
+	if err != nil {
+		return util.QueuedShards{}, err
+	}
+	return util.PlanQueuedShards(mode, topo)
 }
 
 func main() {
-	bpfModule := core.LoadSched("main.bpf.o")
+	cfg, err := config.Parse(os.Args[0], os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		slog.Error("invalid configuration", "err", err)
+		os.Exit(2)
+	}
+	level, _ := cfg.SlogLevel()
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+
+	params.SliceDefault = uint64(cfg.Scheduler.SliceNsDefault)
+	params.SliceMin = uint64(cfg.Scheduler.SliceNsMin)
+	params.Fifo = cfg.Scheduler.Policy == config.PolicyFifo
+	params.CapacityAware = cfg.Scheduler.CapacityAware
+	params.StarvationThreshold = uint64(cfg.Scheduler.StarvationThreshold)
+	params.StarvationDispatch = cfg.Scheduler.StarvationDispatch
+	taskPoolSize = cfg.Scheduler.TaskPoolSize
+	poolBatch = cfg.Scheduler.PoolBatch
+
+	if cfg.Replay != "" {
+		if err := replay(cfg.Replay); err != nil {
+			slog.Error("replay failed", "path", cfg.Replay, "err", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	if err := run(cfg); err != nil {
+		slog.Error("scheduler failed", "err", err)
+		os.Exit(1)
+	}
+}
+
+// run loads and attaches the scheduler, then schedules until it is told to
+// stop or the kernel stops it. Its deferred cleanup, which detaches the
+// scheduler, has run by the time it returns.
+func run(cfg config.Config) error {
+	bpfModule := core.LoadSched(cfg.BPFObject, core.WithLogger(slog.Default()))
 	defer bpfModule.Close()
+	if cfg.Record != "" {
+		w, err := record.Create(cfg.Record)
+		if err != nil {
+			return fmt.Errorf("create trace %s: %w", cfg.Record, err)
+		}
+		defer w.Close()
+		bpfModule.SetRecorder(w)
+	}
 	pid := os.Getpid()
 	err := bpfModule.AssignUserSchedPid(pid)
 	if err != nil {
-		log.Printf("AssignUserSchedPid failed: %v", err)
+		slog.Warn("AssignUserSchedPid failed", "err", err)
+	}
+	bpfModule.SetDebug(cfg.Scheduler.Debug)
+	bpfModule.SetBuiltinIdle(cfg.Scheduler.BuiltinIdle)
+	bpfModule.SetEarlyProcessing(cfg.Scheduler.EarlyProcessing)
+	bpfModule.SetDefaultSlice(uint64(cfg.Scheduler.DefaultSlice))
+	bpfModule.SetPreemptRateLimit(cfg.Scheduler.PreemptInterval)
+	bpfModule.SetSwitchPartial(cfg.Partial.Enabled)
+	bpfModule.SetHeartbeatPeriod(cfg.Scheduler.HeartbeatPeriod)
+	if err := bpfModule.SetWatchdogTimeout(cfg.Scheduler.WatchdogTimeout); err != nil {
+		return fmt.Errorf("set watchdog timeout: %w", err)
+	}
+	err = bpfModule.SetCongestionPolicy(core.CongestionPolicy{
+		RingSize:           cfg.Scheduler.QueuedRingSize,
+		Watermark:          cfg.Scheduler.CongestionWatermark,
+		InteractiveRuntime: cfg.Scheduler.SliceNsDefault,
+	})
+	if err != nil {
+		return fmt.Errorf("set congestion policy: %w", err)
+	}
+	shards, err := planQueuedShards(cfg.Scheduler.QueuedShards)
+	if err != nil {
+		return fmt.Errorf("plan queued shards (mode %s): %w", cfg.Scheduler.QueuedShards, err)
+	}
+	if err := bpfModule.SetQueuedShards(shards.NrShards); err != nil {
+		return fmt.Errorf("set queued shards: %w", err)
+	}
+	bpfModule.SetParallelDispatch(cfg.Scheduler.ParallelDispatch)
+	if err := bpfModule.Start(); err != nil {
+		return fmt.Errorf("start the scheduler: %w", err)
 	}
-	bpfModule.SetDebug(true)
-	bpfModule.SetBuiltinIdle(true)
-	bpfModule.Start()
+	bpfModule.SetStarvationThreshold(cfg.Scheduler.StarvationThreshold)
 
 	err = util.InitCacheDomains(bpfModule)
 	if err != nil {
-		log.Panicf("InitCacheDomains failed: %v", err)
+		return fmt.Errorf("init cache domains: %w", err)
+	}
+
+	if err := setCpuPartitions(bpfModule, cfg.Scheduler); err != nil {
+		return fmt.Errorf("set CPU partitions: %w", err)
+	}
+
+	err = util.InitCpuCapacity(bpfModule)
+	if err != nil {
+		slog.Warn("InitCpuCapacity failed", "err", err)
+	}
+
+	if err := util.InitQueuedShards(bpfModule, shards); err != nil {
+		return fmt.Errorf("init queued shards: %w", err)
+	}
+	slog.Info("queued ring buffer", "mode", cfg.Scheduler.QueuedShards, "shards", shards.NrShards, "parallel_dispatch", cfg.Scheduler.ParallelDispatch)
+
+	if cfg.Trace.Output != "" {
+		stopTracing, err := startTracing(bpfModule, cfg.Trace)
+		if err != nil {
+			return fmt.Errorf("start tracing to %s: %w", cfg.Trace.Output, err)
+		}
+		defer stopTracing()
 	}
 
 	if err := bpfModule.Attach(); err != nil {
-		log.Panicf("bpfModule attach failed: %v", err)
+		return fmt.Errorf("attach the scheduler: %w", err)
 	}
 
-	log.Printf("UserSched's Pid: %v", core.GetUserSchedPid())
+	slog.Info("scheduler attached", "pid", core.GetUserSchedPid(), "policy", cfg.Scheduler.Policy, "partial", cfg.Partial.Enabled)
+
+	switchPartial(cfg.Partial)
 
 	go func() {
-		var t *models.QueuedTask
-		var task *core.DispatchedTask
-		var err error
-		var cpu int32
-
-		for true {
-			t = GetTaskFromPool()
-			if t == nil {
-				for uint64(taskPoolCount) < 10 {
-					if num := DrainQueuedTask(bpfModule); num == 0 {
-						bpfModule.BlockTilReadyForDequeue(context.TODO())
-					}
-				}
-			} else if t.Pid != -1 {
-				task = core.NewDispatchedTask(t)
-				err, cpu = bpfModule.SelectCPU(t)
-				if err != nil {
-					log.Printf("SelectCPU failed: %v", err)
-				}
+		err := util.WatchHotplug(context.Background(), bpfModule, func(ev core.HotplugEvent, topo *util.Topology) {
+			slog.Info("cpu hotplug", "cpu", ev.Cpu, "online", ev.Online, "online_cpus", len(topo.OnlineCPUs()))
+		})
+		if err != nil {
+			slog.Warn("hotplug watcher stopped", "err", err)
+		}
+	}()
 
-				// Evaluate used task time slice.
-				nrWaiting := core.GetNrQueued() + core.GetNrScheduled() + 1
-				task.Vtime = t.Vtime
-				task.SliceNs = max(SLICE_NS_DEFAULT/nrWaiting, SLICE_NS_MIN)
-				task.Cpu = cpu
+	go watchCongestion(bpfModule.CongestionEvents())
 
-				err = bpfModule.DispatchTask(task)
-				if err != nil {
-					log.Printf("DispatchTask failed: %v", err)
-					continue
-				}
+	if cfg.Stats.Address != "" {
+		go serveStats(cfg.Stats.Address, bpfModule)
+	}
 
-				err = core.NotifyComplete(uint64(taskPoolCount))
-				if err != nil {
-					log.Printf("NotifyComplete failed: %v", err)
-				}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	detachC := make(chan struct{}, 1)
+	if cfg.Control.Socket != "" {
+		srv := control.NewServer(&controlBackend{s: bpfModule, cfg: cfg, detach: detachC})
+		go func() {
+			if err := srv.ListenAndServe(ctx, cfg.Control.Socket); err != nil {
+				slog.Error("control server stopped", "socket", cfg.Control.Socket, "err", err)
 			}
-		}
-	}()
+		}()
+	}
+
+	startSchedLoops(bpfModule, shards, cfg.Scheduler.UserschedCpus == "")
 
 	signalChan := make(chan os.Signal, 1)
 	signal.Notify(signalChan, syscall.SIGINT, syscall.SIGTERM)
+	var statsC <-chan time.Time
+	if cfg.Stats.Interval > 0 {
+		statsTicker := time.NewTicker(cfg.Stats.Interval)
+		defer statsTicker.Stop()
+		statsC = statsTicker.C
+	}
+	var starvationC <-chan time.Time
+	if params.StarvationThreshold > 0 {
+		starvationTicker := time.NewTicker(max(cfg.Scheduler.StarvationThreshold/4, 10*time.Millisecond))
+		defer starvationTicker.Stop()
+		starvationC = starvationTicker.C
+	}
+	// The counters are gone once the kernel tears the scheduler down, so
+	// the exit report falls back to the last ones seen by the stats loop.
+	var lastEvents *core.SchedEvents
 	cont := true
-	timer := time.NewTicker(1 * time.Second)
+	timer := time.NewTicker(cfg.Scheduler.PollInterval)
 	for cont {
 		select {
 		case <-signalChan:
-			log.Println("receive os signal")
+			slog.Info("receive os signal")
+			cont = false
+		case <-detachC:
+			slog.Info("detach requested")
 			cont = false
+		case <-starvationC:
+			schedMu.Lock()
+			for _, p := range taskPools {
+				p.CheckStarvation(&starvation)
+			}
+			schedMu.Unlock()
+		case <-statsC:
+			bss, err := bpfModule.GetBssData()
+			if err != nil {
+				slog.Warn("GetBssData failed", "err", err)
+				continue
+			}
+			if ev := schedEvents(bpfModule); ev != nil {
+				lastEvents = ev
+			}
+			schedMu.Lock()
+			starved := starvation
+			pooled := poolCount()
+			schedMu.Unlock()
+			slog.Info("stats", "bss", bss.String(), "pool_count", pooled, "preempt", bpfModule.GetPreemptStats(), "events", lastEvents, "starvation", starved)
+			if bpfModule.QueuedShards() > 1 {
+				if shards, err := bpfModule.QueuedShardStats(); err == nil {
+					slog.Info("queued shards", "shards", shards)
+				}
+			}
 		case <-timer.C:
 			if bpfModule.Stopped() {
-				log.Println("bpfModule stopped")
+				slog.Warn("bpfModule stopped")
 				cmd := exec.Command("bpftool", []string{"map", "dump", "name", "main_bpf.data"}...)
 				cmd.Stdout = os.Stdout
 				cmd.Stderr = os.Stderr
 				if err := cmd.Run(); err != nil {
-					log.Printf("bpftool map dump failed: %v", err)
+					slog.Warn("bpftool map dump failed", "err", err)
 				}
 				cont = false
 			}
 		}
 	}
 	timer.Stop()
-	log.Println("scheduler exit")
+	if ev := schedEvents(bpfModule); ev != nil {
+		lastEvents = ev
+	}
+	if lastEvents != nil {
+		slog.Info("sched_ext events", "events", *lastEvents)
+	}
+	slog.Info("scheduler exit")
+	return nil
 }
@@ -0,0 +1,329 @@
+// Package policy is the deadline-based scheduling policy of qumun: it
+// dequeues the tasks queued by the BPF side into a pool ordered by deadline
+// and dispatches them one at a time with a slice scaled to the load. It only
+// depends on the dataplane interface, so it runs unchanged against the BPF
+// backend, the simulator (package sim) and a recorded trace (package
+// record).
+package policy
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+const NSEC_PER_SEC = 1000000000 // 1 second in nanoseconds
+
+// Params are the tunables of the policy. A TaskPool reads them on every
+// call: the caller serializes their updates with the pools using them.
+type Params struct {
+	SliceDefault  uint64 // slice of a task alone on the system, ns
+	SliceMin      uint64 // lower bound of the scaled slice, ns
+	Fifo          bool   // order tasks by arrival instead of deadline
+	CapacityAware bool   // steer tasks by CPU capacity (see selectCPU)
+
+	// StarvationThreshold is the longest a task may wait in a pool before
+	// CheckStarvation reports it (0 disables the check); with
+	// StarvationDispatch, it is also moved to the shared DSQ.
+	StarvationThreshold uint64
+	StarvationDispatch  bool
+
+	// Priority tasks are dispatched with a zero vtime, which makes the BPF
+	// side treat them as priority tasks (see update_priority_task_map()).
+	Priority map[int32]struct{}
+}
+
+// DefaultParams returns the built-in tunables of the policy.
+func DefaultParams() *Params {
+	return &Params{
+		SliceDefault:        5000 * 1000, // 5ms
+		SliceMin:            500 * 1000,
+		StarvationThreshold: NSEC_PER_SEC,
+		Priority:            map[int32]struct{}{},
+	}
+}
+
+// Task is a task held by a TaskPool.
+type Task struct {
+	*models.QueuedTask
+	Deadline  uint64
+	Timestamp uint64 // time it entered the pool, ns
+	Starved   bool   // already reported by CheckStarvation
+}
+
+// StarvationStats counts the tasks found by CheckStarvation.
+type StarvationStats struct {
+	Starved         uint64 `json:"starved"`          // tasks that waited in the pool longer than the threshold
+	ForceDispatched uint64 `json:"force_dispatched"` // starving tasks dispatched to the shared DSQ
+	MaxWaitNs       uint64 `json:"max_wait_ns"`      // longest wait in the pool seen by the watchdog
+}
+
+// TaskPool holds the tasks dequeued by a scheduling loop from s, ordered
+// by deadline. It is not safe for concurrent use.
+type TaskPool struct {
+	s           dataplane.Scheduler
+	params      *Params
+	tasks       []Task
+	count       int
+	head, tail  int
+	minVruntime uint64 // vruntime of the pool
+
+	// Now returns the current time in nanoseconds; the wall clock by
+	// default.
+	Now func() uint64
+}
+
+// NewTaskPool creates a pool of size slots (holding up to size-1 tasks)
+// scheduling the tasks of s with params.
+func NewTaskPool(s dataplane.Scheduler, size int, params *Params) *TaskPool {
+	return &TaskPool{s: s, params: params, tasks: make([]Task, size), Now: now}
+}
+
+func now() uint64 {
+	return uint64(time.Now().UnixNano())
+}
+
+// Len returns the number of tasks in the pool.
+func (p *TaskPool) Len() int {
+	return p.count
+}
+
+// Cap returns the number of tasks the pool can hold.
+func (p *TaskPool) Cap() int {
+	return len(p.tasks) - 1
+}
+
+// Tasks returns the tasks of the pool in dispatch order.
+func (p *TaskPool) Tasks() []Task {
+	tasks := make([]Task, p.count)
+	for i := range tasks {
+		tasks[i] = p.tasks[(p.head+i)%len(p.tasks)]
+	}
+	return tasks
+}
+
+// DrainQueuedTask moves the tasks queued by the BPF side to the pool until
+// there are no more or the pool is full. It returns the number of tasks
+// moved, or 0 when the pool filled up.
+func (p *TaskPool) DrainQueuedTask() int {
+	var count int
+	for (p.tail+1)%len(p.tasks) != p.head {
+		var newQueuedTask models.QueuedTask
+		p.s.DequeueTask(&newQueuedTask)
+		if newQueuedTask.Pid == -1 {
+			return count
+		}
+		deadline := p.updatedEnqueueTask(&newQueuedTask)
+		t := Task{
+			QueuedTask: &newQueuedTask,
+			Deadline:   deadline,
+			Timestamp:  p.Now(),
+		}
+		if p.params.Fifo {
+			t.Deadline = t.Timestamp
+		}
+		p.InsertTaskToPool(t)
+		count++
+	}
+	return 0
+}
+
+func (p *TaskPool) updatedEnqueueTask(t *models.QueuedTask) uint64 {
+	slice := p.params.SliceDefault
+	if p.minVruntime < t.Vtime {
+		p.minVruntime = t.Vtime
+	}
+	minVruntimeLocal := saturatingSub(p.minVruntime, slice)
+	if t.Vtime == 0 {
+		t.Vtime = minVruntimeLocal + (slice * 100 / t.Weight)
+	} else if t.Vtime < minVruntimeLocal {
+		t.Vtime = minVruntimeLocal
+	}
+	t.Vtime += (t.StopTs - t.StartTs) * t.Weight / 100
+
+	return t.Vtime + min(t.SumExecRuntime, slice*100)
+}
+
+// GetTaskFromPool removes the first task from the pool, or returns nil when
+// the pool is empty.
+func (p *TaskPool) GetTaskFromPool() *models.QueuedTask {
+	if p.head == p.tail {
+		return nil
+	}
+	t := &p.tasks[p.head]
+	p.head = (p.head + 1) % len(p.tasks)
+	p.count--
+	return t.QueuedTask
+}
+
+func saturatingSub(a, b uint64) uint64 {
+	if a > b {
+		return a - b
+	}
+	return 0
+}
+
+// LessQueuedTask orders the tasks by deadline, then arrival, then pid.
+func LessQueuedTask(
+	a, b *Task,
+) bool {
+	if a.Deadline != b.Deadline {
+		return a.Deadline < b.Deadline
+	}
+	if a.Timestamp != b.Timestamp {
+		return a.Timestamp < b.Timestamp
+	}
+	return a.Pid < b.Pid
+}
+
+// InsertTaskToPool adds newTask to the pool in deadline order. It returns
+// false when the pool is full.
+func (p *TaskPool) InsertTaskToPool(
+	newTask Task,
+) bool {
+	size := len(p.tasks)
+	if p.count >= size-1 {
+		return false
+	}
+	insertIdx := p.tail
+	for i := 0; i < p.count; i++ {
+		idx := (p.head + i) % size
+		if LessQueuedTask(
+			&newTask,
+			&p.tasks[idx],
+		) {
+			insertIdx = idx
+			break
+		}
+	}
+
+	cur := p.tail
+	for cur != insertIdx {
+		next := (cur - 1 + size) % size
+		p.tasks[cur] = p.tasks[next]
+		cur = next
+	}
+	p.tasks[insertIdx] = newTask
+	p.tail = (p.tail + 1) % size
+	p.count++
+	return true
+}
+
+// DispatchOne sends the first task of the pool to the BPF side. It returns
+// false when the pool is empty.
+func (p *TaskPool) DispatchOne() bool {
+	s := p.s
+	t := p.GetTaskFromPool()
+	if t == nil {
+		return false
+	}
+	if t.Pid == -1 {
+		return true
+	}
+	task := dataplane.NewDispatchedTask(t)
+	err, cpu := p.selectCPU(t)
+	if err != nil {
+		slog.Warn("SelectCPU failed", "pid", t.Pid, "err", err)
+	}
+
+	// Evaluate used task time slice.
+	nrWaiting := s.GetNrQueued() + s.GetNrScheduled() + 1
+	task.Vtime = t.Vtime
+	if _, ok := p.params.Priority[t.Pid]; ok {
+		task.Vtime = 0
+	}
+	task.SliceNs = max(p.params.SliceDefault/nrWaiting, p.params.SliceMin)
+	task.Cpu = cpu
+
+	err = s.DispatchTask(task)
+	if err != nil {
+		slog.Warn("DispatchTask failed", "pid", task.Pid, "err", err)
+		return true
+	}
+
+	err = s.NotifyComplete(uint64(p.count))
+	if err != nil {
+		slog.Warn("NotifyComplete failed", "err", err)
+	}
+	return true
+}
+
+// CheckStarvation reports the tasks that waited in the pool for longer than
+// the starvation threshold and, with StarvationDispatch, takes them out of
+// the pool and dispatches them to the shared DSQ, where any CPU can pick
+// them up before the sched_ext watchdog ejects the scheduler. It adds them
+// to st and returns the number of tasks newly reported.
+func (p *TaskPool) CheckStarvation(st *StarvationStats) int {
+	threshold := p.params.StarvationThreshold
+	if threshold == 0 {
+		return 0
+	}
+	s := p.s
+	size := len(p.tasks)
+	t0 := p.Now()
+	var n, forced, kept int
+	var oldest *Task
+	for i := 0; i < p.count; i++ {
+		t := p.tasks[(p.head+i)%size]
+		wait := saturatingSub(t0, t.Timestamp)
+		if wait >= threshold {
+			st.MaxWaitNs = max(st.MaxWaitNs, wait)
+			if !t.Starved {
+				t.Starved = true
+				st.Starved++
+				n++
+			}
+			if oldest == nil || t.Timestamp < oldest.Timestamp {
+				oldest = &t
+			}
+			if p.params.StarvationDispatch {
+				if err := p.forceDispatch(t.QueuedTask); err != nil {
+					slog.Warn("DispatchTask failed", "pid", t.Pid, "err", err)
+				} else {
+					st.ForceDispatched++
+					forced++
+					continue
+				}
+			}
+		}
+		p.tasks[(p.head+kept)%size] = t
+		kept++
+	}
+	p.tail = (p.head + kept) % size
+	p.count = kept
+	if forced > 0 {
+		if err := s.NotifyComplete(uint64(p.count)); err != nil {
+			slog.Warn("NotifyComplete failed", "err", err)
+		}
+	}
+	if n > 0 || forced > 0 {
+		slog.Warn("tasks starving in the pool", "new", n, "force_dispatched", forced,
+			"oldest_pid", oldest.Pid, "oldest_wait", time.Duration(saturatingSub(t0, oldest.Timestamp)))
+	}
+	return n
+}
+
+// forceDispatch sends t to the shared DSQ ahead of the tasks queued there.
+func (p *TaskPool) forceDispatch(t *models.QueuedTask) error {
+	task := dataplane.NewDispatchedTask(t)
+	task.Cpu = dataplane.RL_CPU_ANY
+	task.Vtime = 1 // lowest vtime that does not make it a priority task
+	task.SliceNs = p.params.SliceMin
+	return p.s.DispatchTask(task)
+}
+
+// selectCPU picks the CPU of t. With capacity awareness enabled, tasks that
+// ran for less than a slice since their last sleep (interactive) prefer
+// high-capacity CPUs, while CPU-bound tasks are steered to efficient ones.
+func (p *TaskPool) selectCPU(t *models.QueuedTask) (error, int32) {
+	cs, ok := p.s.(dataplane.CapacityScheduler)
+	if !p.params.CapacityAware || !ok {
+		return p.s.SelectCPU(t)
+	}
+	if t.SumExecRuntime < p.params.SliceDefault {
+		return cs.SelectCPUByCapacity(t, dataplane.CapacityPerformance)
+	}
+	return cs.SelectCPUByCapacity(t, dataplane.CapacityEfficiency)
+}
@@ -0,0 +1,287 @@
+package policy
+
+import (
+	"slices"
+	"testing"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+	"github.com/Gthulhu/qumun/sim"
+)
+
+const ms = 1000 * 1000
+
+// tracer records the decisions sent to the simulator.
+type tracer struct {
+	*sim.Sim
+	dispatched []dataplane.DispatchedTask
+}
+
+func (t *tracer) DispatchTask(d *dataplane.DispatchedTask) error {
+	t.dispatched = append(t.dispatched, *d)
+	return t.Sim.DispatchTask(d)
+}
+
+func newSim(t *testing.T, tr *sim.Trace) *tracer {
+	t.Helper()
+	s, err := sim.New(tr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTimeLimit(60 * NSEC_PER_SEC)
+	return &tracer{Sim: s}
+}
+
+// run schedules the trace with a pool of p until all the tasks are done,
+// draining and dispatching everything whenever the BPF side would wake up
+// the scheduler.
+func run(t *testing.T, s *tracer, params *Params) sim.Stats {
+	t.Helper()
+	p := NewTaskPool(s, 64, params)
+	p.Now = s.Now
+	st, err := s.Run(func() {
+		for p.DrainQueuedTask() > 0 || p.Len() > 0 {
+			for p.DispatchOne() {
+			}
+		}
+	})
+	if err != nil {
+		t.Fatalf("Run: %v (stats %+v)", err, st)
+	}
+	for pid, ts := range st.Tasks {
+		if ts.DoneAtNs == 0 {
+			t.Errorf("pid %d never completed", pid)
+		}
+	}
+	if st.NrStale != 0 || st.NrBounces != 0 {
+		t.Errorf("stale %d bounces %d, want none", st.NrStale, st.NrBounces)
+	}
+	return st
+}
+
+func TestUpdatedEnqueueTask(t *testing.T) {
+	params := DefaultParams()
+	slice := params.SliceDefault
+	tests := []struct {
+		name         string
+		minVruntime  uint64
+		task         models.QueuedTask
+		wantVtime    uint64
+		wantDeadline uint64
+	}{
+		{
+			name:         "new task starts a slice after the pool",
+			minVruntime:  100 * ms,
+			task:         models.QueuedTask{Weight: 100},
+			wantVtime:    100*ms - slice + slice,
+			wantDeadline: 100 * ms,
+		},
+		{
+			name:         "new heavy task starts closer to the pool",
+			minVruntime:  100 * ms,
+			task:         models.QueuedTask{Weight: 200},
+			wantVtime:    100*ms - slice + slice/2,
+			wantDeadline: 100*ms - slice/2,
+		},
+		{
+			name:         "sleeper is clamped to a slice behind the pool",
+			minVruntime:  100 * ms,
+			task:         models.QueuedTask{Weight: 100, Vtime: 10 * ms, StartTs: 1 * ms, StopTs: 3 * ms, SumExecRuntime: 2 * ms},
+			wantVtime:    100*ms - slice + 2*ms,
+			wantDeadline: 100*ms - slice + 4*ms,
+		},
+		{
+			name:         "task ahead of the pool advances it",
+			minVruntime:  100 * ms,
+			task:         models.QueuedTask{Weight: 100, Vtime: 200 * ms, StartTs: 0, StopTs: 1 * ms, SumExecRuntime: 1 * ms},
+			wantVtime:    201 * ms,
+			wantDeadline: 202 * ms,
+		},
+		{
+			name:         "exec runtime is capped",
+			minVruntime:  100 * ms,
+			task:         models.QueuedTask{Weight: 100, Vtime: 100 * ms, SumExecRuntime: 10 * NSEC_PER_SEC},
+			wantVtime:    100 * ms,
+			wantDeadline: 100*ms + slice*100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := NewTaskPool(nil, 8, params)
+			p.minVruntime = tt.minVruntime
+			task := tt.task
+			deadline := p.updatedEnqueueTask(&task)
+			if task.Vtime != tt.wantVtime || deadline != tt.wantDeadline {
+				t.Errorf("vtime %d deadline %d, want %d %d", task.Vtime, deadline, tt.wantVtime, tt.wantDeadline)
+			}
+		})
+	}
+}
+
+func TestInsertTaskToPool(t *testing.T) {
+	p := NewTaskPool(nil, 4, DefaultParams())
+	for i, d := range []uint64{30, 10, 20} {
+		q := &models.QueuedTask{Pid: int32(i + 1)}
+		if !p.InsertTaskToPool(Task{QueuedTask: q, Deadline: d}) {
+			t.Fatalf("insert %d failed", i)
+		}
+	}
+	if p.InsertTaskToPool(Task{QueuedTask: &models.QueuedTask{Pid: 4}}) {
+		t.Fatal("insert into a full pool succeeded")
+	}
+	var pids []int32
+	for q := p.GetTaskFromPool(); q != nil; q = p.GetTaskFromPool() {
+		pids = append(pids, q.Pid)
+	}
+	if len(pids) != 3 || pids[0] != 2 || pids[1] != 3 || pids[2] != 1 {
+		t.Errorf("dispatch order %v, want [2 3 1]", pids)
+	}
+}
+
+func TestSimCompletes(t *testing.T) {
+	tr := &sim.Trace{NrCPUs: 4}
+	for pid := int32(1); pid <= 16; pid++ {
+		tr.Tasks = append(tr.Tasks, sim.TaskSpec{
+			Pid:       pid,
+			Weight:    uint64(50 * (1 + pid%3)),
+			ArrivalNs: uint64(pid) * ms,
+			BurstsNs:  []uint64{3 * ms, uint64(pid) * ms, 2 * ms},
+			SleepNs:   5 * ms,
+		})
+	}
+	for _, fifo := range []bool{false, true} {
+		params := DefaultParams()
+		params.Fifo = fifo
+		st := run(t, newSim(t, tr), params)
+		if st.NrDispatches < 48 {
+			t.Errorf("fifo %v: %d dispatches, want at least one per burst", fifo, st.NrDispatches)
+		}
+	}
+}
+
+// Tasks woken together are dispatched by deadline: a new task starts
+// 100/weight slices after the pool, so heavier tasks go first. The fifo
+// policy dispatches them in arrival order instead.
+func TestSimDeadlineOrder(t *testing.T) {
+	tr := &sim.Trace{
+		NrCPUs: 1,
+		Tasks: []sim.TaskSpec{
+			{Pid: 1, Weight: 50, BurstsNs: []uint64{ms}},
+			{Pid: 2, Weight: 100, BurstsNs: []uint64{ms}},
+			{Pid: 3, Weight: 400, BurstsNs: []uint64{ms}},
+		},
+	}
+	for _, tt := range []struct {
+		fifo bool
+		want []int32
+	}{
+		{false, []int32{3, 2, 1}},
+		{true, []int32{1, 2, 3}},
+	} {
+		params := DefaultParams()
+		params.Fifo = tt.fifo
+		s := newSim(t, tr)
+		st := run(t, s, params)
+		var got []int32
+		for _, d := range s.dispatched[:3] {
+			got = append(got, d.Pid)
+		}
+		if !slices.Equal(got, tt.want) {
+			t.Errorf("fifo %v: dispatch order %v, want %v", tt.fifo, got, tt.want)
+		}
+		// The first task gets the idle CPU; the others wait in the
+		// shared DSQ, which is ordered by vtime whatever the policy.
+		done := func(pid int32) uint64 { return st.Tasks[pid].DoneAtNs }
+		if !tt.fifo && (done(3) >= done(2) || done(2) >= done(1)) {
+			t.Errorf("tasks not run by deadline: %+v", st.Tasks)
+		}
+	}
+}
+
+// The slice shrinks with the number of waiting tasks, down to SliceMin.
+func TestSimSliceScaling(t *testing.T) {
+	tr := &sim.Trace{NrCPUs: 1}
+	for pid := int32(1); pid <= 20; pid++ {
+		tr.Tasks = append(tr.Tasks, sim.TaskSpec{Pid: pid, BurstsNs: []uint64{20 * ms}})
+	}
+	params := DefaultParams()
+	s := newSim(t, tr)
+	run(t, s, params)
+	// The first dispatch only sees the tasks reported by NotifyComplete so
+	// far, i.e. none.
+	if got := s.dispatched[0].SliceNs; got != params.SliceDefault {
+		t.Errorf("first slice %d, want %d", got, params.SliceDefault)
+	}
+	if got := s.dispatched[1].SliceNs; got != params.SliceMin {
+		t.Errorf("second slice %d, want %d", got, params.SliceMin)
+	}
+	for _, d := range s.dispatched {
+		if d.SliceNs < params.SliceMin || d.SliceNs > params.SliceDefault {
+			t.Fatalf("pid %d: slice %d out of [%d, %d]", d.Pid, d.SliceNs, params.SliceMin, params.SliceDefault)
+		}
+	}
+}
+
+func TestSimPriority(t *testing.T) {
+	tr := &sim.Trace{NrCPUs: 2}
+	for pid := int32(1); pid <= 4; pid++ {
+		tr.Tasks = append(tr.Tasks, sim.TaskSpec{Pid: pid, BurstsNs: []uint64{10 * ms, 10 * ms}, SleepNs: ms})
+	}
+	params := DefaultParams()
+	params.Priority[3] = struct{}{}
+	s := newSim(t, tr)
+	run(t, s, params)
+	for _, d := range s.dispatched {
+		if (d.Vtime == 0) != (d.Pid == 3) {
+			t.Errorf("pid %d dispatched with vtime %d", d.Pid, d.Vtime)
+		}
+	}
+}
+
+func TestCheckStarvation(t *testing.T) {
+	tr := &sim.Trace{NrCPUs: 1}
+	for pid := int32(1); pid <= 3; pid++ {
+		tr.Tasks = append(tr.Tasks, sim.TaskSpec{Pid: pid, BurstsNs: []uint64{ms}})
+	}
+	for _, dispatch := range []bool{false, true} {
+		params := DefaultParams()
+		params.StarvationDispatch = dispatch
+		s := newSim(t, tr)
+		p := NewTaskPool(s, 8, params)
+		p.Now = s.Now
+		var st StarvationStats
+		var reported []int
+		_, err := s.Run(func() {
+			p.DrainQueuedTask()
+			if reported != nil {
+				for p.DispatchOne() {
+				}
+				return
+			}
+			clock := p.Now
+			p.Now = func() uint64 { return clock() + params.StarvationThreshold }
+			reported = append(reported, p.CheckStarvation(&st), p.CheckStarvation(&st))
+			p.Now = clock
+			for p.DispatchOne() {
+			}
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(reported) != 2 || reported[0] != 3 || reported[1] != 0 {
+			t.Errorf("dispatch %v: reported %v, want [3 0]", dispatch, reported)
+		}
+		if st.Starved != 3 || st.MaxWaitNs != params.StarvationThreshold {
+			t.Errorf("dispatch %v: stats %+v", dispatch, st)
+		}
+		var forced int
+		for _, d := range s.dispatched {
+			if d.Cpu == dataplane.RL_CPU_ANY && d.Vtime == 1 {
+				forced++
+			}
+		}
+		if want := map[bool]int{false: 0, true: 3}[dispatch]; forced != want || st.ForceDispatched != uint64(want) {
+			t.Errorf("dispatch %v: %d tasks forced (stats %d), want %d", dispatch, forced, st.ForceDispatched, want)
+		}
+	}
+}
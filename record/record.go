@@ -0,0 +1,266 @@
+// Package record stores the tasks exchanged between the BPF side and the
+// user-space scheduler in a compact binary trace, and replays such a trace
+// into a policy offline.
+//
+// A trace starts with an 8-byte header ("QMTR", version, reserved) followed
+// by fixed-size little-endian records: a 1-byte kind, an 8-byte timestamp
+// (ns) and the payload (queuedSize or dispatchedSize bytes).
+package record
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+const (
+	magic   = "QMTR"
+	version = 1
+
+	queuedSize     = 4 + 4 + 7*8 + 4 // see struct queued_task_ctx
+	dispatchedSize = 4 + 4 + 4*8     // see struct dispatched_task_ctx
+)
+
+// Kind identifies the type of a record.
+type Kind uint8
+
+const (
+	KindQueued     Kind = 1 // task received from the BPF side
+	KindDispatched Kind = 2 // task sent back to the BPF side
+)
+
+// Event is a single record of a trace. Exactly one of Queued and Dispatched
+// is set, according to Kind.
+type Event struct {
+	Kind       Kind
+	Ts         uint64
+	Queued     *models.QueuedTask
+	Dispatched *dataplane.DispatchedTask
+}
+
+// Writer records tasks to a trace; it implements dataplane.Recorder and is safe
+// for concurrent use.
+type Writer struct {
+	mu  sync.Mutex
+	w   *bufio.Writer
+	c   io.Closer
+	buf [1 + 8 + queuedSize]byte
+	err error
+}
+
+// NewWriter writes the trace header to w and returns a Writer.
+func NewWriter(w io.Writer) (*Writer, error) {
+	rw := &Writer{w: bufio.NewWriter(w)}
+	if c, ok := w.(io.Closer); ok {
+		rw.c = c
+	}
+	var hdr [8]byte
+	copy(hdr[:4], magic)
+	binary.LittleEndian.PutUint16(hdr[4:6], version)
+	if _, err := rw.w.Write(hdr[:]); err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+// Create creates (or truncates) the trace file at path.
+func Create(path string) (*Writer, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	w, err := NewWriter(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+// RecordQueued appends a decoded QueuedTask, timestamped with the current time.
+func (w *Writer) RecordQueued(t *models.QueuedTask) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.write(Event{Kind: KindQueued, Ts: uint64(time.Now().UnixNano()), Queued: t})
+}
+
+// RecordDispatched appends a DispatchedTask, timestamped with the current time.
+func (w *Writer) RecordDispatched(t *dataplane.DispatchedTask) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.write(Event{Kind: KindDispatched, Ts: uint64(time.Now().UnixNano()), Dispatched: t})
+}
+
+// Write appends an arbitrary event.
+func (w *Writer) Write(ev Event) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.write(ev)
+	return w.err
+}
+
+func (w *Writer) write(ev Event) {
+	if w.err != nil {
+		return
+	}
+	b := w.buf[:]
+	b[0] = byte(ev.Kind)
+	binary.LittleEndian.PutUint64(b[1:9], ev.Ts)
+	p := b[9:]
+	switch ev.Kind {
+	case KindQueued:
+		encodeQueued(p, ev.Queued)
+		b = b[:9+queuedSize]
+	case KindDispatched:
+		encodeDispatched(p, ev.Dispatched)
+		b = b[:9+dispatchedSize]
+	default:
+		w.err = fmt.Errorf("record: unknown kind %d", ev.Kind)
+		return
+	}
+	_, w.err = w.w.Write(b)
+}
+
+// Err returns the first write error, if any.
+func (w *Writer) Err() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// Close flushes the buffered records and closes the underlying file.
+func (w *Writer) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.w.Flush()
+	if w.c != nil {
+		if cerr := w.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	if w.err != nil {
+		return w.err
+	}
+	return err
+}
+
+// Reader decodes a trace produced by Writer.
+type Reader struct {
+	r   *bufio.Reader
+	buf [8 + queuedSize]byte
+}
+
+// NewReader checks the trace header and returns a Reader.
+func NewReader(r io.Reader) (*Reader, error) {
+	rd := &Reader{r: bufio.NewReader(r)}
+	var hdr [8]byte
+	if _, err := io.ReadFull(rd.r, hdr[:]); err != nil {
+		return nil, fmt.Errorf("record: read header: %w", err)
+	}
+	if string(hdr[:4]) != magic {
+		return nil, errors.New("record: not a qumun trace")
+	}
+	if v := binary.LittleEndian.Uint16(hdr[4:6]); v != version {
+		return nil, fmt.Errorf("record: unsupported version %d", v)
+	}
+	return rd, nil
+}
+
+// Next returns the next event, or io.EOF at the end of the trace.
+func (r *Reader) Next() (Event, error) {
+	kind, err := r.r.ReadByte()
+	if err != nil {
+		return Event{}, err
+	}
+	var size int
+	switch Kind(kind) {
+	case KindQueued:
+		size = queuedSize
+	case KindDispatched:
+		size = dispatchedSize
+	default:
+		return Event{}, fmt.Errorf("record: unknown kind %d", kind)
+	}
+	b := r.buf[:8+size]
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return Event{}, io.ErrUnexpectedEOF
+	}
+	ev := Event{Kind: Kind(kind), Ts: binary.LittleEndian.Uint64(b[0:8])}
+	if ev.Kind == KindQueued {
+		ev.Queued = decodeQueued(b[8:])
+	} else {
+		ev.Dispatched = decodeDispatched(b[8:])
+	}
+	return ev, nil
+}
+
+// ReadAll returns all the remaining events.
+func (r *Reader) ReadAll() ([]Event, error) {
+	var events []Event
+	for {
+		ev, err := r.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, ev)
+	}
+}
+
+func encodeQueued(b []byte, t *models.QueuedTask) {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.Pid))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Cpu))
+	binary.LittleEndian.PutUint64(b[8:16], t.NrCpusAllowed)
+	binary.LittleEndian.PutUint64(b[16:24], t.Flags)
+	binary.LittleEndian.PutUint64(b[24:32], t.StartTs)
+	binary.LittleEndian.PutUint64(b[32:40], t.StopTs)
+	binary.LittleEndian.PutUint64(b[40:48], t.SumExecRuntime)
+	binary.LittleEndian.PutUint64(b[48:56], t.Weight)
+	binary.LittleEndian.PutUint64(b[56:64], t.Vtime)
+	binary.LittleEndian.PutUint32(b[64:68], uint32(t.Tgid))
+}
+
+func decodeQueued(b []byte) *models.QueuedTask {
+	return &models.QueuedTask{
+		Pid:            int32(binary.LittleEndian.Uint32(b[0:4])),
+		Cpu:            int32(binary.LittleEndian.Uint32(b[4:8])),
+		NrCpusAllowed:  binary.LittleEndian.Uint64(b[8:16]),
+		Flags:          binary.LittleEndian.Uint64(b[16:24]),
+		StartTs:        binary.LittleEndian.Uint64(b[24:32]),
+		StopTs:         binary.LittleEndian.Uint64(b[32:40]),
+		SumExecRuntime: binary.LittleEndian.Uint64(b[40:48]),
+		Weight:         binary.LittleEndian.Uint64(b[48:56]),
+		Vtime:          binary.LittleEndian.Uint64(b[56:64]),
+		Tgid:           int32(binary.LittleEndian.Uint32(b[64:68])),
+	}
+}
+
+func encodeDispatched(b []byte, t *dataplane.DispatchedTask) {
+	binary.LittleEndian.PutUint32(b[0:4], uint32(t.Pid))
+	binary.LittleEndian.PutUint32(b[4:8], uint32(t.Cpu))
+	binary.LittleEndian.PutUint64(b[8:16], t.Flags)
+	binary.LittleEndian.PutUint64(b[16:24], t.SliceNs)
+	binary.LittleEndian.PutUint64(b[24:32], t.Vtime)
+	binary.LittleEndian.PutUint64(b[32:40], t.CpuMaskCnt)
+}
+
+func decodeDispatched(b []byte) *dataplane.DispatchedTask {
+	return &dataplane.DispatchedTask{
+		Pid:        int32(binary.LittleEndian.Uint32(b[0:4])),
+		Cpu:        int32(binary.LittleEndian.Uint32(b[4:8])),
+		Flags:      binary.LittleEndian.Uint64(b[8:16]),
+		SliceNs:    binary.LittleEndian.Uint64(b[16:24]),
+		Vtime:      binary.LittleEndian.Uint64(b[24:32]),
+		CpuMaskCnt: binary.LittleEndian.Uint64(b[32:40]),
+	}
+}
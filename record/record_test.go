@@ -0,0 +1,229 @@
+package record
+
+import (
+	"bytes"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+func queued(pid int32) Event {
+	return Event{Kind: KindQueued, Ts: uint64(pid), Queued: &models.QueuedTask{Pid: pid, Tgid: pid, Weight: 100}}
+}
+
+func dispatched(pid int32, slice uint64) Event {
+	return Event{Kind: KindDispatched, Ts: uint64(pid), Dispatched: &dataplane.DispatchedTask{Pid: pid, Cpu: dataplane.RL_CPU_ANY, SliceNs: slice}}
+}
+
+func encode(t *testing.T, events []Event) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ev := range events {
+		if err := w.Write(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return &buf
+}
+
+func TestRoundTrip(t *testing.T) {
+	events := []Event{
+		{Kind: KindQueued, Ts: 1, Queued: &models.QueuedTask{
+			Pid:            -2,
+			Cpu:            3,
+			NrCpusAllowed:  4,
+			Flags:          5,
+			StartTs:        6,
+			StopTs:         7,
+			SumExecRuntime: 8,
+			Weight:         9,
+			Vtime:          1 << 63,
+			Tgid:           -11,
+		}},
+		{Kind: KindDispatched, Ts: 1<<64 - 1, Dispatched: &dataplane.DispatchedTask{
+			Pid:        12,
+			Cpu:        dataplane.RL_CPU_ANY,
+			Flags:      13,
+			SliceNs:    14,
+			Vtime:      15,
+			CpuMaskCnt: 16,
+		}},
+	}
+	buf := encode(t, events)
+	if want := 8 + 2*(1+8) + queuedSize + dispatchedSize; buf.Len() != want {
+		t.Errorf("trace is %d bytes, want %d", buf.Len(), want)
+	}
+	r, err := NewReader(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(got, events) {
+		t.Errorf("decoded %+v, want %+v", got, events)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	var buf bytes.Buffer
+	w, err := NewWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec dataplane.Recorder = w
+	rec.RecordQueued(&models.QueuedTask{Pid: 1})
+	rec.RecordDispatched(&dataplane.DispatchedTask{Pid: 1})
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	r, err := NewReader(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, err := r.ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 2 || events[0].Kind != KindQueued || events[1].Kind != KindDispatched || events[0].Ts == 0 {
+		t.Errorf("events %+v", events)
+	}
+}
+
+func TestReaderErrors(t *testing.T) {
+	valid := encode(t, []Event{queued(1)}).Bytes()
+	tests := []struct {
+		name  string
+		trace []byte
+		err   string
+	}{
+		{"empty", nil, "read header"},
+		{"magic", append([]byte("XXXX"), valid[4:]...), "not a qumun trace"},
+		{"version", append(append([]byte(magic), 9, 0), valid[6:]...), "unsupported version 9"},
+		{"kind", append(append([]byte{}, valid[:8]...), 7), "unknown kind 7"},
+		{"truncated", valid[:len(valid)-1], io.ErrUnexpectedEOF.Error()},
+	}
+	for _, tt := range tests {
+		r, err := NewReader(bytes.NewReader(tt.trace))
+		if err == nil {
+			_, err = r.ReadAll()
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		}
+	}
+	w, err := NewWriter(io.Discard)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Write(Event{Kind: 7}); err == nil {
+		t.Error("writing an unknown kind succeeded")
+	}
+}
+
+// The policy only sees the tasks queued before the decision it is about to
+// make, as in the recorded run.
+func TestReplayInterleaved(t *testing.T) {
+	trace := encode(t, []Event{
+		queued(1), queued(2),
+		dispatched(1, 2),
+		queued(3),
+		dispatched(2, 2),
+		dispatched(3, 1),
+		queued(1),
+		dispatched(1, 1),
+	})
+	r, err := NewReader(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var visible []uint64
+	diff, err := Replay(r, func(rp *Replayer) {
+		for {
+			var q models.QueuedTask
+			rp.DequeueTask(&q)
+			if q.Pid == -1 {
+				return
+			}
+			// Dispatch right away with a slice that depends on the
+			// backlog, like the built-in policy.
+			visible = append(visible, rp.GetNrQueued()+1)
+			d := dataplane.NewDispatchedTask(&q)
+			_, d.Cpu = rp.SelectCPU(&q)
+			d.SliceNs = rp.GetNrQueued() + 1
+			if err := rp.DispatchTask(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []uint64{2, 2, 1, 1}; !reflect.DeepEqual(visible, want) {
+		t.Errorf("backlog seen at each dispatch %v, want %v", visible, want)
+	}
+	if !diff.Identical() || diff.Queued != 4 || diff.OldDispatches != 4 || diff.NewDispatches != 4 {
+		t.Errorf("diff:\n%s", diff)
+	}
+}
+
+func TestReplayDiff(t *testing.T) {
+	trace := encode(t, []Event{
+		queued(1), queued(2), queued(3),
+		dispatched(1, 10),
+		dispatched(2, 10),
+		dispatched(3, 10),
+	})
+	r, err := NewReader(trace)
+	if err != nil {
+		t.Fatal(err)
+	}
+	diff, err := Replay(r, func(rp *Replayer) {
+		var tasks []models.QueuedTask
+		for {
+			var q models.QueuedTask
+			rp.DequeueTask(&q)
+			if q.Pid == -1 {
+				break
+			}
+			tasks = append(tasks, q)
+		}
+		// Reverse the order, change a slice and drop pid 1.
+		for i := len(tasks) - 1; i >= 0; i-- {
+			if tasks[i].Pid == 1 {
+				continue
+			}
+			d := dataplane.NewDispatchedTask(&tasks[i])
+			d.Cpu = dataplane.RL_CPU_ANY
+			d.SliceNs = 10
+			if tasks[i].Pid == 2 {
+				d.SliceNs = 20
+			}
+			rp.DispatchTask(d)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := Diff{Queued: 3, OldDispatches: 3, NewDispatches: 2, SliceChanged: 1, OrderChanged: 1, Missing: 1}
+	got := *diff
+	got.Mismatches = nil
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("diff %+v, want %+v", got, want)
+	}
+	if diff.Identical() || len(diff.Mismatches) != 2 {
+		t.Errorf("diff:\n%s", diff)
+	}
+}
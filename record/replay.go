@@ -0,0 +1,276 @@
+package record
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+// maxMismatches bounds the number of divergences kept in a Diff.
+const maxMismatches = 64
+
+var _ dataplane.Scheduler = (*Replayer)(nil)
+
+// Replayer plays the role of the BPF backend for a recorded trace: it hands
+// the recorded QueuedTasks to the policy and collects its decisions.
+type Replayer struct {
+	events      []Event
+	next        int // first event not released yet
+	seen        int // recorded dispatches released
+	skipped     int // recorded dispatches the policy did not match
+	pending     []models.QueuedTask
+	nrScheduled uint64
+
+	recorded map[int32][]dataplane.DispatchedTask // original decisions per pid
+	oldOrder []decisionKey
+	newOrder []decisionKey
+	decided  map[int32][]dataplane.DispatchedTask // replayed decisions per pid
+}
+
+type decisionKey struct {
+	pid int32
+	nth int
+}
+
+// Mismatch is a decision that differs between the recording and the replay.
+// Old or New is nil when the decision is missing on that side.
+type Mismatch struct {
+	Pid int32
+	Nth int // n-th dispatch of this pid
+	Old *dataplane.DispatchedTask
+	New *dataplane.DispatchedTask
+}
+
+// Diff summarizes how the replayed policy diverges from the recording.
+type Diff struct {
+	Queued        int
+	OldDispatches int
+	NewDispatches int
+	CpuChanged    int
+	SliceChanged  int
+	VtimeChanged  int
+	OrderChanged  int // decisions emitted at a different position
+	Missing       int // recorded decisions the policy did not make
+	Extra         int // decisions the policy made that were not recorded
+	Mismatches    []Mismatch
+}
+
+// Identical reports whether the replay reproduced the recording exactly.
+func (d *Diff) Identical() bool {
+	return d.CpuChanged == 0 && d.SliceChanged == 0 && d.VtimeChanged == 0 &&
+		d.OrderChanged == 0 && d.Missing == 0 && d.Extra == 0
+}
+
+func (d *Diff) String() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "queued: %d, dispatches: %d recorded / %d replayed\n", d.Queued, d.OldDispatches, d.NewDispatches)
+	fmt.Fprintf(&b, "cpu changed: %d, slice changed: %d, vtime changed: %d, order changed: %d, missing: %d, extra: %d\n",
+		d.CpuChanged, d.SliceChanged, d.VtimeChanged, d.OrderChanged, d.Missing, d.Extra)
+	for _, m := range d.Mismatches {
+		fmt.Fprintf(&b, "pid %d #%d: %s -> %s\n", m.Pid, m.Nth, fmtDecision(m.Old), fmtDecision(m.New))
+	}
+	return b.String()
+}
+
+func fmtDecision(t *dataplane.DispatchedTask) string {
+	if t == nil {
+		return "<none>"
+	}
+	return fmt.Sprintf("{cpu:%d slice:%d vtime:%d}", t.Cpu, t.SliceNs, t.Vtime)
+}
+
+// Replay feeds the events of r into a policy. schedule is called while
+// tasks are queued or held by the policy, and must drain and dispatch tasks
+// through the given Replayer.
+//
+// The recorded tasks are handed out in recorded order, interleaved with the
+// decisions: after the policy made n decisions, only the tasks queued before
+// the n+1-th recorded dispatch can be dequeued, like in the original run.
+// When the policy stops dispatching while the recording goes on, the next
+// recorded dispatch is skipped so that the replay can proceed.
+func Replay(r *Reader, schedule func(rp *Replayer)) (*Diff, error) {
+	events, err := r.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	rp := &Replayer{
+		events:   events,
+		recorded: make(map[int32][]dataplane.DispatchedTask),
+		decided:  make(map[int32][]dataplane.DispatchedTask),
+	}
+	diff := &Diff{}
+	for _, ev := range events {
+		switch ev.Kind {
+		case KindQueued:
+			diff.Queued++
+		case KindDispatched:
+			d := *ev.Dispatched
+			rp.oldOrder = append(rp.oldOrder, decisionKey{d.Pid, len(rp.recorded[d.Pid])})
+			rp.recorded[d.Pid] = append(rp.recorded[d.Pid], d)
+		}
+	}
+
+	rp.release()
+	for {
+		decided, next := len(rp.newOrder), rp.next
+		if len(rp.pending) > 0 || rp.nrScheduled > 0 {
+			schedule(rp)
+		}
+		if len(rp.newOrder) == decided && rp.next == next {
+			if rp.next == len(rp.events) {
+				break
+			}
+			rp.skipped++
+			rp.release()
+		}
+	}
+
+	rp.compare(diff)
+	return diff, nil
+}
+
+// release makes the tasks queued before the next recorded dispatch
+// available to DequeueTask.
+func (rp *Replayer) release() {
+	for ; rp.next < len(rp.events); rp.next++ {
+		ev := rp.events[rp.next]
+		if ev.Kind == KindDispatched {
+			if rp.seen >= len(rp.newOrder)+rp.skipped {
+				return
+			}
+			rp.seen++
+			continue
+		}
+		rp.pending = append(rp.pending, *ev.Queued)
+	}
+}
+
+func (rp *Replayer) compare(diff *Diff) {
+	diff.OldDispatches = len(rp.oldOrder)
+	diff.NewDispatches = len(rp.newOrder)
+
+	oldPos := make(map[decisionKey]int, len(rp.oldOrder))
+	for i, k := range rp.oldOrder {
+		oldPos[k] = i
+	}
+	for i, k := range rp.newOrder {
+		if pos, ok := oldPos[k]; ok && pos != i {
+			diff.OrderChanged++
+		}
+	}
+
+	addMismatch := func(m Mismatch) {
+		if len(diff.Mismatches) < maxMismatches {
+			diff.Mismatches = append(diff.Mismatches, m)
+		}
+	}
+	for _, k := range rp.oldOrder {
+		old := rp.recorded[k.pid][k.nth]
+		if k.nth >= len(rp.decided[k.pid]) {
+			diff.Missing++
+			addMismatch(Mismatch{Pid: k.pid, Nth: k.nth, Old: &old})
+			continue
+		}
+		cur := rp.decided[k.pid][k.nth]
+		changed := false
+		if old.Cpu != cur.Cpu {
+			diff.CpuChanged++
+			changed = true
+		}
+		if old.SliceNs != cur.SliceNs {
+			diff.SliceChanged++
+			changed = true
+		}
+		if old.Vtime != cur.Vtime {
+			diff.VtimeChanged++
+			changed = true
+		}
+		if changed {
+			addMismatch(Mismatch{Pid: k.pid, Nth: k.nth, Old: &old, New: &cur})
+		}
+	}
+	for _, k := range rp.newOrder {
+		if k.nth >= len(rp.recorded[k.pid]) {
+			cur := rp.decided[k.pid][k.nth]
+			diff.Extra++
+			addMismatch(Mismatch{Pid: k.pid, Nth: k.nth, New: &cur})
+		}
+	}
+}
+
+// DequeueTask hands out the next recorded task, or sets task.Pid to -1.
+func (rp *Replayer) DequeueTask(task *models.QueuedTask) {
+	if len(rp.pending) == 0 {
+		task.Pid = -1
+		return
+	}
+	*task = rp.pending[0]
+	rp.pending = rp.pending[1:]
+}
+
+// ReadyForDequeue reports whether recorded tasks are waiting.
+func (rp *Replayer) ReadyForDequeue() bool {
+	return len(rp.pending) > 0
+}
+
+// BlockTilReadyForDequeue never blocks during a replay.
+func (rp *Replayer) BlockTilReadyForDequeue(ctx context.Context) {}
+
+// DefaultSelectCPU returns the CPU picked in the recording for the same
+// dispatch of this task, since the idle state of the machine is not part of
+// the trace; RL_CPU_ANY is returned when there is no such decision.
+func (rp *Replayer) DefaultSelectCPU(t *models.QueuedTask) (error, int32) {
+	nth := len(rp.decided[t.Pid])
+	if rec := rp.recorded[t.Pid]; nth < len(rec) {
+		return nil, rec[nth].Cpu
+	}
+	return nil, dataplane.RL_CPU_ANY
+}
+
+// SelectCPU is the same as DefaultSelectCPU.
+func (rp *Replayer) SelectCPU(t *models.QueuedTask) (error, int32) {
+	return rp.DefaultSelectCPU(t)
+}
+
+// DispatchTask collects a decision of the replayed policy.
+func (rp *Replayer) DispatchTask(t *dataplane.DispatchedTask) error {
+	rp.newOrder = append(rp.newOrder, decisionKey{t.Pid, len(rp.decided[t.Pid])})
+	rp.decided[t.Pid] = append(rp.decided[t.Pid], *t)
+	rp.release()
+	return nil
+}
+
+// PreemptCpu is a no-op: preemptions are not part of the trace.
+func (rp *Replayer) PreemptCpu(cpuId int32) error {
+	return nil
+}
+
+// CPUOccupancy reports every CPU as idle: the CPU occupancy is not part of
+// the trace.
+func (rp *Replayer) CPUOccupancy() ([]dataplane.RunningTask, error) {
+	return nil, nil
+}
+
+// PreemptCpuFor is a no-op: the CPU occupancy is not part of the trace.
+func (rp *Replayer) PreemptCpuFor(cpuId int32, pid int32) (dataplane.PreemptResult, error) {
+	return dataplane.PreemptIdle, nil
+}
+
+// NotifyComplete records the number of tasks still held by the policy.
+func (rp *Replayer) NotifyComplete(nrPending uint64) error {
+	rp.nrScheduled = nrPending
+	return nil
+}
+
+// GetNrQueued returns the number of released tasks not handed out yet.
+func (rp *Replayer) GetNrQueued() uint64 {
+	return uint64(len(rp.pending))
+}
+
+// GetNrScheduled returns the value last passed to NotifyComplete.
+func (rp *Replayer) GetNrScheduled() uint64 {
+	return rp.nrScheduled
+}
@@ -0,0 +1,494 @@
+// Package sim is a deterministic user-space model of the goland BPF backend.
+//
+// A Sim exposes the same data-plane methods as core.Sched (DequeueTask,
+// SelectCPU, DispatchTask, NotifyComplete, GetNrQueued, ...) but runs a
+// workload Trace on synthetic CPUs driven by a virtual clock, so policies can
+// be unit-tested and benchmarked without sched_ext, BPF or root privileges.
+package sim
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+const (
+	defaultSliceNs = 20 * 1000 * 1000 // SCX_SLICE_DFL
+	scxEnqWakeup   = 1                // SCX_ENQ_WAKEUP
+)
+
+var (
+	ErrStalled   = errors.New("sim: runnable tasks are never dispatched")
+	ErrTimeLimit = errors.New("sim: time limit exceeded")
+)
+
+type taskState int
+
+const (
+	stateSleeping   taskState = iota // waiting for its next arrival / wakeup
+	stateQueued                      // sent to user space, not dequeued yet
+	stateScheduled                   // dequeued by the policy
+	stateDispatched                  // sitting in a DSQ
+	stateRunning
+	stateDone
+)
+
+type task struct {
+	spec      TaskSpec
+	state     taskState
+	burst     int    // index of the current burst
+	remaining uint64 // runtime left in the current burst
+	wakeAt    uint64
+	cpu       int32
+	flags     uint64
+
+	// Mirror of the BPF task_ctx / p->scx fields.
+	startTs     uint64
+	stopTs      uint64
+	execRuntime uint64
+	vtime       uint64
+	sliceLeft   uint64
+
+	runnableAt uint64
+	stats      TaskStats
+}
+
+type dsqEntry struct {
+	t     *task
+	vtime uint64
+	slice uint64
+	seq   uint64
+}
+
+type cpu struct {
+	cur      *task
+	dsq      []dsqEntry
+	reserved bool // picked by SelectCPU and not used yet
+}
+
+// TaskStats summarizes how a task has been treated by the policy.
+type TaskStats struct {
+	Runs        int    // number of times the task got a CPU
+	WaitTotalNs uint64 // total time spent runnable but not running
+	WaitMaxNs   uint64 // worst runnable-to-running latency
+	RuntimeNs   uint64 // total CPU time consumed
+	DoneAtNs    uint64 // completion time of the last burst, 0 if still alive
+}
+
+// Stats summarizes a simulation run.
+type Stats struct {
+	NowNs            uint64
+	NrDispatches     uint64
+	NrSharedDispatch uint64 // tasks dispatched with RL_CPU_ANY
+	NrBounces        uint64 // tasks dispatched to an invalid CPU
+	NrStale          uint64 // dispatches of tasks not owned by the policy
+	NrSchedulerRuns  uint64 // invocations of the schedule callback
+	NrPreemptions    uint64 // running tasks stopped by PreemptCpu
+	Tasks            map[int32]TaskStats
+}
+
+// Sim is a synthetic sched_ext backend.
+type Sim struct {
+	now          uint64
+	limit        uint64
+	defaultSlice uint64
+	cpus         []cpu
+	shared       []dsqEntry
+	seq          uint64
+	tasks        []*task
+	byPid        map[int32]*task
+	queued       []*task
+	nrScheduled  uint64
+	stats        Stats
+}
+
+var _ dataplane.Scheduler = (*Sim)(nil)
+
+// New creates a simulator for the given trace; the clock starts at 0.
+func New(tr *Trace) (*Sim, error) {
+	if err := tr.validate(); err != nil {
+		return nil, err
+	}
+	s := &Sim{
+		defaultSlice: tr.DefaultSliceNs,
+		cpus:         make([]cpu, tr.NrCPUs),
+		byPid:        make(map[int32]*task, len(tr.Tasks)),
+	}
+	for i, spec := range tr.Tasks {
+		t := &task{
+			spec:      spec,
+			state:     stateSleeping,
+			remaining: spec.BurstsNs[0],
+			wakeAt:    spec.ArrivalNs,
+			cpu:       int32(i % tr.NrCPUs),
+		}
+		s.tasks = append(s.tasks, t)
+		s.byPid[spec.Pid] = t
+	}
+	return s, nil
+}
+
+// SetTimeLimit stops Run with ErrTimeLimit once the clock passes ns (0 means
+// no limit).
+func (s *Sim) SetTimeLimit(ns uint64) {
+	s.limit = ns
+}
+
+// Now returns the current virtual time in nanoseconds.
+func (s *Sim) Now() uint64 {
+	return s.now
+}
+
+// NrCPUs returns the number of simulated CPUs.
+func (s *Sim) NrCPUs() int {
+	return len(s.cpus)
+}
+
+// Run executes the trace to completion. schedule is invoked every time the
+// BPF side would wake up the user-space scheduler and is expected to drain,
+// select and dispatch tasks using the methods of s.
+func (s *Sim) Run(schedule func()) (Stats, error) {
+	for {
+		s.wakeTasks()
+		if s.pending() {
+			s.stats.NrSchedulerRuns++
+			schedule()
+		}
+		s.fillCPUs()
+
+		next, ok := s.nextEvent()
+		if !ok {
+			if s.alive() {
+				return s.Stats(), ErrStalled
+			}
+			return s.Stats(), nil
+		}
+		if s.limit != 0 && next > s.limit {
+			return s.Stats(), ErrTimeLimit
+		}
+		s.advance(next)
+	}
+}
+
+// Stats returns a snapshot of the simulation counters.
+func (s *Sim) Stats() Stats {
+	st := s.stats
+	st.NowNs = s.now
+	st.Tasks = make(map[int32]TaskStats, len(s.tasks))
+	for _, t := range s.tasks {
+		st.Tasks[t.spec.Pid] = t.stats
+	}
+	return st
+}
+
+func (s *Sim) pending() bool {
+	return len(s.queued) > 0 || s.nrScheduled > 0
+}
+
+func (s *Sim) alive() bool {
+	for _, t := range s.tasks {
+		if t.state != stateDone {
+			return true
+		}
+	}
+	return false
+}
+
+// wakeTasks sends the tasks whose wakeup time has come to user space.
+func (s *Sim) wakeTasks() {
+	for _, t := range s.tasks {
+		if t.state == stateSleeping && t.wakeAt <= s.now {
+			t.execRuntime = 0 // ops.runnable()
+			s.enqueue(t, scxEnqWakeup)
+		}
+	}
+}
+
+func (s *Sim) enqueue(t *task, flags uint64) {
+	t.state = stateQueued
+	t.flags = flags
+	t.runnableAt = s.now
+	s.queued = append(s.queued, t)
+}
+
+// fillCPUs lets every idle CPU consume its own DSQ first, then the shared one.
+func (s *Sim) fillCPUs() {
+	for i := range s.cpus {
+		c := &s.cpus[i]
+		c.reserved = false
+		if c.cur != nil {
+			continue
+		}
+		var e dsqEntry
+		switch {
+		case len(c.dsq) > 0:
+			e, c.dsq = c.dsq[0], c.dsq[1:]
+		case len(s.shared) > 0:
+			e, s.shared = s.shared[0], s.shared[1:]
+		default:
+			continue
+		}
+		s.run(int32(i), e)
+	}
+}
+
+func (s *Sim) run(cpuId int32, e dsqEntry) {
+	t := e.t
+	wait := s.now - t.runnableAt
+	t.stats.Runs++
+	t.stats.WaitTotalNs += wait
+	t.stats.WaitMaxNs = max(t.stats.WaitMaxNs, wait)
+	t.state = stateRunning
+	t.cpu = cpuId
+	t.vtime = e.vtime
+	t.sliceLeft = e.slice
+	t.startTs = s.now
+	s.cpus[cpuId].cur = t
+}
+
+func (s *Sim) nextEvent() (uint64, bool) {
+	var next uint64
+	found := false
+	consider := func(ts uint64) {
+		if !found || ts < next {
+			next, found = ts, true
+		}
+	}
+	for i := range s.cpus {
+		if t := s.cpus[i].cur; t != nil {
+			consider(s.now + min(t.sliceLeft, t.remaining))
+		}
+	}
+	for _, t := range s.tasks {
+		if t.state == stateSleeping {
+			consider(max(t.wakeAt, s.now))
+		}
+	}
+	return next, found
+}
+
+func (s *Sim) advance(to uint64) {
+	ran := to - s.now
+	s.now = to
+	for i := range s.cpus {
+		c := &s.cpus[i]
+		t := c.cur
+		if t == nil {
+			continue
+		}
+		t.remaining -= ran
+		t.sliceLeft -= ran
+		t.execRuntime += ran
+		t.stats.RuntimeNs += ran
+
+		switch {
+		case t.remaining == 0:
+			s.stop(c, t)
+			t.burst++
+			if t.burst < len(t.spec.BurstsNs) {
+				t.remaining = t.spec.BurstsNs[t.burst]
+				t.state = stateSleeping
+				t.wakeAt = s.now + t.spec.SleepNs
+			} else {
+				t.state = stateDone
+				t.stats.DoneAtNs = s.now
+			}
+		case t.sliceLeft == 0:
+			// Same as goland_dispatch(): if nobody else wants the CPU
+			// simply replenish the slice of the running task.
+			if len(c.dsq) == 0 && len(s.shared) == 0 && !s.pending() {
+				t.sliceLeft = s.defaultSlice
+				continue
+			}
+			s.stop(c, t)
+			s.enqueue(t, 0)
+		}
+	}
+}
+
+func (s *Sim) stop(c *cpu, t *task) {
+	t.stopTs = s.now
+	c.cur = nil
+}
+
+// DequeueTask pops the oldest task sent to user space, or sets task.Pid to -1
+// when there is none.
+func (s *Sim) DequeueTask(task *models.QueuedTask) {
+	if len(s.queued) == 0 {
+		task.Pid = -1
+		return
+	}
+	t := s.queued[0]
+	s.queued = s.queued[1:]
+	t.state = stateScheduled
+	*task = models.QueuedTask{
+		Pid:            t.spec.Pid,
+		Cpu:            t.cpu,
+		NrCpusAllowed:  uint64(len(s.cpus)),
+		Flags:          t.flags,
+		StartTs:        t.startTs,
+		StopTs:         t.stopTs,
+		SumExecRuntime: t.execRuntime,
+		Weight:         t.spec.Weight,
+		Vtime:          t.vtime,
+		Tgid:           t.spec.Tgid,
+	}
+}
+
+// ReadyForDequeue reports whether DequeueTask would return a task.
+func (s *Sim) ReadyForDequeue() bool {
+	return len(s.queued) > 0
+}
+
+// BlockTilReadyForDequeue never blocks: time only advances between two
+// invocations of the schedule callback.
+func (s *Sim) BlockTilReadyForDequeue(ctx context.Context) {}
+
+// DefaultSelectCPU mimics pick_idle_cpu(): keep the previous CPU if it is
+// idle, otherwise use the first idle CPU, otherwise RL_CPU_ANY.
+func (s *Sim) DefaultSelectCPU(t *models.QueuedTask) (error, int32) {
+	if t.Cpu >= 0 && int(t.Cpu) < len(s.cpus) && s.idle(t.Cpu) {
+		s.cpus[t.Cpu].reserved = true
+		return nil, t.Cpu
+	}
+	for i := range s.cpus {
+		if s.idle(int32(i)) {
+			s.cpus[i].reserved = true
+			return nil, int32(i)
+		}
+	}
+	return nil, dataplane.RL_CPU_ANY
+}
+
+// SelectCPU is the same as DefaultSelectCPU.
+func (s *Sim) SelectCPU(t *models.QueuedTask) (error, int32) {
+	return s.DefaultSelectCPU(t)
+}
+
+func (s *Sim) idle(cpuId int32) bool {
+	c := &s.cpus[cpuId]
+	return c.cur == nil && len(c.dsq) == 0 && !c.reserved
+}
+
+// DispatchTask inserts a task into the DSQ of its target CPU (or the shared
+// DSQ) ordered by vtime, like scx_bpf_dsq_insert_vtime().
+func (s *Sim) DispatchTask(d *dataplane.DispatchedTask) error {
+	t, ok := s.byPid[d.Pid]
+	if !ok {
+		return fmt.Errorf("sim: unknown pid %d", d.Pid)
+	}
+	if t.state != stateScheduled {
+		// The BPF side silently drops stale dispatches as well.
+		s.stats.NrStale++
+		return nil
+	}
+	slice := d.SliceNs
+	if slice == 0 {
+		slice = s.defaultSlice
+	}
+	s.seq++
+	e := dsqEntry{t: t, vtime: d.Vtime, slice: slice, seq: s.seq}
+	t.state = stateDispatched
+	s.stats.NrDispatches++
+
+	switch {
+	case d.Cpu == dataplane.RL_CPU_ANY:
+		s.stats.NrSharedDispatch++
+		s.shared = insertVtime(s.shared, e)
+	case d.Cpu < 0 || int(d.Cpu) >= len(s.cpus):
+		s.stats.NrBounces++
+		s.shared = insertVtime(s.shared, e)
+	default:
+		c := &s.cpus[d.Cpu]
+		c.dsq = insertVtime(c.dsq, e)
+	}
+	return nil
+}
+
+func insertVtime(q []dsqEntry, e dsqEntry) []dsqEntry {
+	i := sort.Search(len(q), func(i int) bool {
+		if q[i].vtime != e.vtime {
+			return q[i].vtime > e.vtime
+		}
+		return q[i].seq > e.seq
+	})
+	q = append(q, dsqEntry{})
+	copy(q[i+1:], q[i:])
+	q[i] = e
+	return q
+}
+
+// PreemptCpu stops the task running on cpuId and sends it back to user
+// space, like SCX_KICK_PREEMPT.
+func (s *Sim) PreemptCpu(cpuId int32) error {
+	if cpuId < 0 || int(cpuId) >= len(s.cpus) {
+		return fmt.Errorf("sim: invalid cpu %d", cpuId)
+	}
+	c := &s.cpus[cpuId]
+	if t := c.cur; t != nil {
+		s.stop(c, t)
+		s.enqueue(t, 0)
+		s.stats.NrPreemptions++
+	}
+	return nil
+}
+
+// CPUOccupancy returns the tasks running on the simulated CPUs. The
+// simulator has no priority tasks.
+func (s *Sim) CPUOccupancy() ([]dataplane.RunningTask, error) {
+	var tasks []dataplane.RunningTask
+	for i := range s.cpus {
+		t := s.cpus[i].cur
+		if t == nil {
+			continue
+		}
+		tasks = append(tasks, dataplane.RunningTask{
+			Cpu:     int32(i),
+			Pid:     t.spec.Pid,
+			Tgid:    t.spec.Tgid,
+			StartTs: t.startTs,
+		})
+	}
+	return tasks, nil
+}
+
+// PreemptCpuFor preempts cpuId only if the weight of its running task is
+// lower than the weight of task pid.
+func (s *Sim) PreemptCpuFor(cpuId int32, pid int32) (dataplane.PreemptResult, error) {
+	if cpuId < 0 || int(cpuId) >= len(s.cpus) {
+		return dataplane.PreemptIdle, fmt.Errorf("sim: invalid cpu %d", cpuId)
+	}
+	t, ok := s.byPid[pid]
+	if !ok || t.state == stateDone {
+		return dataplane.PreemptNoTask, nil
+	}
+	cur := s.cpus[cpuId].cur
+	if cur == nil {
+		return dataplane.PreemptIdle, nil
+	}
+	if t.spec.Weight <= cur.spec.Weight {
+		return dataplane.PreemptNotLower, nil
+	}
+	return dataplane.PreemptKicked, s.PreemptCpu(cpuId)
+}
+
+// NotifyComplete records the number of tasks still held by the policy.
+func (s *Sim) NotifyComplete(nrPending uint64) error {
+	s.nrScheduled = nrPending
+	return nil
+}
+
+// GetNrQueued returns the number of tasks sent to user space and not yet
+// dequeued.
+func (s *Sim) GetNrQueued() uint64 {
+	return uint64(len(s.queued))
+}
+
+// GetNrScheduled returns the value last passed to NotifyComplete.
+func (s *Sim) GetNrScheduled() uint64 {
+	return s.nrScheduled
+}
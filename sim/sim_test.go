@@ -0,0 +1,208 @@
+package sim
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/Gthulhu/plugin/models"
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+const ms = 1000 * 1000
+
+// dispatchAll sends every queued task to cpu with the default slice.
+func dispatchAll(t *testing.T, s *Sim, cpu int32) func() {
+	return func() {
+		for {
+			var q models.QueuedTask
+			s.DequeueTask(&q)
+			if q.Pid == -1 {
+				return
+			}
+			d := dataplane.NewDispatchedTask(&q)
+			d.Cpu = cpu
+			if err := s.DispatchTask(d); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	s, err := New(&Trace{
+		NrCPUs: 2,
+		Tasks: []TaskSpec{
+			{Pid: 1, BurstsNs: []uint64{10 * ms, 10 * ms}, SleepNs: 5 * ms},
+			{Pid: 2, ArrivalNs: 3 * ms, BurstsNs: []uint64{4 * ms}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.Run(dispatchAll(t, s, dataplane.RL_CPU_ANY))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[int32]TaskStats{
+		1: {Runs: 2, RuntimeNs: 20 * ms, DoneAtNs: 25 * ms},
+		2: {Runs: 1, RuntimeNs: 4 * ms, DoneAtNs: 7 * ms},
+	}
+	for pid, w := range want {
+		if got := st.Tasks[pid]; got != w {
+			t.Errorf("pid %d: %+v, want %+v", pid, got, w)
+		}
+	}
+	if st.NowNs != 25*ms || st.NrDispatches != 3 || st.NrSharedDispatch != 3 {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+// A task whose slice expires while another one waits goes back to user
+// space, and waits behind it.
+func TestSliceExpiry(t *testing.T) {
+	s, err := New(&Trace{
+		NrCPUs:         1,
+		DefaultSliceNs: 2 * ms,
+		Tasks: []TaskSpec{
+			{Pid: 1, BurstsNs: []uint64{3 * ms}},
+			{Pid: 2, ArrivalNs: ms, BurstsNs: []uint64{3 * ms}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.Run(dispatchAll(t, s, 0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := st.Tasks[1]; r.Runs != 2 || r.DoneAtNs != 5*ms || r.WaitMaxNs != 2*ms {
+		t.Errorf("pid 1: %+v", r)
+	}
+	if r := st.Tasks[2]; r.Runs != 2 || r.DoneAtNs != 6*ms || r.WaitMaxNs != ms {
+		t.Errorf("pid 2: %+v", r)
+	}
+}
+
+func TestBounce(t *testing.T) {
+	s, err := New(&Trace{NrCPUs: 1, Tasks: []TaskSpec{{Pid: 1, BurstsNs: []uint64{ms}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, err := s.Run(dispatchAll(t, s, 5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.NrBounces != 1 || st.Tasks[1].DoneAtNs != ms {
+		t.Errorf("stats %+v", st)
+	}
+}
+
+func TestStalled(t *testing.T) {
+	s, err := New(&Trace{NrCPUs: 1, Tasks: []TaskSpec{{Pid: 1, BurstsNs: []uint64{ms}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.Run(func() {}); !errors.Is(err, ErrStalled) {
+		t.Errorf("Run: %v, want ErrStalled", err)
+	}
+}
+
+func TestTimeLimit(t *testing.T) {
+	s, err := New(&Trace{NrCPUs: 1, Tasks: []TaskSpec{{Pid: 1, BurstsNs: []uint64{10 * ms}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetTimeLimit(5 * ms)
+	if _, err := s.Run(dispatchAll(t, s, 0)); !errors.Is(err, ErrTimeLimit) {
+		t.Errorf("Run: %v, want ErrTimeLimit", err)
+	}
+}
+
+// Dispatching a task that is not held by the policy is ignored.
+func TestStaleDispatch(t *testing.T) {
+	s, err := New(&Trace{NrCPUs: 1, Tasks: []TaskSpec{{Pid: 1, BurstsNs: []uint64{ms}}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := dispatchAll(t, s, 0)
+	st, err := s.Run(func() {
+		dispatch()
+		if err := s.DispatchTask(&dataplane.DispatchedTask{Pid: 1}); err != nil {
+			t.Fatal(err)
+		}
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.NrStale != 1 || st.NrDispatches != 1 {
+		t.Errorf("stats %+v", st)
+	}
+	if err := s.DispatchTask(&dataplane.DispatchedTask{Pid: 42}); err == nil {
+		t.Error("dispatching an unknown pid succeeded")
+	}
+}
+
+func TestPreemptCpuFor(t *testing.T) {
+	s, err := New(&Trace{
+		NrCPUs: 1,
+		Tasks: []TaskSpec{
+			{Pid: 1, Weight: 100, BurstsNs: []uint64{10 * ms}},
+			{Pid: 2, Weight: 200, ArrivalNs: ms, BurstsNs: []uint64{ms}},
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := dispatchAll(t, s, 0)
+	var results []dataplane.PreemptResult
+	st, err := s.Run(func() {
+		if s.Now() == ms {
+			res, err := s.PreemptCpuFor(0, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			results = append(results, res)
+		}
+		dispatch()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0] != dataplane.PreemptKicked || st.NrPreemptions != 1 {
+		t.Errorf("results %v, stats %+v", results, st)
+	}
+	if res, _ := s.PreemptCpuFor(0, 2); res != dataplane.PreemptNoTask {
+		t.Errorf("PreemptCpuFor a done task: %v", res)
+	}
+}
+
+func TestLoadTrace(t *testing.T) {
+	tests := []struct {
+		json string
+		err  string
+	}{
+		{`{"nr_cpus": 2, "tasks": [{"pid": 1, "bursts_ns": [1000]}]}`, ""},
+		{`{"nr_cpus": 0}`, "nr_cpus"},
+		{`{"nr_cpus": 1, "tasks": [{"pid": 0, "bursts_ns": [1]}]}`, "pid must be positive"},
+		{`{"nr_cpus": 1, "tasks": [{"pid": 1, "bursts_ns": [1]}, {"pid": 1, "bursts_ns": [1]}]}`, "duplicated pid"},
+		{`{"nr_cpus": 1, "tasks": [{"pid": 1}]}`, "no bursts"},
+		{`{"nr_cpus": 1, "tasks": [{"pid": 1, "bursts_ns": [0]}]}`, "zero-length"},
+	}
+	for _, tt := range tests {
+		tr, err := LoadTrace(strings.NewReader(tt.json))
+		if tt.err == "" {
+			if err != nil {
+				t.Errorf("%s: %v", tt.json, err)
+				continue
+			}
+			if tr.DefaultSliceNs != defaultSliceNs || tr.Tasks[0].Weight != 100 || tr.Tasks[0].Tgid != 1 {
+				t.Errorf("%s: defaults not applied: %+v", tt.json, tr)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.err) {
+			t.Errorf("%s: error %v, want %q", tt.json, err, tt.err)
+		}
+	}
+}
@@ -0,0 +1,82 @@
+package sim
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+)
+
+// TaskSpec describes one synthetic task of a workload trace.
+//
+// The task becomes runnable at ArrivalNs, runs for BurstsNs[0], sleeps for
+// SleepNs, runs for BurstsNs[1] and so on until all the bursts are consumed.
+type TaskSpec struct {
+	Pid       int32    `json:"pid"`
+	Tgid      int32    `json:"tgid"`
+	Weight    uint64   `json:"weight"` // sched_ext weight, 100 for nice 0
+	ArrivalNs uint64   `json:"arrival_ns"`
+	BurstsNs  []uint64 `json:"bursts_ns"`
+	SleepNs   uint64   `json:"sleep_ns"`
+}
+
+// Trace is a workload replayed by the simulator.
+type Trace struct {
+	NrCPUs         int        `json:"nr_cpus"`
+	DefaultSliceNs uint64     `json:"default_slice_ns"` // slice used when a task is dispatched with SliceNs == 0
+	Tasks          []TaskSpec `json:"tasks"`
+}
+
+// LoadTrace decodes a JSON workload trace.
+func LoadTrace(r io.Reader) (*Trace, error) {
+	var tr Trace
+	if err := json.NewDecoder(r).Decode(&tr); err != nil {
+		return nil, err
+	}
+	return &tr, tr.validate()
+}
+
+// LoadTraceFile decodes the JSON workload trace stored at path.
+func LoadTraceFile(path string) (*Trace, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return LoadTrace(f)
+}
+
+func (tr *Trace) validate() error {
+	if tr.NrCPUs <= 0 {
+		return fmt.Errorf("nr_cpus must be positive, got %d", tr.NrCPUs)
+	}
+	if tr.DefaultSliceNs == 0 {
+		tr.DefaultSliceNs = defaultSliceNs
+	}
+	seen := make(map[int32]bool, len(tr.Tasks))
+	for i := range tr.Tasks {
+		t := &tr.Tasks[i]
+		if t.Pid <= 0 {
+			return fmt.Errorf("task %d: pid must be positive", i)
+		}
+		if seen[t.Pid] {
+			return fmt.Errorf("task %d: duplicated pid %d", i, t.Pid)
+		}
+		seen[t.Pid] = true
+		if t.Tgid == 0 {
+			t.Tgid = t.Pid
+		}
+		if t.Weight == 0 {
+			t.Weight = 100
+		}
+		if len(t.BurstsNs) == 0 {
+			return fmt.Errorf("task %d (pid %d): no bursts", i, t.Pid)
+		}
+		for _, b := range t.BurstsNs {
+			if b == 0 {
+				return fmt.Errorf("task %d (pid %d): zero-length burst", i, t.Pid)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,88 @@
+// Package tracing writes the structured task events of the BPF side (see
+// dataplane.TraceEvent) to a file, optionally filtered by pid or command: as
+// JSON lines, or as a Chrome JSON trace that Perfetto UI (ui.perfetto.dev)
+// and chrome://tracing can open. Like dataplane, it builds without cgo.
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+// Output formats.
+const (
+	FormatJSONL  = "jsonl"  // one JSON object per line
+	FormatChrome = "chrome" // Chrome trace event format, a timeline with one track per CPU
+)
+
+// Filter selects events by task. The zero Filter matches everything.
+type Filter struct {
+	Pids  []int32  // pids or tgids to keep, empty for all
+	Comms []string // commands to keep, empty for all
+}
+
+// Match reports whether ev passes the filter: when both lists are set, an
+// event matching either of them is kept. The activity of the scheduler
+// itself (user-space scheduler runs, dispatch batches) is always kept.
+func (f Filter) Match(ev dataplane.TraceEvent) bool {
+	if len(f.Pids) == 0 && len(f.Comms) == 0 {
+		return true
+	}
+	if ev.Kind == dataplane.TraceUserschedRun || ev.Kind == dataplane.TraceDispatchBatch {
+		return true
+	}
+	if slices.Contains(f.Pids, ev.Pid) || slices.Contains(f.Pids, ev.Tgid) {
+		return true
+	}
+	return slices.Contains(f.Comms, ev.Comm)
+}
+
+// Writer writes trace events to a file.
+type Writer interface {
+	WriteEvent(ev dataplane.TraceEvent) error
+	// Close completes the file (e.g. closes the Chrome JSON document)
+	// and closes it.
+	Close() error
+}
+
+// Create creates (or truncates) the trace file at path in format.
+func Create(path, format string) (Writer, error) {
+	switch format {
+	case FormatJSONL, FormatChrome:
+	default:
+		return nil, fmt.Errorf("unknown trace format %q", format)
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	if format == FormatChrome {
+		return NewChromeWriter(f), nil
+	}
+	return NewJSONLWriter(f), nil
+}
+
+// Run writes the events of ch that match f to w until ch is closed or ctx
+// is done. It does not close w.
+func Run(ctx context.Context, ch <-chan dataplane.TraceEvent, f Filter, w Writer) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case ev, ok := <-ch:
+			if !ok {
+				return nil
+			}
+			if !f.Match(ev) {
+				continue
+			}
+			if err := w.WriteEvent(ev); err != nil {
+				return err
+			}
+		}
+	}
+}
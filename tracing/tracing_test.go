@@ -0,0 +1,202 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+func TestFilterMatch(t *testing.T) {
+	task := dataplane.TraceEvent{Kind: dataplane.TraceRunning, Pid: 12, Tgid: 10, Comm: "worker"}
+	batch := dataplane.TraceEvent{Kind: dataplane.TraceDispatchBatch, Pid: 0}
+	tests := []struct {
+		name string
+		f    Filter
+		ev   dataplane.TraceEvent
+		want bool
+	}{
+		{"zero filter", Filter{}, task, true},
+		{"pid", Filter{Pids: []int32{12}}, task, true},
+		{"tgid", Filter{Pids: []int32{10}}, task, true},
+		{"other pid", Filter{Pids: []int32{11}}, task, false},
+		{"comm", Filter{Comms: []string{"worker"}}, task, true},
+		{"other comm", Filter{Comms: []string{"work"}}, task, false},
+		{"pid or comm", Filter{Pids: []int32{11}, Comms: []string{"worker"}}, task, true},
+		{"scheduler activity", Filter{Pids: []int32{11}}, batch, true},
+	}
+	for _, tt := range tests {
+		if got := tt.f.Match(tt.ev); got != tt.want {
+			t.Errorf("%s: Match %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+// closeBuffer records whether the writers close their output.
+type closeBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closeBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestJSONLWriter(t *testing.T) {
+	var buf closeBuffer
+	w := NewJSONLWriter(&buf)
+	events := []dataplane.TraceEvent{
+		{Ts: 1, Kind: dataplane.TraceEnqueue, Pid: 1, Tgid: 1, Cpu: 2, Arg: 3, Comm: "a"},
+		{Ts: 2, Kind: dataplane.TraceKind(99), Pid: 2, Cpu: -1},
+	}
+	for _, ev := range events {
+		if err := w.WriteEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil || !buf.closed {
+		t.Fatalf("Close: %v (closed %v)", err, buf.closed)
+	}
+	var kinds []string
+	sc := bufio.NewScanner(&buf.Buffer)
+	for sc.Scan() {
+		var ev struct {
+			Ts   uint64 `json:"ts"`
+			Kind string `json:"kind"`
+			Pid  int32  `json:"pid"`
+			Cpu  int32  `json:"cpu"`
+			Comm string `json:"comm"`
+		}
+		if err := json.Unmarshal(sc.Bytes(), &ev); err != nil {
+			t.Fatalf("line %q: %v", sc.Text(), err)
+		}
+		kinds = append(kinds, ev.Kind)
+	}
+	if len(kinds) != 2 || kinds[0] != "enqueue" || kinds[1] != "TraceKind(99)" {
+		t.Errorf("kinds %v", kinds)
+	}
+}
+
+// readChrome decodes a Chrome JSON trace.
+func readChrome(t *testing.T, b []byte) []chromeEvent {
+	t.Helper()
+	var doc struct {
+		TraceEvents []chromeEvent `json:"traceEvents"`
+	}
+	if err := json.Unmarshal(b, &doc); err != nil {
+		t.Fatalf("invalid trace %q: %v", b, err)
+	}
+	return doc.TraceEvents
+}
+
+func TestChromeWriterEmpty(t *testing.T) {
+	var buf closeBuffer
+	if err := NewChromeWriter(&buf).Close(); err != nil || !buf.closed {
+		t.Fatalf("Close: %v (closed %v)", err, buf.closed)
+	}
+	if evs := readChrome(t, buf.Bytes()); len(evs) != 0 {
+		t.Errorf("events %+v", evs)
+	}
+}
+
+func TestChromeWriter(t *testing.T) {
+	var buf closeBuffer
+	w := NewChromeWriter(&buf)
+	events := []dataplane.TraceEvent{
+		{Ts: 1000, Kind: dataplane.TraceWakeup, Pid: 7, Cpu: 0, Comm: "t"},
+		// The wakeup time is read just before the wakeup event is sent.
+		{Ts: 1500, Kind: dataplane.TraceRunning, Pid: 7, Cpu: 1, Arg: 990, Comm: "t"},
+		{Ts: 4000, Kind: dataplane.TraceStopping, Pid: 7, Cpu: 1, Arg: 1500, Comm: "t"},
+		{Ts: 5000, Kind: dataplane.TraceUserschedRun, Pid: 1, Cpu: 0, Arg: 4500, Comm: "qumun"},
+		{Ts: 6000, Kind: dataplane.TraceDispatchBatch, Cpu: 0, Arg: 3<<32 | 200},
+		{Ts: 7000, Kind: dataplane.TraceDispatch, Pid: 8, Cpu: -1, Arg: 5000, Comm: "u"},
+		// A running event without a matching wakeup has no arrow.
+		{Ts: 8000, Kind: dataplane.TraceRunning, Pid: 8, Cpu: 1, Arg: 7000, Comm: "u"},
+		// Nor does one whose wakeup event was sampled out, after an older
+		// wakeup of the same task.
+		{Ts: 8100, Kind: dataplane.TraceWakeup, Pid: 9, Cpu: 0, Comm: "v"},
+		{Ts: 9500, Kind: dataplane.TraceRunning, Pid: 9, Cpu: 1, Arg: 9000, Comm: "v"},
+	}
+	for _, ev := range events {
+		if err := w.WriteEvent(ev); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	tracks := map[int]string{}
+	var got []chromeEvent
+	for _, ev := range readChrome(t, buf.Bytes()) {
+		if ev.Ph == "M" {
+			tracks[ev.Tid] = ev.Args["name"].(string)
+			continue
+		}
+		got = append(got, ev)
+	}
+	if len(tracks) != 3 || tracks[0] != "CPU 0" || tracks[1] != "CPU 1" || tracks[anyCpuTrack] != "any CPU" {
+		t.Errorf("tracks %v", tracks)
+	}
+	want := []struct {
+		name, ph string
+		ts, dur  float64
+		tid      int
+	}{
+		{"wakeup", "i", 1, 0, 0},
+		{"wakeup", "s", 1, 0, 0},
+		{"wakeup", "f", 1.5, 0, 1},
+		{"t", "X", 1.5, 2.5, 1},
+		{"usersched", "X", 4.5, 0.5, 0},
+		{"dispatch batch", "X", 5.8, 0.2, 0},
+		{"dispatch", "i", 7, 0, anyCpuTrack},
+		{"wakeup", "i", 8.1, 0, 0},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("events %+v", got)
+	}
+	for i, w := range want {
+		ev := got[i]
+		if ev.Name != w.name || ev.Ph != w.ph || ev.Ts != w.ts || ev.Dur != w.dur || ev.Tid != w.tid {
+			t.Errorf("event %d: %+v, want %+v", i, ev, w)
+		}
+	}
+	if got[1].ID == 0 || got[1].ID != got[2].ID {
+		t.Errorf("flow ids %d %d", got[1].ID, got[2].ID)
+	}
+	if lat := got[3].Args["wakeup_latency_ns"]; lat != float64(510) {
+		t.Errorf("wakeup latency %v", lat)
+	}
+	if nr := got[5].Args["tasks"]; nr != float64(3) {
+		t.Errorf("batch of %v tasks", nr)
+	}
+}
+
+func TestRun(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	if _, err := Create(path, "xml"); err == nil {
+		t.Error("Create with an unknown format succeeded")
+	}
+	w, err := Create(path, FormatChrome)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ch := make(chan dataplane.TraceEvent, 2)
+	ch <- dataplane.TraceEvent{Kind: dataplane.TraceEnqueue, Pid: 1}
+	ch <- dataplane.TraceEvent{Kind: dataplane.TraceEnqueue, Pid: 2}
+	close(ch)
+	if err := Run(context.Background(), ch, Filter{Pids: []int32{2}}, w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if n := w.(*ChromeWriter).n; n != 2 { // track name and the event of pid 2
+		t.Errorf("%d events written, want 2", n)
+	}
+}
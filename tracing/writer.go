@@ -0,0 +1,244 @@
+package tracing
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/Gthulhu/qumun/goland_core/dataplane"
+)
+
+type bufWriter struct {
+	w *bufio.Writer
+	c io.Closer
+}
+
+func newBufWriter(w io.Writer) bufWriter {
+	bw := bufWriter{w: bufio.NewWriter(w)}
+	if c, ok := w.(io.Closer); ok {
+		bw.c = c
+	}
+	return bw
+}
+
+func (b bufWriter) close() error {
+	err := b.w.Flush()
+	if b.c != nil {
+		if cerr := b.c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// JSONLWriter writes one JSON object per event.
+type JSONLWriter struct {
+	bw  bufWriter
+	enc *json.Encoder
+}
+
+// NewJSONLWriter returns a JSONLWriter writing to w. w is closed by Close
+// if it is an io.Closer.
+func NewJSONLWriter(w io.Writer) *JSONLWriter {
+	bw := newBufWriter(w)
+	return &JSONLWriter{bw: bw, enc: json.NewEncoder(bw.w)}
+}
+
+func (j *JSONLWriter) WriteEvent(ev dataplane.TraceEvent) error {
+	return j.enc.Encode(ev)
+}
+
+func (j *JSONLWriter) Close() error {
+	return j.bw.close()
+}
+
+// anyCpuTrack is the track of the events not bound to a CPU (Cpu -1).
+const anyCpuTrack = 1 << 20
+
+// chromeEvent is an event of the Chrome trace event format.
+type chromeEvent struct {
+	Name  string         `json:"name"`
+	Cat   string         `json:"cat,omitempty"`
+	Ph    string         `json:"ph"`
+	Ts    float64        `json:"ts"`            // µs
+	Dur   float64        `json:"dur,omitempty"` // µs, complete events
+	Pid   int            `json:"pid"`
+	Tid   int            `json:"tid"`
+	ID    uint64         `json:"id,omitempty"` // flow events
+	Bp    string         `json:"bp,omitempty"` // flow events
+	Scope string         `json:"s,omitempty"`
+	Args  map[string]any `json:"args,omitempty"`
+}
+
+// us converts a timestamp or duration from ns to µs.
+func us(ns uint64) float64 {
+	return float64(ns) / 1e3
+}
+
+// wakeup is the last wakeup event of a task.
+type wakeup struct {
+	ts  uint64
+	tid int
+}
+
+// ChromeWriter writes a Chrome JSON trace with one track per CPU: the tasks
+// and the user-space scheduler run as slices, with an arrow from each wakeup
+// to the slice it led to, and the batches of tasks dispatched from user
+// space are slices between them. The other task events are instant events.
+//
+// Arrows and wakeup latencies need both the wakeup and the running events of
+// a task, which sampling makes unlikely: leave the sample rate at 1 for a
+// complete timeline.
+type ChromeWriter struct {
+	bw      bufWriter
+	enc     *json.Encoder
+	n       int
+	tracks  map[int]bool
+	wakeups map[int32]wakeup // pending wakeup of each pid
+	latency map[int32]uint64 // wakeup latency (ns) of each running pid
+	flows   uint64           // last flow id
+}
+
+// NewChromeWriter returns a ChromeWriter writing to w. w is closed by Close
+// if it is an io.Closer.
+func NewChromeWriter(w io.Writer) *ChromeWriter {
+	bw := newBufWriter(w)
+	return &ChromeWriter{
+		bw:      bw,
+		enc:     json.NewEncoder(bw.w),
+		tracks:  map[int]bool{},
+		wakeups: map[int32]wakeup{},
+		latency: map[int32]uint64{},
+	}
+}
+
+func (c *ChromeWriter) write(ev chromeEvent) error {
+	sep := ","
+	if c.n == 0 {
+		sep = "{\"displayTimeUnit\":\"ns\",\"traceEvents\":[\n"
+	}
+	c.n++
+	if _, err := c.bw.w.WriteString(sep); err != nil {
+		return err
+	}
+	// Encode appends a newline, which is valid JSON whitespace.
+	return c.enc.Encode(ev)
+}
+
+// track returns the tid of the track of cpu, naming it on first use.
+func (c *ChromeWriter) track(cpu int32) (int, error) {
+	tid, name := int(cpu), fmt.Sprintf("CPU %d", cpu)
+	if cpu < 0 {
+		tid, name = anyCpuTrack, "any CPU"
+	}
+	if !c.tracks[tid] {
+		c.tracks[tid] = true
+		err := c.write(chromeEvent{Name: "thread_name", Ph: "M", Tid: tid, Args: map[string]any{"name": name}})
+		if err != nil {
+			return 0, err
+		}
+	}
+	return tid, nil
+}
+
+func taskArgs(ev dataplane.TraceEvent) map[string]any {
+	return map[string]any{
+		"pid":  ev.Pid,
+		"tgid": ev.Tgid,
+		"comm": ev.Comm,
+	}
+}
+
+func (c *ChromeWriter) WriteEvent(ev dataplane.TraceEvent) error {
+	tid, err := c.track(ev.Cpu)
+	if err != nil {
+		return err
+	}
+	switch ev.Kind {
+	case dataplane.TraceWakeup:
+		c.wakeups[ev.Pid] = wakeup{ev.Ts, tid}
+	case dataplane.TraceRunning:
+		w, ok := c.wakeups[ev.Pid]
+		delete(c.wakeups, ev.Pid)
+		delete(c.latency, ev.Pid)
+		// Arg is the wakeup time recorded by the BPF side just before
+		// sending the wakeup event, with another clock read: the wakeup
+		// event of this run is the one sent at or after it. An older one
+		// belongs to a previous sleep whose running event was sampled out.
+		if !ok || ev.Arg == 0 || w.ts < ev.Arg || ev.Ts < w.ts {
+			return nil
+		}
+		c.latency[ev.Pid] = ev.Ts - ev.Arg
+		// The arrow goes from the slice running at the wakeup on the
+		// waker CPU to the slice starting now.
+		c.flows++
+		err := c.write(chromeEvent{Name: "wakeup", Cat: "wakeup", Ph: "s", Ts: us(w.ts), Tid: w.tid, ID: c.flows})
+		if err != nil {
+			return err
+		}
+		return c.write(chromeEvent{Name: "wakeup", Cat: "wakeup", Ph: "f", Bp: "e", Ts: us(ev.Ts), Tid: tid, ID: c.flows})
+	case dataplane.TraceStopping:
+		if ev.Arg == 0 || ev.Arg > ev.Ts {
+			return nil
+		}
+		args := taskArgs(ev)
+		if lat, ok := c.latency[ev.Pid]; ok {
+			args["wakeup_latency_ns"] = lat
+			delete(c.latency, ev.Pid)
+		}
+		return c.write(chromeEvent{
+			Name: ev.Comm,
+			Cat:  "task",
+			Ph:   "X",
+			Ts:   us(ev.Arg),
+			Dur:  us(ev.Ts - ev.Arg),
+			Tid:  tid,
+			Args: args,
+		})
+	case dataplane.TraceUserschedRun:
+		if ev.Arg == 0 || ev.Arg > ev.Ts {
+			return nil
+		}
+		return c.write(chromeEvent{
+			Name: "usersched",
+			Cat:  "usersched",
+			Ph:   "X",
+			Ts:   us(ev.Arg),
+			Dur:  us(ev.Ts - ev.Arg),
+			Tid:  tid,
+			Args: taskArgs(ev),
+		})
+	case dataplane.TraceDispatchBatch:
+		nr, dur := ev.Batch()
+		return c.write(chromeEvent{
+			Name: "dispatch batch",
+			Cat:  "dispatch",
+			Ph:   "X",
+			Ts:   us(ev.Ts - dur),
+			Dur:  us(dur),
+			Tid:  tid,
+			Args: map[string]any{"tasks": nr},
+		})
+	}
+	args := taskArgs(ev)
+	args["arg"] = ev.Arg
+	return c.write(chromeEvent{
+		Name:  ev.Kind.String(),
+		Cat:   "task",
+		Ph:    "i",
+		Scope: "t",
+		Ts:    us(ev.Ts),
+		Tid:   tid,
+		Args:  args,
+	})
+}
+
+// Close terminates the JSON document and closes the file.
+func (c *ChromeWriter) Close() error {
+	if c.n == 0 {
+		c.bw.w.WriteString("{\"traceEvents\":[")
+	}
+	c.bw.w.WriteString("]}\n")
+	return c.bw.close()
+}
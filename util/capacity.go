@@ -0,0 +1,188 @@
+package util
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	core "github.com/Gthulhu/qumun/goland_core"
+)
+
+// CoreType is the kind of a CPU on hybrid systems.
+type CoreType int
+
+const (
+	CoreTypeUnknown     CoreType = iota
+	CoreTypePerformance          // Intel P-core, ARM big core
+	CoreTypeEfficiency           // Intel E-core, ARM LITTLE core
+)
+
+func (c CoreType) String() string {
+	switch c {
+	case CoreTypePerformance:
+		return "performance"
+	case CoreTypeEfficiency:
+		return "efficiency"
+	}
+	return "unknown"
+}
+
+func (c CoreType) MarshalText() ([]byte, error) {
+	return []byte(c.String()), nil
+}
+
+// CPUCapacity describes the compute capacity of a CPU.
+type CPUCapacity struct {
+	Cpu        int      `json:"cpu"`
+	Capacity   uint32   `json:"capacity"`     // 0 - core.MaxCpuCapacity
+	MaxFreqKHz uint64   `json:"max_freq_khz"` // 0 if cpufreq is not available
+	CoreType   CoreType `json:"core_type"`
+}
+
+// GetCPUCapacities returns the capacity of every CPU, sorted by CPU.
+//
+// The capacity is read from cpu_capacity when the kernel exposes it (ARM,
+// recent x86 hybrid kernels), otherwise it is derived from the cpufreq
+// maximum frequency relative to the fastest CPU. The core type comes from
+// the cpu_core / cpu_atom PMUs on Intel hybrid systems, otherwise from the
+// capacity when CPUs are asymmetric.
+func GetCPUCapacities() ([]CPUCapacity, error) {
+	return getCPUCapacities("/sys/devices/system/cpu/", "/sys/devices/")
+}
+
+func getCPUCapacities(cpuDir, devDir string) ([]CPUCapacity, error) {
+	cpus, err := readCPUList(filepath.Join(cpuDir, "possible"))
+	if err != nil {
+		return nil, err
+	}
+	pCores, _ := readCPUList(filepath.Join(devDir, "cpu_core", "cpus"))
+	eCores, _ := readCPUList(filepath.Join(devDir, "cpu_atom", "cpus"))
+	coreType := map[int]CoreType{}
+	for _, cpu := range pCores {
+		coreType[cpu] = CoreTypePerformance
+	}
+	for _, cpu := range eCores {
+		coreType[cpu] = CoreTypeEfficiency
+	}
+
+	caps := make([]CPUCapacity, 0, len(cpus))
+	var maxFreq uint64
+	haveCapacity := true
+	for _, cpu := range cpus {
+		c := CPUCapacity{Cpu: cpu, CoreType: coreType[cpu]}
+		base := filepath.Join(cpuDir, fmt.Sprintf("cpu%d", cpu))
+		if v, err := readUint(filepath.Join(base, "cpu_capacity")); err == nil {
+			c.Capacity = uint32(v)
+		} else {
+			haveCapacity = false
+		}
+		if v, err := readUint(filepath.Join(base, "cpufreq", "cpuinfo_max_freq")); err == nil {
+			c.MaxFreqKHz = v
+			maxFreq = max(maxFreq, v)
+		}
+		caps = append(caps, c)
+	}
+
+	for i := range caps {
+		c := &caps[i]
+		if !haveCapacity {
+			c.Capacity = core.MaxCpuCapacity
+			if maxFreq > 0 && c.MaxFreqKHz > 0 {
+				c.Capacity = uint32(c.MaxFreqKHz * core.MaxCpuCapacity / maxFreq)
+			}
+		}
+	}
+	if IsAsymmetric(caps) {
+		perf := performanceCapacity(caps)
+		for i := range caps {
+			c := &caps[i]
+			if c.CoreType != CoreTypeUnknown {
+				continue
+			}
+			if c.Capacity >= perf {
+				c.CoreType = CoreTypePerformance
+			} else {
+				c.CoreType = CoreTypeEfficiency
+			}
+		}
+	}
+	return caps, nil
+}
+
+// IsAsymmetric reports whether the CPUs do not all have the same capacity.
+func IsAsymmetric(caps []CPUCapacity) bool {
+	for _, c := range caps {
+		if c.Capacity != caps[0].Capacity {
+			return true
+		}
+	}
+	return false
+}
+
+// PerformanceCPUs returns the CPUs of the highest capacity class (see
+// core.PerformanceCapacity); all of them on symmetric systems.
+func PerformanceCPUs(caps []CPUCapacity) []int {
+	perf := performanceCapacity(caps)
+	var cpus []int
+	for _, c := range caps {
+		if c.Capacity >= perf {
+			cpus = append(cpus, c.Cpu)
+		}
+	}
+	return cpus
+}
+
+// EfficiencyCPUs returns the CPUs below the highest capacity class; it is
+// empty on symmetric systems.
+func EfficiencyCPUs(caps []CPUCapacity) []int {
+	perf := performanceCapacity(caps)
+	var cpus []int
+	for _, c := range caps {
+		if c.Capacity < perf {
+			cpus = append(cpus, c.Cpu)
+		}
+	}
+	return cpus
+}
+
+func performanceCapacity(caps []CPUCapacity) uint32 {
+	values := make([]uint32, len(caps))
+	for i, c := range caps {
+		values[i] = c.Capacity
+	}
+	return core.PerformanceCapacity(values)
+}
+
+// InitCpuCapacity publishes the capacity of every CPU to the BPF side (see
+// core.Sched.SelectCPUByCapacity).
+func InitCpuCapacity(bpfModule *core.Sched) error {
+	caps, err := GetCPUCapacities()
+	if err != nil {
+		return err
+	}
+	for _, c := range caps {
+		err = bpfModule.SetCpuCapacity(int32(c.Cpu), c.Capacity)
+		if err != nil {
+			return fmt.Errorf("SetCpuCapacity failed: cpuId %v capacity %v: %w", c.Cpu, c.Capacity, err)
+		}
+	}
+	return nil
+}
+
+func readCPUList(path string) ([]int, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return parseCPUs(strings.TrimSpace(string(content)))
+}
+
+func readUint(path string) (uint64, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(content)), 10, 64)
+}
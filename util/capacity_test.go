@@ -0,0 +1,31 @@
+package util
+
+import (
+	"slices"
+	"testing"
+)
+
+// Favored cores are classified with the other performance cores.
+func TestCapacityClasses(t *testing.T) {
+	caps := []CPUCapacity{
+		{Cpu: 0, Capacity: 1024},
+		{Cpu: 1, Capacity: 1009},
+		{Cpu: 2, Capacity: 1009},
+		{Cpu: 3, Capacity: 605},
+		{Cpu: 4, Capacity: 605},
+	}
+	if got := PerformanceCPUs(caps); !slices.Equal(got, []int{0, 1, 2}) {
+		t.Errorf("PerformanceCPUs %v", got)
+	}
+	if got := EfficiencyCPUs(caps); !slices.Equal(got, []int{3, 4}) {
+		t.Errorf("EfficiencyCPUs %v", got)
+	}
+
+	symmetric := caps[:1]
+	if got := EfficiencyCPUs(symmetric); len(got) != 0 {
+		t.Errorf("EfficiencyCPUs on a symmetric system %v", got)
+	}
+	if got := PerformanceCPUs(symmetric); !slices.Equal(got, []int{0}) {
+		t.Errorf("PerformanceCPUs on a symmetric system %v", got)
+	}
+}
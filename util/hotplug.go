@@ -0,0 +1,40 @@
+package util
+
+import (
+	"context"
+	"fmt"
+
+	core "github.com/Gthulhu/qumun/goland_core"
+)
+
+// WatchHotplug waits for CPU hotplug events of bpfModule until ctx is done.
+// On every event the topology is read again and the cache and NUMA domains
+// are rebuilt on the BPF side from the online CPUs, then onChange (if not
+// nil) is called so that the policy can stop targeting offline CPUs.
+func WatchHotplug(ctx context.Context, bpfModule *core.Sched, onChange func(ev core.HotplugEvent, topo *Topology)) error {
+	events := bpfModule.HotplugEvents()
+	if events == nil {
+		return fmt.Errorf("hotplug events not available")
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case ev, ok := <-events:
+			if !ok {
+				return nil
+			}
+			topo, err := GetTopology()
+			if err != nil {
+				return err
+			}
+			err = initCacheDomains(bpfModule, topo)
+			if err != nil {
+				return err
+			}
+			if onChange != nil {
+				onChange(ev, topo)
+			}
+		}
+	}
+}
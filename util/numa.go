@@ -0,0 +1,65 @@
+package util
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	core "github.com/Gthulhu/qumun/goland_core"
+)
+
+// GetNumaNodes returns the CPUs of each NUMA node, keyed by node id. The map
+// is empty when the kernel exposes no NUMA information.
+func GetNumaNodes() (map[int][]int, error) {
+	return getNumaNodes("/sys/devices/system/node/")
+}
+
+func getNumaNodes(nodeDir string) (map[int][]int, error) {
+	nodes := map[int][]int{}
+	paths, err := filepath.Glob(filepath.Join(nodeDir, "node[0-9]*"))
+	if err != nil {
+		return nodes, err
+	}
+	for _, path := range paths {
+		id, err := strconv.Atoi(strings.TrimPrefix(filepath.Base(path), "node"))
+		if err != nil {
+			continue
+		}
+		content, err := os.ReadFile(filepath.Join(path, "cpulist"))
+		if err != nil {
+			return nodes, err
+		}
+		cpuList := strings.TrimSpace(string(content))
+		if cpuList == "" {
+			// Memory-only node.
+			continue
+		}
+		cpuIdList, err := parseCPUs(cpuList)
+		if err != nil {
+			return nodes, err
+		}
+		nodes[id] = cpuIdList
+	}
+	return nodes, nil
+}
+
+// InitNumaDomains pushes the NUMA node of every CPU to the BPF side, so that
+// idle CPU selection stays within the node before crossing it, and records
+// the node of every CPU in bpfModule (see Sched.NumaNodeOf).
+func InitNumaDomains(bpfModule *core.Sched) error {
+	topo, err := GetTopology()
+	if err != nil {
+		return err
+	}
+	return initNumaDomains(bpfModule, topo)
+}
+
+func initNumaDomains(bpfModule *core.Sched, topo *Topology) error {
+	for _, node := range topo.Nodes {
+		for _, cpuId := range node.CPUs {
+			bpfModule.SetCpuNumaNode(int32(cpuId), int32(node.ID))
+		}
+	}
+	return initDomains(bpfModule, core.DomainNuma, topo.Nodes, topo)
+}
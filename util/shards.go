@@ -0,0 +1,173 @@
+package util
+
+import (
+	"fmt"
+	"slices"
+
+	core "github.com/Gthulhu/qumun/goland_core"
+)
+
+// Sharding modes of the queue of the tasks sent to user space.
+const (
+	ShardNone = "none" // a single ring buffer
+	ShardCPU  = "cpu"  // one ring buffer per CPU
+	ShardLLC  = "llc"  // one ring buffer per last level cache
+)
+
+// QueuedShards maps the CPUs to the shards of the queue.
+type QueuedShards struct {
+	NrShards int
+	Shard    map[int]int // shard of each CPU
+}
+
+// PlanQueuedShards assigns the CPUs of topo to shards according to mode.
+// When there are more CPUs or LLCs than core.MaxQueuedShards, they are
+// grouped into blocks that follow the topology (see planCPUShards and
+// planLLCShards) rather than folded together. In that case, and in the llc
+// mode, CPUs without a known LLC (e.g. offline ones) use shard 0.
+func PlanQueuedShards(mode string, topo *Topology) (QueuedShards, error) {
+	plan := QueuedShards{NrShards: 1, Shard: map[int]int{}}
+	switch mode {
+	case ShardNone:
+		return plan, nil
+	case ShardCPU:
+		plan.NrShards = planCPUShards(topo, plan.Shard)
+	case ShardLLC:
+		plan.NrShards = planLLCShards(topo, plan.Shard)
+	default:
+		return plan, fmt.Errorf("unknown queued shard mode %q", mode)
+	}
+	plan.NrShards = max(plan.NrShards, 1)
+	return plan, nil
+}
+
+// planCPUShards gives each CPU of topo its own shard. Beyond
+// core.MaxQueuedShards CPUs, each LLC is split into blocks of contiguous
+// cores instead, with a number of shards proportional to its size, so that
+// a shard never spans two LLCs or NUMA nodes. With more LLCs than shards,
+// it falls back to whole LLCs, as planLLCShards.
+func planCPUShards(topo *Topology, shard map[int]int) int {
+	if len(topo.CPUs) <= core.MaxQueuedShards {
+		cpus := make([]int, 0, len(topo.CPUs))
+		for _, c := range topo.CPUs {
+			cpus = append(cpus, c.ID)
+		}
+		slices.Sort(cpus)
+		for i, cpu := range cpus {
+			shard[cpu] = i
+		}
+		return len(cpus)
+	}
+
+	groups := llcGroups(topo)
+	if len(groups) >= core.MaxQueuedShards {
+		return planLLCShards(topo, shard)
+	}
+	var n int
+	for _, g := range groups {
+		n += len(g)
+	}
+	// Every LLC gets a shard, and the others go to the LLCs with the
+	// largest remainders of their proportional share.
+	shares := make([]int, len(groups))
+	rems := make([]int, len(groups))
+	left := core.MaxQueuedShards
+	for i, g := range groups {
+		extra := (core.MaxQueuedShards - len(groups)) * len(g) / n
+		rems[i] = (core.MaxQueuedShards - len(groups)) * len(g) % n
+		shares[i] = min(1+extra, len(g))
+		left -= shares[i]
+	}
+	order := make([]int, len(groups))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int { return rems[b] - rems[a] })
+	for _, i := range order {
+		if left == 0 {
+			break
+		}
+		if shares[i] < len(groups[i]) {
+			shares[i]++
+			left--
+		}
+	}
+
+	next := 0
+	for i, g := range groups {
+		for j, cpu := range g {
+			shard[cpu] = next + j*shares[i]/len(g)
+		}
+		next += shares[i]
+	}
+	return next
+}
+
+// planLLCShards gives each LLC of topo its own shard. Beyond
+// core.MaxQueuedShards LLCs, contiguous LLCs, ordered by NUMA node, share a
+// shard.
+func planLLCShards(topo *Topology, shard map[int]int) int {
+	groups := llcGroups(topo)
+	nr := min(len(groups), core.MaxQueuedShards)
+	for i, g := range groups {
+		for _, cpu := range g {
+			shard[cpu] = i * nr / len(groups)
+		}
+	}
+	return nr
+}
+
+// llcGroups returns the CPUs of each LLC of topo, ordered by NUMA node, then
+// LLC, with the CPUs of a group ordered by core so that SMT siblings are
+// next to each other. CPUs without a known LLC are left out.
+func llcGroups(topo *Topology) [][]int {
+	cpus := slices.DeleteFunc(slices.Clone(topo.CPUs), func(c CPU) bool { return c.LLC < 0 })
+	slices.SortFunc(cpus, func(a, b CPU) int {
+		if a.Node != b.Node {
+			return a.Node - b.Node
+		}
+		if a.LLC != b.LLC {
+			return a.LLC - b.LLC
+		}
+		if a.Core != b.Core {
+			return a.Core - b.Core
+		}
+		return a.ID - b.ID
+	})
+	var groups [][]int
+	for i, c := range cpus {
+		if i == 0 || c.Node != cpus[i-1].Node || c.LLC != cpus[i-1].LLC {
+			groups = append(groups, nil)
+		}
+		groups[len(groups)-1] = append(groups[len(groups)-1], c.ID)
+	}
+	return groups
+}
+
+// InitQueuedShards publishes the shard of every CPU of plan to the BPF side.
+// bpfModule must have been started with plan.NrShards shards (see
+// core.Sched.SetQueuedShards).
+func InitQueuedShards(bpfModule *core.Sched, plan QueuedShards) error {
+	for cpu, shard := range plan.Shard {
+		if shard == 0 {
+			continue
+		}
+		err := bpfModule.SetQueuedShard(int32(cpu), uint32(shard))
+		if err != nil {
+			return fmt.Errorf("SetQueuedShard failed: cpuId %v shard %v: %w", cpu, shard, err)
+		}
+	}
+	return nil
+}
+
+// CPUs returns the CPUs assigned to shard, in increasing order.
+func (q QueuedShards) CPUs(shard int) []int {
+	var cpus []int
+	for cpu, s := range q.Shard {
+		if s == shard {
+			cpus = append(cpus, cpu)
+		}
+	}
+	slices.Sort(cpus)
+	return cpus
+}
@@ -0,0 +1,108 @@
+package util
+
+import (
+	"slices"
+	"testing"
+
+	core "github.com/Gthulhu/qumun/goland_core"
+)
+
+// gridTopology has nodes NUMA nodes of llcs LLCs of cpus CPUs each, the
+// CPUs numbered in that order, plus offline CPUs without a known LLC.
+func gridTopology(nodes, llcs, cpus, offline int) *Topology {
+	topo := &Topology{}
+	for n := 0; n < nodes; n++ {
+		for l := 0; l < llcs; l++ {
+			llc := Domain{ID: len(topo.LLCs)}
+			for c := 0; c < cpus; c++ {
+				id := len(topo.CPUs)
+				topo.CPUs = append(topo.CPUs, CPU{ID: id, Online: true, Node: n, LLC: llc.ID, Core: id})
+				llc.CPUs = append(llc.CPUs, id)
+			}
+			topo.LLCs = append(topo.LLCs, llc)
+		}
+	}
+	for i := 0; i < offline; i++ {
+		topo.CPUs = append(topo.CPUs, CPU{ID: len(topo.CPUs), Package: -1, Node: -1, LLC: -1, L2: -1, Core: -1})
+	}
+	return topo
+}
+
+func TestPlanQueuedShards(t *testing.T) {
+	tests := []struct {
+		name     string
+		mode     string
+		topo     *Topology
+		nrShards int
+	}{
+		{"none", ShardNone, gridTopology(1, 1, 8, 0), 1},
+		{"cpu", ShardCPU, gridTopology(1, 2, 8, 0), 16},
+		{"cpu, 32 cpus", ShardCPU, gridTopology(2, 1, 16, 0), 32},
+		{"cpu, 2 nodes of 64", ShardCPU, gridTopology(2, 1, 64, 0), 32},
+		{"cpu, uneven llcs", ShardCPU, gridTopology(1, 3, 20, 4), 32},
+		{"cpu, many llcs", ShardCPU, gridTopology(4, 16, 2, 0), 32},
+		{"llc", ShardLLC, gridTopology(2, 2, 4, 2), 4},
+		{"llc, many llcs", ShardLLC, gridTopology(4, 16, 2, 0), 32},
+	}
+	for _, tt := range tests {
+		plan, err := PlanQueuedShards(tt.mode, tt.topo)
+		if err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		if plan.NrShards != tt.nrShards {
+			t.Errorf("%s: %d shards, want %d", tt.name, plan.NrShards, tt.nrShards)
+		}
+		for shard := 0; shard < plan.NrShards; shard++ {
+			cpus := plan.CPUs(shard)
+			if len(cpus) == 0 && tt.mode != ShardNone {
+				t.Errorf("%s: shard %d has no CPU", tt.name, shard)
+				continue
+			}
+			// A shard is a block of consecutive CPUs of a single NUMA
+			// node.
+			for i, cpu := range cpus {
+				c, _ := tt.topo.CPU(cpu)
+				first, _ := tt.topo.CPU(cpus[0])
+				if c.Node != first.Node || cpu != cpus[0]+i {
+					t.Errorf("%s: shard %d has cpus %v", tt.name, shard, cpus)
+					break
+				}
+			}
+		}
+		// CPUs without an LLC stay on shard 0 once CPUs are grouped.
+		grouped := tt.mode == ShardLLC || len(tt.topo.CPUs) > core.MaxQueuedShards
+		for _, c := range tt.topo.CPUs {
+			if _, ok := plan.Shard[c.ID]; ok && c.LLC < 0 && grouped {
+				t.Errorf("%s: cpu %d without an LLC has a shard", tt.name, c.ID)
+			}
+		}
+	}
+	if _, err := PlanQueuedShards("numa", gridTopology(1, 1, 1, 0)); err == nil {
+		t.Error("unknown mode accepted")
+	}
+}
+
+func TestPlanQueuedShardsLLCAligned(t *testing.T) {
+	// 3 LLCs of 20 CPUs share the 32 shards: 11, 11 and 10 of them, each
+	// holding 1 or 2 CPUs of a single LLC.
+	topo := gridTopology(1, 3, 20, 0)
+	plan, err := PlanQueuedShards(ShardCPU, topo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var perLLC [3]int
+	for shard := 0; shard < plan.NrShards; shard++ {
+		cpus := plan.CPUs(shard)
+		if len(cpus) < 1 || len(cpus) > 2 {
+			t.Errorf("shard %d has cpus %v", shard, cpus)
+		}
+		llc := cpus[0] / 20
+		if cpus[len(cpus)-1]/20 != llc {
+			t.Errorf("shard %d spans two LLCs: %v", shard, cpus)
+		}
+		perLLC[llc]++
+	}
+	if got := perLLC[:]; !slices.Equal(got, []int{11, 11, 10}) {
+		t.Errorf("shards per LLC %v", got)
+	}
+}
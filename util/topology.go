@@ -2,15 +2,23 @@ package util
 
 import (
 	"fmt"
-	"io/fs"
 	"os"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 
 	core "github.com/Gthulhu/qumun/goland_core"
 )
 
+// ParseCPUList parses a CPU list in the sysfs format (e.g. "0-3,8").
+func ParseCPUList(cpuList string) ([]int, error) {
+	if strings.TrimSpace(cpuList) == "" {
+		return nil, nil
+	}
+	return parseCPUs(cpuList)
+}
+
 func parseCPUs(cpuList string) ([]int, error) {
 	var result []int
 	segments := strings.Split(cpuList, ",")
@@ -51,80 +59,306 @@ func parseCPUs(cpuList string) ([]int, error) {
 	return result, nil
 }
 
-func GetTopology() (map[string]map[string][]int, error) {
-	cacheDir := "/sys/devices/system/cpu/"
-	cacheMap := map[string]map[string][]int{
-		"L2": {},
-		"L3": {},
+// Domain is a group of CPUs sharing a hardware resource (package, NUMA
+// node, cache or core).
+type Domain struct {
+	ID   int   `json:"id"`
+	CPUs []int `json:"cpus"`
+}
+
+// CPU describes the position of a CPU in the topology. Domain indices are
+// -1 when the information is not available (e.g. offline CPUs).
+type CPU struct {
+	ID      int  `json:"id"`
+	Online  bool `json:"online"`
+	Package int  `json:"package"` // index in Topology.Packages
+	Node    int  `json:"node"`    // index in Topology.Nodes
+	LLC     int  `json:"llc"`     // index in Topology.LLCs
+	L2      int  `json:"l2"`      // index in Topology.L2s
+	Core    int  `json:"core"`    // index in Topology.Cores
+}
+
+// Topology is the CPU topology of the system.
+type Topology struct {
+	CPUs     []CPU    `json:"cpus"`
+	Packages []Domain `json:"packages"`
+	Nodes    []Domain `json:"nodes"`
+	LLCs     []Domain `json:"llcs"` // last level caches
+	L2s      []Domain `json:"l2s"`
+	Cores    []Domain `json:"cores"` // SMT siblings of each physical core
+}
+
+// GetTopology reads the topology of the running system.
+func GetTopology() (*Topology, error) {
+	return NewTopology("/sys")
+}
+
+// NewTopology reads the topology from a sysfs tree mounted at root, which
+// allows using fixture directories.
+func NewTopology(root string) (*Topology, error) {
+	cpuDir := filepath.Join(root, "devices/system/cpu")
+	possible, err := readCPUList(filepath.Join(cpuDir, "possible"))
+	if err != nil {
+		return nil, err
 	}
+	online := map[int]bool{}
+	if cpus, err := readCPUList(filepath.Join(cpuDir, "online")); err == nil {
+		for _, cpu := range cpus {
+			online[cpu] = true
+		}
+	} else {
+		for _, cpu := range possible {
+			online[cpu] = true
+		}
+	}
+
+	topo := &Topology{}
+	var packages, llcs, l2s, cores domainSet
+	for _, id := range possible {
+		base := filepath.Join(cpuDir, fmt.Sprintf("cpu%d", id))
+		cpu := CPU{ID: id, Online: online[id], Package: -1, Node: -1, LLC: -1, L2: -1, Core: -1}
+
+		if pkg, err := readUint(filepath.Join(base, "topology/physical_package_id")); err == nil {
+			cpu.Package = packages.addID(int(pkg), id)
+		}
+		if list, err := readFirst(filepath.Join(base, "topology/core_cpus_list"),
+			filepath.Join(base, "topology/thread_siblings_list")); err == nil {
+			cpu.Core = cores.addList(list)
+		}
 
-	err := filepath.Walk(cacheDir, func(path string, info fs.FileInfo, err error) error {
+		caches, err := readCaches(base)
 		if err != nil {
-			return err
+			return nil, err
 		}
-		var content []byte
-		var key string
-		if strings.HasSuffix(path, "shared_cpu_list") {
-			if strings.Contains(path, "/cache/index2/") {
-				content, err = os.ReadFile(path)
-				if err != nil {
-					return err
-				}
-				key = "L2"
-
-			} else if strings.Contains(path, "/cache/index3/") {
-				content, err = os.ReadFile(path)
-				if err != nil {
-					return err
-				}
-				key = "L3"
+		llcLevel := 0
+		for _, c := range caches {
+			llcLevel = max(llcLevel, c.level)
+		}
+		for _, c := range caches {
+			if c.level == 2 {
+				cpu.L2 = l2s.addList(c.cpuList)
 			}
-			cpuIdList, err := parseCPUs(strings.TrimSpace(string(content)))
-			if err != nil {
-				return nil
+			if c.level == llcLevel {
+				cpu.LLC = llcs.addList(c.cpuList)
+			}
+		}
+		topo.CPUs = append(topo.CPUs, cpu)
+	}
+
+	nodes, err := getNumaNodes(filepath.Join(root, "devices/system/node"))
+	if err != nil {
+		return nil, err
+	}
+	nodeIDs := make([]int, 0, len(nodes))
+	for id := range nodes {
+		nodeIDs = append(nodeIDs, id)
+	}
+	sort.Ints(nodeIDs)
+	for i, id := range nodeIDs {
+		topo.Nodes = append(topo.Nodes, Domain{ID: id, CPUs: nodes[id]})
+		for _, cpuId := range nodes[id] {
+			if c := topo.cpu(cpuId); c != nil {
+				c.Node = i
 			}
-			cacheMap[key][strings.TrimSpace(string(content))] = cpuIdList
 		}
+	}
+
+	topo.Packages = packages.domains
+	topo.LLCs = llcs.domains
+	topo.L2s = l2s.domains
+	topo.Cores = cores.domains
+	return topo, nil
+}
+
+// CPU returns the CPU with the given id.
+func (t *Topology) CPU(id int) (CPU, bool) {
+	if c := t.cpu(id); c != nil {
+		return *c, true
+	}
+	return CPU{}, false
+}
+
+func (t *Topology) cpu(id int) *CPU {
+	for i := range t.CPUs {
+		if t.CPUs[i].ID == id {
+			return &t.CPUs[i]
+		}
+	}
+	return nil
+}
+
+// OnlineCPUs returns the ids of the online CPUs.
+func (t *Topology) OnlineCPUs() []int {
+	var cpus []int
+	for _, c := range t.CPUs {
+		if c.Online {
+			cpus = append(cpus, c.ID)
+		}
+	}
+	return cpus
+}
+
+// SiblingsOf returns the other SMT threads of the core of cpu.
+func (t *Topology) SiblingsOf(cpu int) []int {
+	core, ok := t.CoreOf(cpu)
+	if !ok {
 		return nil
-	})
+	}
+	var sibs []int
+	for _, c := range core.CPUs {
+		if c != cpu {
+			sibs = append(sibs, c)
+		}
+	}
+	return sibs
+}
+
+// CoreOf returns the physical core of cpu.
+func (t *Topology) CoreOf(cpu int) (Domain, bool) {
+	return lookupDomain(t, cpu, t.Cores, func(c *CPU) int { return c.Core })
+}
+
+// L2Of returns the L2 cache domain of cpu.
+func (t *Topology) L2Of(cpu int) (Domain, bool) {
+	return lookupDomain(t, cpu, t.L2s, func(c *CPU) int { return c.L2 })
+}
+
+// LLCOf returns the last level cache domain of cpu.
+func (t *Topology) LLCOf(cpu int) (Domain, bool) {
+	return lookupDomain(t, cpu, t.LLCs, func(c *CPU) int { return c.LLC })
+}
+
+// NodeOf returns the NUMA node of cpu.
+func (t *Topology) NodeOf(cpu int) (Domain, bool) {
+	return lookupDomain(t, cpu, t.Nodes, func(c *CPU) int { return c.Node })
+}
+
+func lookupDomain(t *Topology, cpu int, domains []Domain, idx func(c *CPU) int) (Domain, bool) {
+	c := t.cpu(cpu)
+	if c == nil {
+		return Domain{}, false
+	}
+	i := idx(c)
+	if i < 0 || i >= len(domains) {
+		return Domain{}, false
+	}
+	return domains[i], true
+}
+
+// domainSet builds a list of domains, deduplicated by id or by CPU list.
+type domainSet struct {
+	domains []Domain
+	index   map[string]int
+}
+
+func (s *domainSet) add(key string, id int, cpus []int) int {
+	if s.index == nil {
+		s.index = map[string]int{}
+	}
+	if i, ok := s.index[key]; ok {
+		return i
+	}
+	s.domains = append(s.domains, Domain{ID: id, CPUs: cpus})
+	s.index[key] = len(s.domains) - 1
+	return len(s.domains) - 1
+}
+
+func (s *domainSet) addID(id int, cpu int) int {
+	i := s.add(strconv.Itoa(id), id, nil)
+	s.domains[i].CPUs = append(s.domains[i].CPUs, cpu)
+	return i
+}
 
+func (s *domainSet) addList(cpuList string) int {
+	cpus, err := parseCPUs(cpuList)
 	if err != nil {
-		return cacheMap, err
+		return -1
 	}
+	return s.add(cpuList, len(s.domains), cpus)
+}
 
-	return cacheMap, nil
+type cacheInfo struct {
+	level   int
+	cpuList string
 }
 
-func initCacheDomains(bpfModule *core.Sched, level int32) error {
-	topo, err := GetTopology()
+// readCaches returns the data and unified caches of the CPU at base.
+func readCaches(base string) ([]cacheInfo, error) {
+	dirs, err := filepath.Glob(filepath.Join(base, "cache/index[0-9]*"))
 	if err != nil {
-		return err
+		return nil, err
 	}
-	l := "L2"
-	if level == 3 {
-		l = "L3"
-	}
-	for _, cpuIdList := range topo[l] {
-		for _, cpuId := range cpuIdList {
-			for _, sibCpuId := range cpuIdList {
-				err = bpfModule.EnableSiblingCpu(level, int32(cpuId), int32(sibCpuId))
-				if err != nil {
-					return fmt.Errorf("EnableSiblingCpu failed: lvl %v cpuId %v sibCpuId %v", level, cpuId, sibCpuId)
-				}
+	var caches []cacheInfo
+	for _, dir := range dirs {
+		typ, err := os.ReadFile(filepath.Join(dir, "type"))
+		if err == nil && strings.TrimSpace(string(typ)) == "Instruction" {
+			continue
+		}
+		level, err := readUint(filepath.Join(dir, "level"))
+		if err != nil {
+			continue
+		}
+		list, err := os.ReadFile(filepath.Join(dir, "shared_cpu_list"))
+		if err != nil {
+			continue
+		}
+		caches = append(caches, cacheInfo{int(level), strings.TrimSpace(string(list))})
+	}
+	return caches, nil
+}
+
+// readFirst returns the trimmed content of the first readable file.
+func readFirst(paths ...string) (string, error) {
+	var err error
+	for _, path := range paths {
+		var content []byte
+		content, err = os.ReadFile(path)
+		if err == nil {
+			return strings.TrimSpace(string(content)), nil
+		}
+	}
+	return "", err
+}
+
+// initDomains replaces the level domain of every CPU of domains with the
+// online CPUs of its domain, so it can be called again after a topology
+// change.
+func initDomains(bpfModule *core.Sched, level int32, domains []Domain, topo *Topology) error {
+	for _, d := range domains {
+		var siblings []int
+		for _, cpuId := range d.CPUs {
+			if c, ok := topo.CPU(cpuId); ok && c.Online {
+				siblings = append(siblings, cpuId)
+			}
+		}
+		for _, cpuId := range d.CPUs {
+			err := bpfModule.SetCacheDomain(level, int32(cpuId), siblings)
+			if err != nil {
+				return fmt.Errorf("SetCacheDomain failed: lvl %v cpuId %v siblings %v: %w", level, cpuId, siblings, err)
 			}
 		}
 	}
 	return nil
 }
 
+// InitCacheDomains pushes the L2, LLC and NUMA domains of every CPU to the
+// BPF side.
 func InitCacheDomains(bpfModule *core.Sched) error {
-	err := initCacheDomains(bpfModule, 2)
+	topo, err := GetTopology()
 	if err != nil {
 		return err
 	}
-	err = initCacheDomains(bpfModule, 3)
+	return initCacheDomains(bpfModule, topo)
+}
+
+func initCacheDomains(bpfModule *core.Sched, topo *Topology) error {
+	err := initDomains(bpfModule, core.DomainL2, topo.L2s, topo)
 	if err != nil {
 		return err
 	}
-	return nil
+	err = initDomains(bpfModule, core.DomainL3, topo.LLCs, topo)
+	if err != nil {
+		return err
+	}
+	return initNumaDomains(bpfModule, topo)
 }
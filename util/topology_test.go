@@ -0,0 +1,170 @@
+package util
+
+import (
+	"path/filepath"
+	"reflect"
+	"slices"
+	"testing"
+)
+
+func cpuRange(from, to int) []int {
+	var cpus []int
+	for c := from; c <= to; c++ {
+		cpus = append(cpus, c)
+	}
+	return cpus
+}
+
+// singletons returns one domain per CPU of cpus.
+func singletons(cpus ...int) []Domain {
+	var domains []Domain
+	for i, c := range cpus {
+		domains = append(domains, Domain{ID: i, CPUs: []int{c}})
+	}
+	return domains
+}
+
+func TestNewTopology(t *testing.T) {
+	tests := []struct {
+		name     string
+		online   []int
+		packages []Domain
+		nodes    []Domain
+		llcs     []Domain
+		l2s      []Domain
+		cores    []Domain
+		cpus     map[int]CPU // a few CPUs to check in detail
+		siblings map[int][]int
+	}{
+		{
+			name:     "smt",
+			online:   cpuRange(0, 7),
+			packages: []Domain{{0, cpuRange(0, 7)}},
+			nodes:    []Domain{{0, cpuRange(0, 7)}},
+			llcs:     []Domain{{0, cpuRange(0, 7)}},
+			l2s:      []Domain{{0, []int{0, 4}}, {1, []int{1, 5}}, {2, []int{2, 6}}, {3, []int{3, 7}}},
+			cores:    []Domain{{0, []int{0, 4}}, {1, []int{1, 5}}, {2, []int{2, 6}}, {3, []int{3, 7}}},
+			cpus: map[int]CPU{
+				5: {ID: 5, Online: true, Package: 0, Node: 0, LLC: 0, L2: 1, Core: 1},
+			},
+			siblings: map[int][]int{0: {4}, 7: {3}},
+		},
+		{
+			name:     "hybrid",
+			online:   cpuRange(0, 7),
+			packages: []Domain{{0, cpuRange(0, 7)}},
+			nodes:    []Domain{{0, cpuRange(0, 7)}},
+			llcs:     []Domain{{0, cpuRange(0, 7)}},
+			l2s:      []Domain{{0, []int{0, 1}}, {1, []int{2, 3}}, {2, cpuRange(4, 7)}},
+			cores:    []Domain{{0, []int{0, 1}}, {1, []int{2, 3}}, {2, []int{4}}, {3, []int{5}}, {4, []int{6}}, {5, []int{7}}},
+			cpus: map[int]CPU{
+				3: {ID: 3, Online: true, Package: 0, Node: 0, LLC: 0, L2: 1, Core: 1},
+				6: {ID: 6, Online: true, Package: 0, Node: 0, LLC: 0, L2: 2, Core: 4},
+			},
+			siblings: map[int][]int{2: {3}, 6: nil},
+		},
+		{
+			name:     "multi-llc",
+			online:   cpuRange(0, 7),
+			packages: []Domain{{0, cpuRange(0, 3)}, {1, cpuRange(4, 7)}},
+			nodes:    []Domain{{0, cpuRange(0, 3)}, {1, cpuRange(4, 7)}},
+			llcs:     []Domain{{0, cpuRange(0, 3)}, {1, cpuRange(4, 7)}},
+			l2s:      singletons(cpuRange(0, 7)...),
+			cores:    singletons(cpuRange(0, 7)...),
+			cpus: map[int]CPU{
+				1: {ID: 1, Online: true, Package: 0, Node: 0, LLC: 0, L2: 1, Core: 1},
+				6: {ID: 6, Online: true, Package: 1, Node: 1, LLC: 1, L2: 6, Core: 6},
+			},
+			siblings: map[int][]int{4: nil},
+		},
+		{
+			name:     "offline",
+			online:   cpuRange(0, 2),
+			packages: []Domain{{0, cpuRange(0, 2)}},
+			nodes:    []Domain{{0, cpuRange(0, 2)}},
+			llcs:     []Domain{{0, cpuRange(0, 2)}},
+			l2s:      singletons(0, 1, 2),
+			cores:    singletons(0, 1, 2),
+			cpus: map[int]CPU{
+				2: {ID: 2, Online: true, Package: 0, Node: 0, LLC: 0, L2: 2, Core: 2},
+				3: {ID: 3, Online: false, Package: -1, Node: -1, LLC: -1, L2: -1, Core: -1},
+			},
+			siblings: map[int][]int{3: nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			topo, err := NewTopology(filepath.Join("testdata", tt.name, "sys"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := topo.OnlineCPUs(); !slices.Equal(got, tt.online) {
+				t.Errorf("online %v, want %v", got, tt.online)
+			}
+			for _, d := range []struct {
+				level     string
+				got, want []Domain
+			}{
+				{"packages", topo.Packages, tt.packages},
+				{"nodes", topo.Nodes, tt.nodes},
+				{"llcs", topo.LLCs, tt.llcs},
+				{"l2s", topo.L2s, tt.l2s},
+				{"cores", topo.Cores, tt.cores},
+			} {
+				if !reflect.DeepEqual(d.got, d.want) {
+					t.Errorf("%s %v, want %v", d.level, d.got, d.want)
+				}
+			}
+			for id, want := range tt.cpus {
+				if got, ok := topo.CPU(id); !ok || got != want {
+					t.Errorf("cpu %d: %+v, want %+v", id, got, want)
+				}
+			}
+			for id, want := range tt.siblings {
+				if got := topo.SiblingsOf(id); !slices.Equal(got, want) {
+					t.Errorf("siblings of %d: %v, want %v", id, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestNewTopologyMissing(t *testing.T) {
+	if _, err := NewTopology(filepath.Join("testdata", "missing")); err == nil {
+		t.Error("NewTopology succeeded without a sysfs tree")
+	}
+}
+
+func TestGetCPUCapacities(t *testing.T) {
+	dir := func(name string) (string, string) {
+		sys := filepath.Join("testdata", name, "sys")
+		return filepath.Join(sys, "devices/system/cpu"), filepath.Join(sys, "devices")
+	}
+
+	caps, err := getCPUCapacities(dir("hybrid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range caps {
+		want := CPUCapacity{Cpu: c.Cpu, Capacity: 1024, MaxFreqKHz: 5000000, CoreType: CoreTypePerformance}
+		if c.Cpu >= 4 {
+			want = CPUCapacity{Cpu: c.Cpu, Capacity: 778, MaxFreqKHz: 3800000, CoreType: CoreTypeEfficiency}
+		}
+		if c != want {
+			t.Errorf("hybrid: %+v, want %+v", c, want)
+		}
+	}
+
+	caps, err = getCPUCapacities(dir("smt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(caps) != 8 || IsAsymmetric(caps) {
+		t.Errorf("smt: %+v", caps)
+	}
+	for _, c := range caps {
+		if c.Capacity != 1024 || c.CoreType != CoreTypeUnknown {
+			t.Errorf("smt: %+v", c)
+		}
+	}
+}
@@ -10,6 +10,10 @@ void *open_skel() {
     return obj->obj;
 }
 
+const void *get_elf_bytes(size_t *sz) {
+    return main_bpf__elf_bytes(sz);
+}
+
 u32 get_usersched_pid() {
     return global_obj->rodata->usersched_pid;
 }
@@ -30,6 +34,36 @@ void set_default_slice(u64 t) {
     global_obj->rodata->default_slice = t;
 }
 
+void set_switch_partial(bool enabled) {
+    global_obj->rodata->switch_partial = enabled;
+    if (enabled)
+        global_obj->struct_ops.goland->flags |= SCX_OPS_SWITCH_PARTIAL;
+    else
+        global_obj->struct_ops.goland->flags &= ~SCX_OPS_SWITCH_PARTIAL;
+}
+
+void set_heartbeat_period(u64 ns) {
+    global_obj->rodata->usersched_timer_ns = ns;
+}
+
+void set_timeout_ms(u32 ms) {
+    global_obj->struct_ops.goland->timeout_ms = ms;
+}
+
+void set_congestion(u64 ring_bytes, u64 high_watermark, u64 interactive_ns) {
+    global_obj->rodata->queued_ring_bytes = ring_bytes;
+    global_obj->rodata->queued_high_watermark = high_watermark;
+    global_obj->rodata->interactive_runtime_ns = interactive_ns;
+}
+
+u32 get_queued_task_ctx_size() {
+    return global_obj->rodata->queued_task_ctx_size;
+}
+
+void set_nr_queued_shards(u32 nr) {
+    global_obj->rodata->nr_queued_shards = nr;
+}
+
 void set_debug(bool enabled) {
     global_obj->rodata->debug = enabled;
 }
@@ -50,10 +84,21 @@ void notify_complete(u64 nr_pending) {
     global_obj->bss->nr_scheduled = nr_pending;
 }
 
+void set_trace_sample_rate(u32 rate) {
+    global_obj->bss->trace_sample_rate = rate;
+}
+
+void set_starvation_ns(u64 ns) {
+    global_obj->bss->starvation_ns = ns;
+}
+
 void sub_nr_queued() {
-    if (global_obj->bss->nr_queued){
-        global_obj->bss->nr_queued--;
-    }
+    u64 nr = __atomic_load_n(&global_obj->bss->nr_queued, __ATOMIC_RELAXED);
+
+    /* Dispatch workers may dequeue concurrently (see core.Worker). */
+    while (nr && !__atomic_compare_exchange_n(&global_obj->bss->nr_queued, &nr, nr - 1,
+                                              false, __ATOMIC_RELAXED, __ATOMIC_RELAXED))
+        ;
 }
 
 void destroy_skel(void*skel) {
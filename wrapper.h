@@ -42,8 +42,13 @@ struct user_exit_info {
 };
 #include "main.skeleton.h"
 
+/* enum scx_ops_flags */
+#define SCX_OPS_SWITCH_PARTIAL (1LLU << 3)
+
 void *open_skel();
 
+const void *get_elf_bytes(size_t *sz);
+
 u32 get_usersched_pid();
 
 void set_usersched_pid(u32 id);
@@ -58,12 +63,26 @@ void set_early_processing(bool enabled);
 
 void set_default_slice(u64 t);
 
+void set_switch_partial(bool enabled);
+
+void set_heartbeat_period(u64 ns);
+
+void set_timeout_ms(u32 ms);
+
+void set_congestion(u64 ring_bytes, u64 high_watermark, u64 interactive_ns);
+u32 get_queued_task_ctx_size();
+void set_nr_queued_shards(u32 nr);
+
 u64 get_nr_scheduled();
 
 u64 get_nr_queued();
 
 void notify_complete(u64 nr_pending);
 
+void set_trace_sample_rate(u32 rate);
+
+void set_starvation_ns(u64 ns);
+
 void sub_nr_queued();
 
 void destroy_skel(void *);